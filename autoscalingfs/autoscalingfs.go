@@ -0,0 +1,508 @@
+package autoscalingfs
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/jszwedko/ec2-metadatafs/internal/fuseutil"
+	"github.com/jszwedko/ec2-metadatafs/logger"
+)
+
+// The filesystem holds a file per value of the instance's Auto Scaling group:
+//
+//   - group-name, desired-capacity, min-size and max-size: the group
+//   - lifecycle-state, health-status and protected-from-scale-in: the
+//     instance within the group
+//   - launch-template-id, launch-template-name and launch-template-version, or
+//     launch-configuration-name: what the instance was launched from
+//
+// and a directory per lifecycle hook of the group under lifecycle-hooks/,
+// with the hook's transition, default-result and heartbeat-timeout, and two
+// write-only files acting on the instance's pending lifecycle action:
+//
+//   - complete: writing CONTINUE or ABANDON completes the action
+//   - heartbeat: closing it after opening it for writing, e.g. with `touch`,
+//     records a heartbeat
+//
+// The action is taken when the file is closed, failing the close if the API
+// call fails. Only the owner of the mount and root can take actions (see
+// fuseutil.Allowed). The root is empty if the instance is not in a group.
+
+const (
+	hooksDir      = "lifecycle-hooks"
+	completeFile  = "complete"
+	heartbeatFile = "heartbeat"
+)
+
+// maxActionSize is the most that can be written to an action file, plenty
+// for CONTINUE or ABANDON and a newline
+const maxActionSize = 64
+
+// AutoScalingAPI is the part of the Auto Scaling API client used
+// Satisfied by *autoscaling.Client
+type AutoScalingAPI interface {
+	DescribeAutoScalingInstances(ctx context.Context, params *autoscaling.DescribeAutoScalingInstancesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingInstancesOutput, error)
+	DescribeAutoScalingGroups(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error)
+	DescribeLifecycleHooks(ctx context.Context, params *autoscaling.DescribeLifecycleHooksInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeLifecycleHooksOutput, error)
+	CompleteLifecycleAction(ctx context.Context, params *autoscaling.CompleteLifecycleActionInput, optFns ...func(*autoscaling.Options)) (*autoscaling.CompleteLifecycleActionOutput, error)
+	RecordLifecycleActionHeartbeat(ctx context.Context, params *autoscaling.RecordLifecycleActionHeartbeatInput, optFns ...func(*autoscaling.Options)) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error)
+}
+
+// AutoScalingFs represents a filesystem that exposes the Auto Scaling group
+// of an instance
+// Satisfies pathfs.FileSystem
+type AutoScalingFs struct {
+	pathfs.FileSystem
+
+	Client     AutoScalingAPI
+	InstanceID string
+	Logger     logger.LeveledLogger
+
+	// RefreshInterval is how long the group is served before it is described
+	// again, 0 to describe it on every access
+	RefreshInterval time.Duration
+
+	mu      sync.Mutex
+	group   *group
+	fetched time.Time
+}
+
+// group is what is known of the instance's group, nil if it is in none
+type group struct {
+	name   string
+	values map[string]string
+	hooks  map[string]map[string]string
+}
+
+// New initializes a new AutoScalingFs for the instance with the given ID
+func New(client AutoScalingAPI, instanceID string, l logger.LeveledLogger) *AutoScalingFs {
+	return &AutoScalingFs{
+		FileSystem: pathfs.NewReadonlyFileSystem(pathfs.NewDefaultFileSystem()),
+		Client:     client,
+		InstanceID: instanceID,
+		Logger:     l,
+	}
+}
+
+// describe returns the instance's group, describing it again if it is older
+// than RefreshInterval
+func (fs *AutoScalingFs) describe(ctx context.Context) (*group, fuse.Status) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.fetched.IsZero() && time.Since(fs.fetched) < fs.RefreshInterval {
+		return fs.group, fuse.OK
+	}
+
+	g, err := fs.describeGroup(ctx)
+	if err != nil {
+		fs.Logger.Errorf("failed to query AWS API for Auto Scaling group: %s", err)
+		return nil, fuseutil.ErrorStatus(err, errorCodes)
+	}
+
+	fs.group = g
+	fs.fetched = time.Now()
+	return g, fuse.OK
+}
+
+// invalidate makes the next access describe the group again
+func (fs *AutoScalingFs) invalidate() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.fetched = time.Time{}
+}
+
+// describeGroup fetches the instance's group and its lifecycle hooks
+func (fs *AutoScalingFs) describeGroup(ctx context.Context) (*group, error) {
+	fs.Logger.Debugf("issuing request to AWS API for Auto Scaling group of %s", fs.InstanceID)
+
+	instances, err := fs.Client.DescribeAutoScalingInstances(ctx, &autoscaling.DescribeAutoScalingInstancesInput{
+		InstanceIds: []string{fs.InstanceID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(instances.AutoScalingInstances) == 0 {
+		fs.Logger.Debugf("%s is not in an Auto Scaling group", fs.InstanceID)
+		return nil, nil
+	}
+
+	instance := instances.AutoScalingInstances[0]
+	g := &group{
+		name: aws.ToString(instance.AutoScalingGroupName),
+		values: map[string]string{
+			"group-name":              aws.ToString(instance.AutoScalingGroupName),
+			"lifecycle-state":         aws.ToString(instance.LifecycleState),
+			"health-status":           aws.ToString(instance.HealthStatus),
+			"protected-from-scale-in": strconv.FormatBool(aws.ToBool(instance.ProtectedFromScaleIn)),
+		},
+		hooks: map[string]map[string]string{},
+	}
+	if template := instance.LaunchTemplate; template != nil {
+		g.values["launch-template-id"] = aws.ToString(template.LaunchTemplateId)
+		g.values["launch-template-name"] = aws.ToString(template.LaunchTemplateName)
+		g.values["launch-template-version"] = aws.ToString(template.Version)
+	}
+	if instance.LaunchConfigurationName != nil {
+		g.values["launch-configuration-name"] = aws.ToString(instance.LaunchConfigurationName)
+	}
+
+	groups, err := fs.Client.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []string{g.name},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, asg := range groups.AutoScalingGroups {
+		g.values["desired-capacity"] = strconv.Itoa(int(aws.ToInt32(asg.DesiredCapacity)))
+		g.values["min-size"] = strconv.Itoa(int(aws.ToInt32(asg.MinSize)))
+		g.values["max-size"] = strconv.Itoa(int(aws.ToInt32(asg.MaxSize)))
+	}
+
+	hooks, err := fs.Client.DescribeLifecycleHooks(ctx, &autoscaling.DescribeLifecycleHooksInput{
+		AutoScalingGroupName: aws.String(g.name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, hook := range hooks.LifecycleHooks {
+		g.hooks[aws.ToString(hook.LifecycleHookName)] = map[string]string{
+			"transition":        aws.ToString(hook.LifecycleTransition),
+			"default-result":    aws.ToString(hook.DefaultResult),
+			"heartbeat-timeout": strconv.Itoa(int(aws.ToInt32(hook.HeartbeatTimeout))),
+		}
+	}
+
+	return g, nil
+}
+
+// node is what a path refers to
+type node struct {
+	dir     bool
+	value   string
+	hook    string
+	action  string
+	entries []fuse.DirEntry
+}
+
+// lookup returns what name refers to, ok is false if it does not exist
+func (fs *AutoScalingFs) lookup(name string, context *fuse.Context) (n node, ok bool, code fuse.Status) {
+	g, code := fs.describe(fuseutil.RequestContext(context))
+	if code != fuse.OK {
+		return node{}, false, code
+	}
+
+	if name == "" {
+		n := node{dir: true, entries: []fuse.DirEntry{}}
+		if g != nil {
+			n.entries = append(fileEntries(g.values), fuse.DirEntry{Name: hooksDir, Mode: fuse.S_IFDIR})
+			sortEntries(n.entries)
+		}
+		return n, true, fuse.OK
+	}
+	if g == nil {
+		return node{}, false, fuse.OK
+	}
+
+	components := strings.Split(name, "/")
+	if len(components) == 1 {
+		if name == hooksDir {
+			n := node{dir: true, entries: []fuse.DirEntry{}}
+			for hook := range g.hooks {
+				n.entries = append(n.entries, fuse.DirEntry{Name: hook, Mode: fuse.S_IFDIR})
+			}
+			sortEntries(n.entries)
+			return n, true, fuse.OK
+		}
+
+		value, ok := g.values[name]
+		return node{value: value}, ok, fuse.OK
+	}
+
+	if components[0] != hooksDir {
+		return node{}, false, fuse.OK
+	}
+	hookName := components[1]
+	hook, ok := g.hooks[hookName]
+	if !ok {
+		return node{}, false, fuse.OK
+	}
+
+	switch len(components) {
+	case 2:
+		n := node{dir: true, entries: fileEntries(hook)}
+		n.entries = append(n.entries,
+			fuse.DirEntry{Name: completeFile, Mode: fuse.S_IFREG},
+			fuse.DirEntry{Name: heartbeatFile, Mode: fuse.S_IFREG})
+		sortEntries(n.entries)
+		return n, true, fuse.OK
+	case 3:
+		switch file := components[2]; file {
+		case completeFile, heartbeatFile:
+			return node{hook: hookName, action: file}, true, fuse.OK
+		default:
+			value, ok := hook[file]
+			return node{value: value}, ok, fuse.OK
+		}
+	}
+	return node{}, false, fuse.OK
+}
+
+// GetAttr returns the attributes of a value, directory or action file
+func (fs *AutoScalingFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if name == "" {
+		return &fuse.Attr{Size: 4096, Mode: fuse.S_IFDIR | 0555}, fuse.OK
+	}
+
+	n, ok, code := fs.lookup(name, context)
+	switch {
+	case code != fuse.OK:
+		return nil, code
+	case !ok:
+		return nil, fuse.ENOENT
+	case n.dir:
+		return &fuse.Attr{Size: 4096, Mode: fuse.S_IFDIR | 0555}, fuse.OK
+	case n.action != "":
+		return fuseutil.OwnedAttr(&fuse.Attr{Mode: fuse.S_IFREG | 0200}), fuse.OK
+	default:
+		return &fuse.Attr{Size: uint64(len(n.value)), Mode: fuse.S_IFREG | 0444}, fuse.OK
+	}
+}
+
+// OpenDir lists the root, lifecycle-hooks/ or a hook's directory
+func (fs *AutoScalingFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	n, ok, code := fs.lookup(name, context)
+	switch {
+	case code != fuse.OK:
+		return nil, code
+	case !ok || !n.dir:
+		return nil, fuse.ENOENT
+	}
+	return n.entries, fuse.OK
+}
+
+// Open returns the content of a value, or a file taking a lifecycle action
+// when closed
+func (fs *AutoScalingFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	n, ok, code := fs.lookup(name, context)
+	switch {
+	case code != fuse.OK:
+		return nil, code
+	case !ok || n.dir:
+		return nil, fuse.ENOENT
+	case n.action == "":
+		if flags&fuse.O_ANYWRITE != 0 {
+			return nil, fuse.EPERM
+		}
+		return nodefs.NewDataFile([]byte(n.value)), fuse.OK
+	case flags&syscall.O_ACCMODE != syscall.O_WRONLY, !fuseutil.Allowed(context):
+		return nil, fuse.EACCES
+	}
+
+	return newActionFile(fs, n.hook, n.action), fuse.OK
+}
+
+// Truncate is accepted on action files so that shells can write to them
+func (fs *AutoScalingFs) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	n, ok, code := fs.lookup(name, context)
+	switch {
+	case code != fuse.OK:
+		return code
+	case !ok:
+		return fuse.ENOENT
+	case n.action == "":
+		return fuse.EPERM
+	case !fuseutil.Allowed(context):
+		return fuse.EACCES
+	}
+	return fuse.OK
+}
+
+// Utimens is accepted on action files so that `touch` works
+func (fs *AutoScalingFs) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	return fs.Truncate(name, 0, context)
+}
+
+// completeAction completes the instance's lifecycle action for hook
+func (fs *AutoScalingFs) completeAction(ctx context.Context, hook, result string) fuse.Status {
+	if result != "CONTINUE" && result != "ABANDON" {
+		fs.Logger.Errorf("invalid lifecycle action result %q, expected CONTINUE or ABANDON", result)
+		return fuse.EINVAL
+	}
+
+	g, code := fs.describe(ctx)
+	if code != fuse.OK {
+		return code
+	}
+	if g == nil {
+		return fuse.ENOENT
+	}
+
+	fs.Logger.Infof("completing lifecycle action of %s for hook %s with %s", fs.InstanceID, hook, result)
+	_, err := fs.Client.CompleteLifecycleAction(ctx, &autoscaling.CompleteLifecycleActionInput{
+		AutoScalingGroupName:  aws.String(g.name),
+		LifecycleHookName:     aws.String(hook),
+		InstanceId:            aws.String(fs.InstanceID),
+		LifecycleActionResult: aws.String(result),
+	})
+	if err != nil {
+		fs.Logger.Errorf("failed to complete lifecycle action for hook %s: %s", hook, err)
+		return fuseutil.ErrorStatus(err, errorCodes)
+	}
+
+	// the lifecycle state moves on
+	fs.invalidate()
+	return fuse.OK
+}
+
+// recordHeartbeat extends the instance's lifecycle action for hook
+func (fs *AutoScalingFs) recordHeartbeat(ctx context.Context, hook string) fuse.Status {
+	g, code := fs.describe(ctx)
+	if code != fuse.OK {
+		return code
+	}
+	if g == nil {
+		return fuse.ENOENT
+	}
+
+	fs.Logger.Debugf("recording lifecycle action heartbeat of %s for hook %s", fs.InstanceID, hook)
+	_, err := fs.Client.RecordLifecycleActionHeartbeat(ctx, &autoscaling.RecordLifecycleActionHeartbeatInput{
+		AutoScalingGroupName: aws.String(g.name),
+		LifecycleHookName:    aws.String(hook),
+		InstanceId:           aws.String(fs.InstanceID),
+	})
+	if err != nil {
+		fs.Logger.Errorf("failed to record lifecycle action heartbeat for hook %s: %s", hook, err)
+		return fuseutil.ErrorStatus(err, errorCodes)
+	}
+	return fuse.OK
+}
+
+// actionFile buffers what is written to an action file, taking the action on
+// Flush
+type actionFile struct {
+	nodefs.File
+
+	fs     *AutoScalingFs
+	hook   string
+	action string
+
+	mu    sync.Mutex
+	value []byte
+	dirty bool
+}
+
+func newActionFile(fs *AutoScalingFs, hook, action string) *actionFile {
+	return &actionFile{
+		File:   nodefs.NewDefaultFile(),
+		fs:     fs,
+		hook:   hook,
+		action: action,
+		// a heartbeat needs nothing written
+		dirty: action == heartbeatFile,
+	}
+}
+
+func (f *actionFile) GetAttr(out *fuse.Attr) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out.Mode = fuse.S_IFREG | 0200
+	out.Owner = *fuse.CurrentOwner()
+	out.Size = uint64(len(f.value))
+	return fuse.OK
+}
+
+func (f *actionFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if off < 0 {
+		return 0, fuse.EINVAL
+	}
+	if off > maxActionSize || int(off)+len(data) > maxActionSize {
+		return 0, fuse.Status(syscall.EFBIG)
+	}
+	if end := int(off) + len(data); end > len(f.value) {
+		f.value = append(f.value, make([]byte, end-len(f.value))...)
+	}
+	copy(f.value[off:], data)
+	f.dirty = true
+	return uint32(len(data)), fuse.OK
+}
+
+func (f *actionFile) Truncate(size uint64) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if size > uint64(len(f.value)) {
+		return fuse.EINVAL
+	}
+	f.value = f.value[:size]
+	return fuse.OK
+}
+
+func (f *actionFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	return fuse.OK
+}
+
+// Flush takes the action if the file was written to since it was opened or
+// last flushed
+func (f *actionFile) Flush() fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.dirty {
+		return fuse.OK
+	}
+
+	// nodefs.File.Flush is not given the context of the request
+	ctx := context.Background()
+
+	var code fuse.Status
+	switch f.action {
+	case completeFile:
+		code = f.fs.completeAction(ctx, f.hook, strings.TrimSpace(string(f.value)))
+	case heartbeatFile:
+		code = f.fs.recordHeartbeat(ctx, f.hook)
+	}
+	if code == fuse.OK {
+		f.dirty = false
+	}
+	return code
+}
+
+// fileEntries lists the files holding values
+func fileEntries(values map[string]string) []fuse.DirEntry {
+	entries := make([]fuse.DirEntry, 0, len(values))
+	for name := range values {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFREG})
+	}
+	return entries
+}
+
+func sortEntries(entries []fuse.DirEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+}
+
+// errorCodes maps the error codes of the Auto Scaling API to errnos
+var errorCodes = map[string]fuse.Status{
+	"AccessDenied":          fuse.EACCES,
+	"AccessDeniedException": fuse.EACCES,
+	"UnauthorizedOperation": fuse.EACCES,
+	"AuthFailure":           fuse.EACCES,
+	"ValidationError":       fuse.EINVAL,
+	"Throttling":            fuse.EAGAIN,
+	"RequestLimitExceeded":  fuse.EAGAIN,
+}
@@ -0,0 +1,269 @@
+package autoscalingfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/smithy-go"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jszwedko/ec2-metadatafs/internal/fusetest"
+	"github.com/jszwedko/ec2-metadatafs/internal/logging"
+)
+
+// fakeAutoScaling implements AutoScalingAPI for a single group, recording the
+// lifecycle actions taken as "complete group/instance/hook=result" and
+// "heartbeat hook"
+type fakeAutoScaling struct {
+	mu       sync.Mutex
+	instance *types.AutoScalingInstanceDetails
+	group    types.AutoScalingGroup
+	hooks    []types.LifecycleHook
+	err      error
+	calls    []string
+}
+
+func (c *fakeAutoScaling) DescribeAutoScalingInstances(ctx context.Context, params *autoscaling.DescribeAutoScalingInstancesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	out := &autoscaling.DescribeAutoScalingInstancesOutput{}
+	if c.instance != nil && reflect.DeepEqual(params.InstanceIds, []string{aws.ToString(c.instance.InstanceId)}) {
+		out.AutoScalingInstances = []types.AutoScalingInstanceDetails{*c.instance}
+	}
+	return out, nil
+}
+
+func (c *fakeAutoScaling) DescribeAutoScalingGroups(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	return &autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: []types.AutoScalingGroup{c.group}}, nil
+}
+
+func (c *fakeAutoScaling) DescribeLifecycleHooks(ctx context.Context, params *autoscaling.DescribeLifecycleHooksInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+	return &autoscaling.DescribeLifecycleHooksOutput{LifecycleHooks: c.hooks}, nil
+}
+
+func (c *fakeAutoScaling) CompleteLifecycleAction(ctx context.Context, params *autoscaling.CompleteLifecycleActionInput, optFns ...func(*autoscaling.Options)) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if aws.ToString(params.LifecycleHookName) != "drain" {
+		return nil, &smithy.GenericAPIError{Code: "ValidationError", Message: "No active Lifecycle Action found"}
+	}
+	c.calls = append(c.calls, fmt.Sprintf("complete %s/%s/%s=%s", aws.ToString(params.AutoScalingGroupName), aws.ToString(params.InstanceId), aws.ToString(params.LifecycleHookName), aws.ToString(params.LifecycleActionResult)))
+	c.instance.LifecycleState = aws.String("Terminating:Proceed")
+	return &autoscaling.CompleteLifecycleActionOutput{}, nil
+}
+
+func (c *fakeAutoScaling) RecordLifecycleActionHeartbeat(ctx context.Context, params *autoscaling.RecordLifecycleActionHeartbeatInput, optFns ...func(*autoscaling.Options)) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, fmt.Sprintf("heartbeat %s", aws.ToString(params.LifecycleHookName)))
+	return &autoscaling.RecordLifecycleActionHeartbeatOutput{}, nil
+}
+
+func newFakeAutoScaling() *fakeAutoScaling {
+	return &fakeAutoScaling{
+		instance: &types.AutoScalingInstanceDetails{
+			InstanceId:           aws.String("i-123456"),
+			AutoScalingGroupName: aws.String("web"),
+			LifecycleState:       aws.String("Terminating:Wait"),
+			HealthStatus:         aws.String("HEALTHY"),
+			ProtectedFromScaleIn: aws.Bool(true),
+			LaunchTemplate: &types.LaunchTemplateSpecification{
+				LaunchTemplateId:   aws.String("lt-123"),
+				LaunchTemplateName: aws.String("web"),
+				Version:            aws.String("7"),
+			},
+		},
+		group: types.AutoScalingGroup{
+			AutoScalingGroupName: aws.String("web"),
+			DesiredCapacity:      aws.Int32(3),
+			MinSize:              aws.Int32(1),
+			MaxSize:              aws.Int32(5),
+		},
+		hooks: []types.LifecycleHook{{
+			LifecycleHookName:   aws.String("drain"),
+			LifecycleTransition: aws.String("autoscaling:EC2_INSTANCE_TERMINATING"),
+			DefaultResult:       aws.String("CONTINUE"),
+			HeartbeatTimeout:    aws.Int32(300),
+		}},
+	}
+}
+
+func setup(t *testing.T, client *fakeAutoScaling) (dir string, cleanup func()) {
+	return fusetest.Mount(t, New(client, "i-123456", logging.NewLogger()))
+}
+
+func TestAutoScalingFs(t *testing.T) {
+	dir, cleanup := setup(t, newFakeAutoScaling())
+	defer cleanup()
+
+	expected := []string{
+		"desired-capacity -r--r--r--",
+		"group-name -r--r--r--",
+		"health-status -r--r--r--",
+		"launch-template-id -r--r--r--",
+		"launch-template-name -r--r--r--",
+		"launch-template-version -r--r--r--",
+		"lifecycle-hooks dr-xr-xr-x",
+		"lifecycle-state -r--r--r--",
+		"max-size -r--r--r--",
+		"min-size -r--r--r--",
+		"protected-from-scale-in -r--r--r--",
+	}
+	if names := fusetest.Listing(t, dir); !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %q, expected %q`, names, expected)
+	}
+
+	expected = []string{
+		"complete --w-------",
+		"default-result -r--r--r--",
+		"heartbeat --w-------",
+		"heartbeat-timeout -r--r--r--",
+		"transition -r--r--r--",
+	}
+	if names := fusetest.Listing(t, path.Join(dir, "lifecycle-hooks", "drain")); !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %q, expected %q`, names, expected)
+	}
+
+	for name, expected := range map[string]string{
+		"group-name":                              "web",
+		"desired-capacity":                        "3",
+		"protected-from-scale-in":                 "true",
+		"launch-template-version":                 "7",
+		"lifecycle-hooks/drain/heartbeat-timeout": "300",
+	} {
+		contents, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil || string(contents) != expected {
+			t.Errorf(`read %s: %q, %v, expected %q`, name, contents, err, expected)
+		}
+	}
+
+	if _, err := os.Stat(path.Join(dir, "lifecycle-hooks", "missing")); !os.IsNotExist(err) {
+		t.Errorf(`expected missing hook not to exist, got %v`, err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "min-size"), []byte("2"), 0644); !errors.Is(err, syscall.EPERM) {
+		t.Errorf(`expected EPERM writing min-size, got %v`, err)
+	}
+	if _, err := ioutil.ReadFile(path.Join(dir, "lifecycle-hooks", "drain", "complete")); !errors.Is(err, syscall.EACCES) {
+		t.Errorf(`expected EACCES reading complete, got %v`, err)
+	}
+}
+
+func TestAutoScalingFs_lifecycleActions(t *testing.T) {
+	client := newFakeAutoScaling()
+	dir, cleanup := setup(t, client)
+	defer cleanup()
+
+	hook := path.Join(dir, "lifecycle-hooks", "drain")
+	if out, err := exec.Command("touch", path.Join(hook, "heartbeat")).CombinedOutput(); err != nil {
+		t.Fatalf(`error touching heartbeat: %s: %s`, err, out)
+	}
+	if err := ioutil.WriteFile(path.Join(hook, "complete"), []byte("MAYBE\n"), 0200); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf(`expected EINVAL completing with MAYBE, got %v`, err)
+	}
+	if err := ioutil.WriteFile(path.Join(hook, "complete"), []byte("CONTINUE\n"), 0200); err != nil {
+		t.Fatalf(`error completing lifecycle action: %s`, err)
+	}
+
+	expected := []string{"heartbeat drain", "complete web/i-123456/drain=CONTINUE"}
+	if !reflect.DeepEqual(expected, client.calls) {
+		t.Errorf(`made calls %q, expected %q`, client.calls, expected)
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(dir, "lifecycle-state"))
+	if err != nil || string(contents) != "Terminating:Proceed" {
+		t.Errorf(`read lifecycle-state: %q, %v, expected "Terminating:Proceed"`, contents, err)
+	}
+}
+
+func TestAutoScalingFs_actionError(t *testing.T) {
+	client := newFakeAutoScaling()
+	client.hooks = append(client.hooks, types.LifecycleHook{LifecycleHookName: aws.String("launch")})
+	dir, cleanup := setup(t, client)
+	defer cleanup()
+
+	err := ioutil.WriteFile(path.Join(dir, "lifecycle-hooks", "launch", "complete"), []byte("ABANDON"), 0200)
+	if !errors.Is(err, syscall.EINVAL) {
+		t.Errorf(`expected EINVAL without an active lifecycle action, got %v`, err)
+	}
+}
+
+func TestAutoScalingFs_otherUser(t *testing.T) {
+	client := newFakeAutoScaling()
+	fs := New(client, "i-123456", logging.NewLogger())
+	context := &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: uint32(os.Getuid() + 1000)}}}
+
+	for _, name := range []string{"lifecycle-hooks/drain/complete", "lifecycle-hooks/drain/heartbeat"} {
+		if _, code := fs.Open(name, syscall.O_WRONLY|syscall.O_TRUNC, context); code != fuse.EACCES {
+			t.Errorf(`expected EACCES opening %s as another user, got %s`, name, code)
+		}
+		if code := fs.Truncate(name, 0, context); code != fuse.EACCES {
+			t.Errorf(`expected EACCES truncating %s as another user, got %s`, name, code)
+		}
+	}
+	if _, code := fs.Open("group-name", syscall.O_RDONLY, context); code != fuse.OK {
+		t.Errorf(`expected other users to read group-name, got %s`, code)
+	}
+	if len(client.calls) != 0 {
+		t.Errorf(`made calls %q, expected none`, client.calls)
+	}
+}
+
+func TestAutoScalingFs_actionTooLarge(t *testing.T) {
+	client := newFakeAutoScaling()
+	dir, cleanup := setup(t, client)
+	defer cleanup()
+
+	err := ioutil.WriteFile(path.Join(dir, "lifecycle-hooks", "drain", "complete"), make([]byte, maxActionSize+1), 0200)
+	if !errors.Is(err, syscall.EFBIG) {
+		t.Errorf(`expected EFBIG, got %v`, err)
+	}
+
+	file := newActionFile(New(client, "i-123456", logging.NewLogger()), "drain", completeFile)
+	for off, expected := range map[int64]fuse.Status{-1: fuse.EINVAL, 1 << 40: fuse.Status(syscall.EFBIG), 1<<63 - 1: fuse.Status(syscall.EFBIG)} {
+		if _, code := file.Write([]byte("x"), off); code != expected {
+			t.Errorf(`writing at %d: %s, expected %s`, off, code, expected)
+		}
+	}
+	if len(client.calls) != 0 {
+		t.Errorf(`made calls %q, expected none`, client.calls)
+	}
+}
+
+func TestAutoScalingFs_noGroup(t *testing.T) {
+	client := newFakeAutoScaling()
+	client.instance = nil
+	dir, cleanup := setup(t, client)
+	defer cleanup()
+
+	if names := fusetest.Listing(t, dir); len(names) != 0 {
+		t.Errorf(`returned entries %q, expected none`, names)
+	}
+	if _, err := os.Stat(path.Join(dir, "lifecycle-hooks")); !os.IsNotExist(err) {
+		t.Errorf(`expected lifecycle-hooks not to exist, got %v`, err)
+	}
+}
+
+func TestAutoScalingFs_error(t *testing.T) {
+	client := newFakeAutoScaling()
+	client.err = &smithy.GenericAPIError{Code: "AccessDenied", Message: "denied"}
+	dir, cleanup := setup(t, client)
+	defer cleanup()
+
+	if _, err := ioutil.ReadFile(path.Join(dir, "group-name")); !errors.Is(err, syscall.EACCES) {
+		t.Errorf(`expected EACCES, got %v`, err)
+	}
+}
@@ -0,0 +1,246 @@
+package instancefs
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/jszwedko/ec2-metadatafs/internal/fuseutil"
+	"github.com/jszwedko/ec2-metadatafs/logger"
+)
+
+// The filesystem shows the instance as returned by DescribeInstances, with a
+// directory per object and list and a file per scalar field, named as in the
+// API. List items are named by their index, e.g.
+// SecurityGroups/0/GroupName or BlockDeviceMappings/0/Ebs/VolumeId. Missing
+// fields are left out and times are formatted as RFC 3339.
+//
+// DescribeInstances does not return termination protection, so it is added
+// as DisableApiTermination from DescribeInstanceAttribute. It is left out if
+// that fails, e.g. for lack of ec2:DescribeInstanceAttribute.
+
+// EC2API is the part of the EC2 API client used
+// Satisfied by *ec2.Client
+type EC2API interface {
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	DescribeInstanceAttribute(ctx context.Context, params *ec2.DescribeInstanceAttributeInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceAttributeOutput, error)
+}
+
+// InstanceFs represents a filesystem that exposes the attributes of an
+// instance from the EC2 API
+// Satisfies pathfs.FileSystem
+type InstanceFs struct {
+	pathfs.FileSystem
+
+	Client     EC2API
+	InstanceID string
+	Logger     logger.LeveledLogger
+
+	// RefreshInterval is how long the instance is served before it is
+	// described again, 0 to describe it on every access
+	RefreshInterval time.Duration
+
+	mu      sync.Mutex
+	tree    *tree
+	fetched time.Time
+}
+
+// tree is the instance as files and directories
+type tree struct {
+	files map[string]string
+	dirs  map[string][]fuse.DirEntry
+}
+
+// New initializes a new InstanceFs for the instance with the given ID
+func New(client EC2API, instanceID string, l logger.LeveledLogger) *InstanceFs {
+	return &InstanceFs{
+		FileSystem: pathfs.NewReadonlyFileSystem(pathfs.NewDefaultFileSystem()),
+		Client:     client,
+		InstanceID: instanceID,
+		Logger:     l,
+	}
+}
+
+// describe returns the instance, describing it again if it is older than
+// RefreshInterval
+func (fs *InstanceFs) describe(ctx context.Context) (*tree, fuse.Status) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.tree != nil && time.Since(fs.fetched) < fs.RefreshInterval {
+		return fs.tree, fuse.OK
+	}
+
+	t, err := fs.describeInstance(ctx)
+	if err != nil {
+		fs.Logger.Errorf("failed to query AWS API for instance: %s", err)
+		return nil, fuseutil.ErrorStatus(err, errorCodes)
+	}
+
+	fs.tree = t
+	fs.fetched = time.Now()
+	return t, fuse.OK
+}
+
+// describeInstance fetches the instance and builds its tree
+func (fs *InstanceFs) describeInstance(ctx context.Context) (*tree, error) {
+	fs.Logger.Debugf("issuing request to AWS API to describe %s", fs.InstanceID)
+
+	out, err := fs.Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{fs.InstanceID},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var instance *types.Instance
+	for _, reservation := range out.Reservations {
+		for i := range reservation.Instances {
+			instance = &reservation.Instances[i]
+		}
+	}
+	if instance == nil {
+		return nil, &smithy.GenericAPIError{Code: "InvalidInstanceID.NotFound", Message: "instance " + fs.InstanceID + " not found"}
+	}
+
+	// the SDK types marshal with the field names of the API
+	data, err := json.Marshal(instance)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	attribute, err := fs.Client.DescribeInstanceAttribute(ctx, &ec2.DescribeInstanceAttributeInput{
+		InstanceId: aws.String(fs.InstanceID),
+		Attribute:  types.InstanceAttributeNameDisableApiTermination,
+	})
+	switch {
+	case err != nil:
+		fs.Logger.Warningf("failed to query AWS API for termination protection, leaving out DisableApiTermination: %s", err)
+	case attribute.DisableApiTermination != nil:
+		fields["DisableApiTermination"] = aws.ToBool(attribute.DisableApiTermination.Value)
+	}
+
+	t := &tree{files: map[string]string{}, dirs: map[string][]fuse.DirEntry{}}
+	t.add("", fields)
+	return t, nil
+}
+
+// add adds value at name, returning whether it is shown
+func (t *tree) add(name string, value interface{}) bool {
+	var children map[string]interface{}
+	switch v := value.(type) {
+	case nil:
+		return false
+	case string:
+		t.files[name] = v
+		return true
+	case bool:
+		t.files[name] = strconv.FormatBool(v)
+		return true
+	case float64:
+		t.files[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		return true
+	case map[string]interface{}:
+		children = v
+	case []interface{}:
+		children = make(map[string]interface{}, len(v))
+		for i, item := range v {
+			children[strconv.Itoa(i)] = item
+		}
+	default:
+		return false
+	}
+
+	entries := []fuse.DirEntry{}
+	for child, childValue := range children {
+		if !t.add(path.Join(name, child), childValue) {
+			continue
+		}
+		mode := uint32(fuse.S_IFREG)
+		if _, ok := t.files[path.Join(name, child)]; !ok {
+			mode = fuse.S_IFDIR
+		}
+		entries = append(entries, fuse.DirEntry{Name: child, Mode: mode})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	t.dirs[name] = entries
+	return true
+}
+
+// GetAttr returns the attributes of a field or directory
+func (fs *InstanceFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if name == "" {
+		return &fuse.Attr{Size: 4096, Mode: fuse.S_IFDIR | 0555}, fuse.OK
+	}
+
+	t, code := fs.describe(fuseutil.RequestContext(context))
+	if code != fuse.OK {
+		return nil, code
+	}
+
+	if value, ok := t.files[name]; ok {
+		return &fuse.Attr{Size: uint64(len(value)), Mode: fuse.S_IFREG | 0444}, fuse.OK
+	}
+	if _, ok := t.dirs[name]; ok {
+		return &fuse.Attr{Size: 4096, Mode: fuse.S_IFDIR | 0555}, fuse.OK
+	}
+	return nil, fuse.ENOENT
+}
+
+// OpenDir lists the fields of an object or the items of a list
+func (fs *InstanceFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	t, code := fs.describe(fuseutil.RequestContext(context))
+	if code != fuse.OK {
+		return nil, code
+	}
+
+	entries, ok := t.dirs[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return entries, fuse.OK
+}
+
+// Open returns the value of a field
+func (fs *InstanceFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+
+	t, code := fs.describe(fuseutil.RequestContext(context))
+	if code != fuse.OK {
+		return nil, code
+	}
+
+	value, ok := t.files[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return nodefs.NewDataFile([]byte(value)), fuse.OK
+}
+
+// errorCodes maps the error codes of the EC2 API to errnos
+var errorCodes = map[string]fuse.Status{
+	"UnauthorizedOperation":      fuse.EACCES,
+	"AuthFailure":                fuse.EACCES,
+	"AccessDenied":               fuse.EACCES,
+	"OptInRequired":              fuse.EACCES,
+	"RequestLimitExceeded":       fuse.EAGAIN,
+	"Throttling":                 fuse.EAGAIN,
+	"InvalidInstanceID.NotFound": fuse.ENOENT,
+}
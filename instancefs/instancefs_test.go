@@ -0,0 +1,213 @@
+package instancefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jszwedko/ec2-metadatafs/internal/fusetest"
+	"github.com/jszwedko/ec2-metadatafs/internal/logging"
+)
+
+// fakeEC2 implements EC2API for a single instance, counting the calls to
+// DescribeInstances
+type fakeEC2 struct {
+	mu           sync.Mutex
+	instance     types.Instance
+	protected    bool
+	attributeErr error
+	err          error
+	describes    int
+}
+
+func (c *fakeEC2) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.describes++
+	if c.err != nil {
+		return nil, c.err
+	}
+	if !reflect.DeepEqual(params.InstanceIds, []string{aws.ToString(c.instance.InstanceId)}) {
+		return &ec2.DescribeInstancesOutput{}, nil
+	}
+	return &ec2.DescribeInstancesOutput{
+		Reservations: []types.Reservation{{Instances: []types.Instance{c.instance}}},
+	}, nil
+}
+
+func (c *fakeEC2) DescribeInstanceAttribute(ctx context.Context, params *ec2.DescribeInstanceAttributeInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceAttributeOutput, error) {
+	if c.attributeErr != nil {
+		return nil, c.attributeErr
+	}
+	if params.Attribute != types.InstanceAttributeNameDisableApiTermination {
+		return nil, fmt.Errorf("unexpected attribute %s", params.Attribute)
+	}
+	return &ec2.DescribeInstanceAttributeOutput{
+		DisableApiTermination: &types.AttributeBooleanValue{Value: aws.Bool(c.protected)},
+	}, nil
+}
+
+func newFakeEC2() *fakeEC2 {
+	return &fakeEC2{
+		instance: types.Instance{
+			InstanceId:   aws.String("i-123456"),
+			InstanceType: types.InstanceTypeT3Micro,
+			LaunchTime:   aws.Time(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)),
+			State:        &types.InstanceState{Code: aws.Int32(16), Name: types.InstanceStateNameRunning},
+			IamInstanceProfile: &types.IamInstanceProfile{
+				Arn: aws.String("arn:aws:iam::123456789012:instance-profile/web"),
+				Id:  aws.String("AIPA123"),
+			},
+			SecurityGroups: []types.GroupIdentifier{
+				{GroupId: aws.String("sg-1"), GroupName: aws.String("web")},
+				{GroupId: aws.String("sg-2"), GroupName: aws.String("ssh")},
+			},
+			BlockDeviceMappings: []types.InstanceBlockDeviceMapping{{
+				DeviceName: aws.String("/dev/xvda"),
+				Ebs:        &types.EbsInstanceBlockDevice{VolumeId: aws.String("vol-1")},
+			}},
+		},
+		protected: true,
+	}
+}
+
+func setup(t *testing.T, client *fakeEC2, configure func(*InstanceFs)) (dir string, cleanup func()) {
+	fs := New(client, "i-123456", logging.NewLogger())
+	if configure != nil {
+		configure(fs)
+	}
+	return fusetest.Mount(t, fs)
+}
+
+func TestInstanceFs(t *testing.T) {
+	dir, cleanup := setup(t, newFakeEC2(), nil)
+	defer cleanup()
+
+	expected := []string{
+		"BlockDeviceMappings dr-xr-xr-x",
+		"DisableApiTermination -r--r--r--",
+		"IamInstanceProfile dr-xr-xr-x",
+		"InstanceId -r--r--r--",
+		"InstanceType -r--r--r--",
+		"LaunchTime -r--r--r--",
+		"SecurityGroups dr-xr-xr-x",
+		"State dr-xr-xr-x",
+	}
+	names := fusetest.Listing(t, dir)
+	for _, name := range expected {
+		found := false
+		for _, n := range names {
+			found = found || n == name
+		}
+		if !found {
+			t.Errorf(`expected %q in entries %q`, name, names)
+		}
+	}
+
+	if contents, err := ioutil.ReadFile(path.Join(dir, "State", "Name")); err != nil || string(contents) != "running" {
+		t.Errorf(`read State/Name: %q, %v, expected "running"`, contents, err)
+	}
+	if _, err := os.Stat(path.Join(dir, "RamdiskId")); !os.IsNotExist(err) {
+		t.Errorf(`expected missing field not to exist, got %v`, err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "InstanceType"), []byte("t3.large"), 0644); !errors.Is(err, syscall.EPERM) {
+		t.Errorf(`expected EPERM writing a field, got %v`, err)
+	}
+}
+
+func TestInstanceFs_describeInstance(t *testing.T) {
+	fs := New(newFakeEC2(), "i-123456", logging.NewLogger())
+	tree, err := fs.describeInstance(context.Background())
+	if err != nil {
+		t.Fatalf(`error describing instance: %s`, err)
+	}
+
+	for name, expected := range map[string]string{
+		"InstanceType":                       "t3.micro",
+		"LaunchTime":                         "2026-10-01T12:00:00Z",
+		"State/Code":                         "16",
+		"State/Name":                         "running",
+		"IamInstanceProfile/Arn":             "arn:aws:iam::123456789012:instance-profile/web",
+		"SecurityGroups/1/GroupName":         "ssh",
+		"BlockDeviceMappings/0/Ebs/VolumeId": "vol-1",
+		"DisableApiTermination":              "true",
+	} {
+		if value, ok := tree.files[name]; !ok || value != expected {
+			t.Errorf(`built %s: %q, %t, expected %q`, name, value, ok, expected)
+		}
+	}
+
+	for dir, expected := range map[string][]fuse.DirEntry{
+		"SecurityGroups": {{Name: "0", Mode: fuse.S_IFDIR}, {Name: "1", Mode: fuse.S_IFDIR}},
+		"State":          {{Name: "Code", Mode: fuse.S_IFREG}, {Name: "Name", Mode: fuse.S_IFREG}},
+	} {
+		if !reflect.DeepEqual(expected, tree.dirs[dir]) {
+			t.Errorf(`built entries %v for %q, expected %v`, tree.dirs[dir], dir, expected)
+		}
+	}
+
+	// fields DescribeInstances did not return are left out
+	for _, name := range []string{"RamdiskId", "Tags", "Placement"} {
+		if _, ok := tree.files[name]; ok {
+			t.Errorf(`expected %s not to be a file`, name)
+		}
+		if _, ok := tree.dirs[name]; ok {
+			t.Errorf(`expected %s not to be a directory`, name)
+		}
+	}
+}
+
+func TestInstanceFs_RefreshInterval(t *testing.T) {
+	client := newFakeEC2()
+	dir, cleanup := setup(t, client, func(fs *InstanceFs) {
+		fs.RefreshInterval = time.Hour
+	})
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		if _, err := ioutil.ReadFile(path.Join(dir, "State", "Name")); err != nil {
+			t.Fatalf(`error reading field: %s`, err)
+		}
+	}
+	if client.describes != 1 {
+		t.Errorf(`described the instance %d times, expected once`, client.describes)
+	}
+}
+
+func TestInstanceFs_attributeError(t *testing.T) {
+	client := newFakeEC2()
+	client.attributeErr = &smithy.GenericAPIError{Code: "UnauthorizedOperation", Message: "denied"}
+	dir, cleanup := setup(t, client, nil)
+	defer cleanup()
+
+	if _, err := os.Stat(path.Join(dir, "DisableApiTermination")); !os.IsNotExist(err) {
+		t.Errorf(`expected DisableApiTermination to be left out, got %v`, err)
+	}
+	if contents, err := ioutil.ReadFile(path.Join(dir, "InstanceId")); err != nil || string(contents) != "i-123456" {
+		t.Errorf(`read InstanceId: %q, %v`, contents, err)
+	}
+}
+
+func TestInstanceFs_error(t *testing.T) {
+	client := newFakeEC2()
+	client.err = &smithy.GenericAPIError{Code: "UnauthorizedOperation", Message: "denied"}
+	dir, cleanup := setup(t, client, nil)
+	defer cleanup()
+
+	if _, err := ioutil.ReadFile(path.Join(dir, "InstanceId")); !errors.Is(err, syscall.EACCES) {
+		t.Errorf(`expected EACCES, got %v`, err)
+	}
+}
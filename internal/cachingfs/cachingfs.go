@@ -5,10 +5,14 @@ package cachingfs
 
 import (
 	"fmt"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/jszwedko/ec2-metadatafs/internal/fuseutil"
 )
 
 type attrResponse struct {
@@ -21,6 +25,28 @@ type dirResponse struct {
 	fuse.Status
 }
 
+// FileSystem is a pathfs.FileSystem whose cached entries can be dropped on
+// demand, e.g. after attaching a network interface or changing the IAM role
+type FileSystem interface {
+	pathfs.FileSystem
+
+	// Invalidate drops the cached attributes and listing for name along with
+	// the kernel's entry and attribute caches for it
+	Invalidate(name string)
+
+	// InvalidateTree is like Invalidate, but also drops everything beneath
+	// name. An empty name invalidates the whole filesystem.
+	InvalidateTree(name string)
+}
+
+// ContentCache is implemented by wrapped filesystems that keep the content of
+// some files themselves, so that it is dropped along with the attributes and
+// listings
+type ContentCache interface {
+	// DropContent drops the kept content of the files match is true for
+	DropContent(match func(name string) bool)
+}
+
 // cachingFileSystem caches file attributes and directory listings for a
 // wrapped pathfs.FileSystem.
 type cachingFileSystem struct {
@@ -28,12 +54,17 @@ type cachingFileSystem struct {
 
 	attributes *timedCache
 	dirs       *timedCache
+
+	nodeFs *pathfs.PathNodeFs
 }
 
 // New returns a pathfs.FileSystem that caches the results of GetAttr and
 // OpenDir calls to fs for the given ttl. A ttl of 0 disables caching and a
 // negative ttl caches indefinitely.
-func New(fs pathfs.FileSystem, ttl time.Duration) pathfs.FileSystem {
+//
+// Invalidation requests may also be written to the hidden
+// .control/invalidate file, see controlFile.
+func New(fs pathfs.FileSystem, ttl time.Duration) FileSystem {
 	c := &cachingFileSystem{FileSystem: fs}
 	c.attributes = newTimedCache(func(n string) (interface{}, bool) {
 		a, code := fs.GetAttr(n, nil)
@@ -43,19 +74,184 @@ func New(fs pathfs.FileSystem, ttl time.Duration) pathfs.FileSystem {
 		entries, code := fs.OpenDir(n, nil)
 		return &dirResponse{entries: entries, Status: code}, code.Ok()
 	}, ttl)
+
+	c.attributes.refetched = func(n string, old, new interface{}) {
+		if !sameAttr(old.(*attrResponse), new.(*attrResponse)) {
+			go c.notify(n)
+		}
+	}
+	c.dirs.refetched = func(n string, old, new interface{}) {
+		if !sameEntries(old.(*dirResponse), new.(*dirResponse)) {
+			go c.notify(n)
+		}
+	}
 	return c
 }
 
+// indefiniteTimeout is used for the kernel timeouts when caching indefinitely
+const indefiniteTimeout = 365 * 24 * time.Hour
+
+// KernelOptions returns the nodefs.Options for a mount whose kernel entry and
+// attribute caches follow the same ttl as New. Failed lookups are never
+// cached, matching New not caching errors.
+func KernelOptions(ttl time.Duration) *nodefs.Options {
+	if ttl < 0 {
+		ttl = indefiniteTimeout
+	}
+
+	return &nodefs.Options{
+		EntryTimeout:    ttl,
+		AttrTimeout:     ttl,
+		NegativeTimeout: 0,
+		Owner:           fuse.CurrentOwner(),
+	}
+}
+
+func (fs *cachingFileSystem) OnMount(nodeFs *pathfs.PathNodeFs) {
+	fs.nodeFs = nodeFs
+	fs.FileSystem.OnMount(nodeFs)
+}
+
 func (fs *cachingFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if attr, ok := controlAttr(name); ok {
+		return attr, fuse.OK
+	}
+
 	r := fs.attributes.Get(name).(*attrResponse)
 	return r.Attr, r.Status
 }
 
 func (fs *cachingFileSystem) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, status fuse.Status) {
+	if name == controlDir {
+		return []fuse.DirEntry{{Name: path.Base(invalidateFile), Mode: fuse.S_IFREG}}, fuse.OK
+	}
+
 	r := fs.dirs.Get(name).(*dirResponse)
 	return r.entries, r.Status
 }
 
+func (fs *cachingFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if name == invalidateFile {
+		// with allow_other, other users must not be able to make us refetch
+		// everything at will
+		if flags&fuse.O_ANYWRITE == 0 || !fuseutil.Allowed(context) {
+			return nil, fuse.EACCES
+		}
+		return newControlFile(fs), fuse.OK
+	}
+
+	return fs.FileSystem.Open(name, flags, context)
+}
+
+// Truncate is accepted for the control file so that `echo path >
+// .control/invalidate` works
+func (fs *cachingFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	if name == invalidateFile {
+		return fuse.OK
+	}
+
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+func (fs *cachingFileSystem) Invalidate(name string) {
+	fs.attributes.Drop(name)
+	fs.dirs.Drop(name)
+	if content, ok := fs.FileSystem.(ContentCache); ok {
+		content.DropContent(func(n string) bool { return n == name })
+	}
+	fs.notify(name)
+}
+
+func (fs *cachingFileSystem) InvalidateTree(name string) {
+	inTree := func(n string) bool {
+		return name == "" || n == name || strings.HasPrefix(n, name+"/")
+	}
+
+	names := map[string]bool{name: true}
+	for _, n := range fs.attributes.DropMatching(inTree) {
+		names[n] = true
+	}
+	for _, n := range fs.dirs.DropMatching(inTree) {
+		names[n] = true
+	}
+	if content, ok := fs.FileSystem.(ContentCache); ok {
+		content.DropContent(inTree)
+	}
+	for _, n := range fs.kernelNames(name) {
+		names[n] = true
+	}
+
+	for n := range names {
+		fs.notify(n)
+	}
+}
+
+// kernelNames returns the paths of the inodes known to the kernel at and
+// beneath name, which may include some that were never cached by us
+func (fs *cachingFileSystem) kernelNames(name string) []string {
+	if fs.nodeFs == nil {
+		return nil
+	}
+
+	node := fs.nodeFs.Node(name)
+	if node == nil {
+		return nil
+	}
+
+	names := []string{}
+	var walk func(prefix string, node *nodefs.Inode)
+	walk = func(prefix string, node *nodefs.Inode) {
+		for child, n := range node.FsChildren() {
+			p := path.Join(prefix, child)
+			names = append(names, p)
+			walk(p, n)
+		}
+	}
+	walk(name, node)
+
+	return names
+}
+
+// notify asks the kernel to forget the entry and attributes it has cached
+// for name
+func (fs *cachingFileSystem) notify(name string) {
+	if fs.nodeFs == nil {
+		return
+	}
+
+	fs.nodeFs.Notify(name)
+	if name != "" {
+		dir, base := path.Split(name)
+		fs.nodeFs.EntryNotify(strings.TrimRight(dir, "/"), base)
+	}
+}
+
+// sameAttr reports whether the kernel's view of a file would be unchanged by
+// going from a to b
+func sameAttr(a, b *attrResponse) bool {
+	if a.Status != b.Status || (a.Attr == nil) != (b.Attr == nil) {
+		return false
+	}
+	if a.Attr == nil {
+		return true
+	}
+	return a.Mode == b.Mode && a.Size == b.Size && a.Mtime == b.Mtime && a.Mtimensec == b.Mtimensec
+}
+
+// sameEntries reports whether two directory listings have the same entries
+// in the same order
+func sameEntries(a, b *dirResponse) bool {
+	if a.Status != b.Status || len(a.entries) != len(b.entries) {
+		return false
+	}
+	for i := range a.entries {
+		if a.entries[i].Name != b.entries[i].Name || a.entries[i].Mode != b.entries[i].Mode {
+			return false
+		}
+	}
+	return true
+}
+
 func (fs *cachingFileSystem) String() string {
 	return fmt.Sprintf("cachingFileSystem(%v)", fs.FileSystem)
 }
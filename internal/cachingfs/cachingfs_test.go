@@ -0,0 +1,270 @@
+package cachingfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+)
+
+// countingFs serves a single file whose size can be changed and counts how
+// often its attributes were requested
+type countingFs struct {
+	pathfs.FileSystem
+
+	mu       sync.Mutex
+	size     uint64
+	getAttrs map[string]int
+}
+
+func (fs *countingFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.getAttrs[name]++
+	switch name {
+	case "", "dir":
+		return &fuse.Attr{Size: 4096, Mode: fuse.S_IFDIR | 0555}, fuse.OK
+	case "dir/file":
+		return &fuse.Attr{Size: fs.size, Mode: fuse.S_IFREG | 0444}, fuse.OK
+	default:
+		return nil, fuse.ENOENT
+	}
+}
+
+func (fs *countingFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	switch name {
+	case "":
+		return []fuse.DirEntry{{Name: "dir", Mode: fuse.S_IFDIR}}, fuse.OK
+	case "dir":
+		return []fuse.DirEntry{{Name: "file", Mode: fuse.S_IFREG}}, fuse.OK
+	default:
+		return nil, fuse.ENOENT
+	}
+}
+
+func (fs *countingFs) setSize(size uint64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.size = size
+}
+
+func setup(t *testing.T) (fs *countingFs, dir string, cleanup func()) {
+	fs, _, dir, cleanup = setupWithTTL(t, -1, time.Hour)
+	return fs, dir, cleanup
+}
+
+// setupWithTTL mounts a countingFs cached for ttl, with the kernel caching
+// entries and attributes for kernelTTL
+func setupWithTTL(t *testing.T, ttl, kernelTTL time.Duration) (fs *countingFs, cache FileSystem, dir string, cleanup func()) {
+	fs = &countingFs{
+		FileSystem: pathfs.NewReadonlyFileSystem(pathfs.NewDefaultFileSystem()),
+		size:       1,
+		getAttrs:   map[string]int{},
+	}
+
+	tmpDir, err := ioutil.TempDir("", "cachingfs-test")
+	if err != nil {
+		t.Fatalf("creating tempdir failed: %v", err)
+	}
+
+	cache = New(fs, ttl)
+	nfs := pathfs.NewPathNodeFs(cache, nil)
+	state, _, err := nodefs.MountRoot(tmpDir, nfs.Root(), KernelOptions(kernelTTL))
+	if err != nil {
+		t.Fatalf("mounting filesystem failed: %v", err)
+	}
+
+	go state.Serve()
+	state.WaitMount()
+
+	return fs, cache, tmpDir, func() {
+		state.Unmount()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestCachingFs_Invalidate(t *testing.T) {
+	fs, dir, cleanup := setup(t)
+	defer cleanup()
+
+	if _, err := os.Stat(path.Join(dir, "dir/file")); err != nil {
+		t.Fatalf(`error retrieving stat %s`, err)
+	}
+
+	for i, request := range []string{"dir/file\n", "dir/\n", "/\n"} {
+		cached := int64(i + 1)
+		fs.setSize(uint64(cached + 1))
+
+		info, err := os.Stat(path.Join(dir, "dir/file"))
+		if err != nil {
+			t.Fatalf(`error retrieving stat %s`, err)
+		}
+		if info.Size() != cached {
+			t.Fatalf(`file size was %d before invalidating %q, expected cached %d`, info.Size(), request, cached)
+		}
+
+		err = ioutil.WriteFile(path.Join(dir, ".control/invalidate"), []byte(request), 0200)
+		if err != nil {
+			t.Fatalf(`error writing invalidation request %q: %s`, request, err)
+		}
+
+		info, err = os.Stat(path.Join(dir, "dir/file"))
+		if err != nil {
+			t.Fatalf(`error retrieving stat %s`, err)
+		}
+		if info.Size() != cached+1 {
+			t.Errorf(`file size was %d after invalidating %q, expected %d`, info.Size(), request, cached+1)
+		}
+	}
+}
+
+func TestCachingFs_InvalidateTree_unrelated(t *testing.T) {
+	fs, dir, cleanup := setup(t)
+	defer cleanup()
+
+	if _, err := os.Stat(path.Join(dir, "dir/file")); err != nil {
+		t.Fatalf(`error retrieving stat %s`, err)
+	}
+
+	err := ioutil.WriteFile(path.Join(dir, ".control/invalidate"), []byte("other/\n"), 0200)
+	if err != nil {
+		t.Fatalf(`error writing invalidation request: %s`, err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "dir/file")); err != nil {
+		t.Fatalf(`error retrieving stat %s`, err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.getAttrs["dir/file"] != 1 {
+		t.Errorf(`dir/file attributes were fetched %d times, expected %d`, fs.getAttrs["dir/file"], 1)
+	}
+}
+
+// contentFs keeps content for a few files, recording which were dropped
+type contentFs struct {
+	pathfs.FileSystem
+
+	dropped []string
+}
+
+func (fs *contentFs) DropContent(match func(name string) bool) {
+	for _, name := range []string{"file", "dir/file", "other"} {
+		if match(name) {
+			fs.dropped = append(fs.dropped, name)
+		}
+	}
+}
+
+func TestCachingFs_ContentCache(t *testing.T) {
+	fs := &contentFs{FileSystem: pathfs.NewDefaultFileSystem()}
+	cache := New(fs, time.Hour)
+
+	for _, c := range []struct {
+		invalidate func()
+		expected   []string
+	}{
+		{func() { cache.Invalidate("file") }, []string{"file"}},
+		{func() { cache.Invalidate("dir") }, nil},
+		{func() { cache.InvalidateTree("dir") }, []string{"dir/file"}},
+		{func() { cache.InvalidateTree("") }, []string{"file", "dir/file", "other"}},
+	} {
+		fs.dropped = nil
+		c.invalidate()
+		if !reflect.DeepEqual(c.expected, fs.dropped) {
+			t.Errorf(`dropped the content of %q, expected %q`, fs.dropped, c.expected)
+		}
+	}
+}
+
+func TestCachingFs_Control_hidden(t *testing.T) {
+	_, dir, cleanup := setup(t)
+	defer cleanup()
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf(`error listing directory: %s`, err)
+	}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.Name() == controlDir {
+			t.Errorf(`expected %s to be hidden from the root listing`, controlDir)
+		}
+	}
+
+	if _, err := ioutil.ReadFile(path.Join(dir, ".control/invalidate")); !os.IsPermission(err) {
+		t.Errorf(`expected to get permissions error reading the control file, got %v`, err)
+	}
+}
+
+func TestCachingFs_Control_otherUser(t *testing.T) {
+	fs := New(pathfs.NewDefaultFileSystem(), time.Hour)
+
+	other := &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: uint32(os.Getuid() + 1000)}}}
+	if _, code := fs.Open(invalidateFile, uint32(os.O_WRONLY), other); code != fuse.EACCES {
+		t.Errorf(`expected other users to get EACCES opening the control file, got %s`, code)
+	}
+	if _, code := fs.Open(invalidateFile, uint32(os.O_WRONLY), nil); !code.Ok() {
+		t.Errorf(`expected the owner to open the control file, got %s`, code)
+	}
+}
+
+func TestCachingFs_refetchNotifiesKernel(t *testing.T) {
+	fs, cache, dir, cleanup := setupWithTTL(t, 10*time.Millisecond, time.Hour)
+	defer cleanup()
+
+	if info, err := os.Stat(path.Join(dir, "dir/file")); err != nil || info.Size() != 1 {
+		t.Fatalf(`expected file size 1, got %+v (%v)`, info, err)
+	}
+
+	fs.setSize(2)
+	time.Sleep(20 * time.Millisecond)
+
+	// the kernel still has the old attributes, so refresh them ourselves
+	if attr, _ := cache.GetAttr("dir/file", nil); attr.Size != 2 {
+		t.Fatalf(`expected refreshed size 2, got %d`, attr.Size)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		info, err := os.Stat(path.Join(dir, "dir/file"))
+		if err != nil {
+			t.Fatalf(`error retrieving stat %s`, err)
+		}
+		if info.Size() == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf(`kernel still reports size %d after the value changed`, info.Size())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKernelOptions(t *testing.T) {
+	for _, tt := range []struct {
+		ttl      time.Duration
+		expected time.Duration
+	}{
+		{0, 0},
+		{30 * time.Second, 30 * time.Second},
+		{-1, indefiniteTimeout},
+	} {
+		opts := KernelOptions(tt.ttl)
+		if opts.EntryTimeout != tt.expected || opts.AttrTimeout != tt.expected {
+			t.Errorf(`expected entry and attribute timeouts of %s for ttl %s, got %s and %s`, tt.expected, tt.ttl, opts.EntryTimeout, opts.AttrTimeout)
+		}
+		if opts.NegativeTimeout != 0 {
+			t.Errorf(`expected no negative timeout for ttl %s, got %s`, tt.ttl, opts.NegativeTimeout)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package cachingfs
+
+import (
+	"bytes"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+)
+
+// The control directory is hidden from the listing of the root, but can be
+// accessed directly
+const (
+	controlDir     = ".control"
+	invalidateFile = controlDir + "/invalidate"
+)
+
+// controlAttr returns the attributes of the control paths, if name is one
+func controlAttr(name string) (*fuse.Attr, bool) {
+	switch name {
+	case controlDir:
+		return &fuse.Attr{Size: 4096, Mode: fuse.S_IFDIR | 0500}, true
+	case invalidateFile:
+		return &fuse.Attr{Mode: fuse.S_IFREG | 0200}, true
+	default:
+		return nil, false
+	}
+}
+
+// controlFile collects invalidation requests written to .control/invalidate
+// and applies them when the file is flushed. One path is expected per line:
+//
+//	meta-data/instance-id   invalidates that path only
+//	meta-data/network/      invalidates that path and everything beneath it
+//	/                       invalidates everything
+type controlFile struct {
+	nodefs.File
+
+	fs FileSystem
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func newControlFile(fs FileSystem) *controlFile {
+	return &controlFile{
+		File: nodefs.NewDefaultFile(),
+		fs:   fs,
+	}
+}
+
+func (f *controlFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.buf.Write(data)
+	return uint32(len(data)), fuse.OK
+}
+
+func (f *controlFile) Truncate(size uint64) fuse.Status {
+	return fuse.OK
+}
+
+func (f *controlFile) Flush() fuse.Status {
+	f.mu.Lock()
+	requests := f.buf.String()
+	f.buf.Reset()
+	f.mu.Unlock()
+
+	for _, line := range strings.Split(requests, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		name := strings.Trim(path.Clean("/"+line), "/")
+		if strings.HasSuffix(line, "/") {
+			f.fs.InvalidateTree(name)
+		} else {
+			f.fs.Invalidate(name)
+		}
+	}
+
+	return fuse.OK
+}
+
+func (f *controlFile) String() string {
+	return "controlFile(" + invalidateFile + ")"
+}
@@ -17,6 +17,10 @@ type cacheEntry struct {
 // timedCacheFetcher fetches the value for a cache miss
 type timedCacheFetcher func(name string) (value interface{}, cacheable bool)
 
+// timedCacheNotifier is called when a value is fetched again for a name that
+// had been cached before, so that callers can act on the value changing
+type timedCacheNotifier func(name string, old, new interface{})
+
 // timedCache caches the result of fetch() for some time. It is
 // thread-safe. Calls of fetch() do not happen inside a critical
 // section, so when multiple concurrent Get()s happen for the same
@@ -24,6 +28,9 @@ type timedCacheFetcher func(name string) (value interface{}, cacheable bool)
 type timedCache struct {
 	fetch timedCacheFetcher
 
+	// refetched, if set, is called whenever an expired entry is replaced
+	refetched timedCacheNotifier
+
 	// ttl is the duration of the cache.
 	ttl time.Duration
 
@@ -64,9 +71,43 @@ func (c *timedCache) set(name string, val interface{}) {
 }
 
 func (c *timedCache) getFresh(name string) interface{} {
+	c.cacheMapMutex.RLock()
+	old, hadOld := c.cacheMap[name]
+	c.cacheMapMutex.RUnlock()
+
 	data, ok := c.fetch(name)
 	if ok {
 		c.set(name, data)
+	} else if hadOld {
+		c.Drop(name)
+	}
+
+	if hadOld && c.refetched != nil {
+		c.refetched(name, old.data, data)
 	}
 	return data
 }
+
+// Drop removes the cached entry for name, if there is one.
+func (c *timedCache) Drop(name string) {
+	c.cacheMapMutex.Lock()
+	defer c.cacheMapMutex.Unlock()
+
+	delete(c.cacheMap, name)
+}
+
+// DropMatching removes every cached entry whose name satisfies match and
+// returns the names that were removed.
+func (c *timedCache) DropMatching(match func(name string) bool) []string {
+	c.cacheMapMutex.Lock()
+	defer c.cacheMapMutex.Unlock()
+
+	dropped := []string{}
+	for name := range c.cacheMap {
+		if match(name) {
+			delete(c.cacheMap, name)
+			dropped = append(dropped, name)
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,133 @@
+// Package eventstream keeps a bounded log of value changes seen by the daemon
+// and serves it as a file that readers can follow like a pipe.
+package eventstream
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Record is a single change, written to the stream as one line of JSON
+type Record struct {
+	Path string `json:"path"`
+
+	// Old and New are nil if the path did not exist before or after the
+	// change
+	Old *string `json:"old"`
+	New *string `json:"new"`
+
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NewRecord returns the Record for path changing from old to new, where a
+// nil value means the path was missing
+func NewRecord(path string, old, new []byte, t time.Time) Record {
+	return Record{Path: path, Old: optionalString(old), New: optionalString(new), Timestamp: t}
+}
+
+func optionalString(b []byte) *string {
+	if b == nil {
+		return nil
+	}
+	s := string(b)
+	return &s
+}
+
+// Stream is an append-only log of records. Only the most recent bytes are
+// retained, so readers falling too far behind skip the records they missed
+// rather than holding up publishers or other readers.
+type Stream struct {
+	mu sync.Mutex
+
+	// data holds the encoded records from offset start onwards
+	data  []byte
+	start int64
+	size  int
+
+	modified time.Time
+
+	// published is closed and replaced whenever records are added
+	published chan struct{}
+}
+
+// New returns a Stream retaining about size bytes of records
+func New(size int) *Stream {
+	return &Stream{
+		size:      size,
+		modified:  time.Now(),
+		published: make(chan struct{}),
+	}
+}
+
+// Publish appends r to the stream, waking up blocked readers
+func (s *Stream) Publish(r Record) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		// records only hold strings and times
+		panic(err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data = append(s.data, line...)
+	if excess := len(s.data) - s.size; excess > 0 {
+		// only drop whole records so that readers never get half a line,
+		// and always keep the newest one
+		for excess < len(s.data)-len(line) && s.data[excess-1] != '\n' {
+			excess++
+		}
+		if excess > len(s.data)-len(line) {
+			excess = len(s.data) - len(line)
+		}
+		s.data = append([]byte(nil), s.data[excess:]...)
+		s.start += int64(excess)
+	}
+
+	s.modified = r.Timestamp
+	close(s.published)
+	s.published = make(chan struct{})
+}
+
+// end returns the offset just past the last record. Must be called with mu
+// held.
+func (s *Stream) end() int64 {
+	return s.start + int64(len(s.data))
+}
+
+// Size returns the number of bytes ever published and when the last record
+// was
+func (s *Stream) Size() (int64, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.end(), s.modified
+}
+
+// ReadAt copies the records at offset off into dest, blocking until there
+// are any or cancel is closed. Offsets before the retained records are moved
+// forward to the oldest one and the number of bytes skipped is returned.
+func (s *Stream) ReadAt(dest []byte, off int64, cancel <-chan struct{}) (n int, skipped int64, ok bool) {
+	for {
+		s.mu.Lock()
+		if off < s.start {
+			skipped = s.start - off
+			off = s.start
+		}
+		if off < s.end() {
+			n = copy(dest, s.data[off-s.start:])
+			s.mu.Unlock()
+			return n, skipped, true
+		}
+		published := s.published
+		s.mu.Unlock()
+
+		select {
+		case <-published:
+		case <-cancel:
+			return 0, skipped, false
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package eventstream
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/jszwedko/ec2-metadatafs/internal/logging"
+)
+
+func setup(t *testing.T, size int) (stream *Stream, dir string, cleanup func()) {
+	tmpDir, err := ioutil.TempDir("", "eventstream-test")
+	if err != nil {
+		t.Fatalf("creating tempdir failed: %v", err)
+	}
+
+	stream = New(size)
+	nfs := pathfs.NewPathNodeFs(pathfs.NewReadonlyFileSystem(pathfs.NewDefaultFileSystem()), nil)
+	state, _, err := nodefs.MountRoot(tmpDir, nfs.Root(), nodefs.NewOptions())
+	if err != nil {
+		t.Fatalf("mounting filesystem failed: %v", err)
+	}
+	nfs.Root().Inode().NewChild(".events", false, stream.Node(logging.NewLogger()))
+
+	go state.Serve()
+	state.WaitMount()
+
+	return stream, tmpDir, func() {
+		state.Unmount()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestStream_follow(t *testing.T) {
+	stream, dir, cleanup := setup(t, 4096)
+	defer cleanup()
+
+	timestamp := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	stream.Publish(NewRecord("meta-data/spot/instance-action", nil, []byte(`{"action": "stop"}`), timestamp))
+
+	f, err := os.Open(path.Join(dir, ".events"))
+	if err != nil {
+		t.Fatalf(`error opening stream: %s`, err)
+	}
+	defer f.Close()
+	lines := bufio.NewReader(f)
+
+	line, err := lines.ReadString('\n')
+	if err != nil {
+		t.Fatalf(`error reading retained record: %s`, err)
+	}
+	record := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		t.Fatalf(`error decoding record %q: %s`, line, err)
+	}
+	expected := map[string]interface{}{
+		"path":      "meta-data/spot/instance-action",
+		"old":       nil,
+		"new":       `{"action": "stop"}`,
+		"timestamp": "2026-10-18T12:00:00Z",
+	}
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf(`expected %s to be %v, got %v`, key, value, record[key])
+		}
+	}
+
+	// the next read blocks until a record is published
+	read := make(chan string)
+	go func() {
+		line, _ := lines.ReadString('\n')
+		read <- line
+	}()
+
+	select {
+	case line := <-read:
+		t.Fatalf(`expected read to block, got %q`, line)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stream.Publish(NewRecord("tags/Name", []byte("a"), []byte("b"), timestamp))
+
+	select {
+	case line := <-read:
+		if !strings.Contains(line, `"path":"tags/Name","old":"a","new":"b"`) {
+			t.Errorf(`unexpected record %q`, line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf(`read did not return after publishing`)
+	}
+}
+
+func TestStream_slowReader(t *testing.T) {
+	stream := New(100)
+
+	record := NewRecord("meta-data/instance-type", []byte("m5.large"), []byte("m5.xlarge"), time.Now())
+	for i := 0; i < 10; i++ {
+		stream.Publish(record)
+	}
+
+	buf := make([]byte, 4096)
+	n, skipped, ok := stream.ReadAt(buf, 0, nil)
+	if !ok || skipped == 0 {
+		t.Fatalf(`expected a reader from the start to skip dropped records, skipped %d`, skipped)
+	}
+	if n == 0 || buf[n-1] != '\n' || strings.Count(string(buf[:n]), "\n") != 1 {
+		t.Errorf(`expected only the whole records retained, got %q`, buf[:n])
+	}
+	if size, _ := stream.Size(); size != skipped+int64(n) {
+		t.Errorf(`expected size %d to be the skipped and retained bytes, got %d`, skipped+int64(n), size)
+	}
+}
+
+func TestStream_cancel(t *testing.T) {
+	stream := New(100)
+	cancel := make(chan struct{})
+	close(cancel)
+
+	if _, _, ok := stream.ReadAt(make([]byte, 10), 0, cancel); ok {
+		t.Errorf(`expected a cancelled read to fail`)
+	}
+}
+
+func TestStream_interruptBlockedRead(t *testing.T) {
+	_, dir, cleanup := setup(t, 4096)
+	defer cleanup()
+
+	cmd := exec.Command("cat", path.Join(dir, ".events"))
+	if err := cmd.Start(); err != nil {
+		t.Fatalf(`error starting reader: %s`, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error)
+	go func() { done <- cmd.Wait() }()
+	cmd.Process.Signal(os.Interrupt)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf(`blocked reader did not exit after being interrupted`)
+	}
+}
@@ -0,0 +1,102 @@
+package eventstream
+
+import (
+	"sync"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/jszwedko/ec2-metadatafs/logger"
+)
+
+// streamNode serves a Stream as a read-only file
+//
+// It is a plain nodefs.Node rather than part of a pathfs.FileSystem because
+// pathfs does not pass the request's cancel channel on to reads, and a read
+// blocked waiting for records has to return when the reader is interrupted.
+type streamNode struct {
+	nodefs.Node
+
+	stream *Stream
+	logger logger.LeveledLogger
+}
+
+// Node returns a nodefs.Node serving the stream. It should be added to the
+// tree with nodefs.Inode.NewChild.
+//
+// Offsets are positions in the stream, so that a reader opening the file
+// starts with the retained records and then blocks waiting for new ones.
+func (s *Stream) Node(l logger.LeveledLogger) nodefs.Node {
+	return &streamNode{Node: nodefs.NewDefaultNode(), stream: s, logger: l}
+}
+
+// Deletable keeps the node around after the kernel forgets it, as it cannot
+// be looked up again otherwise
+func (n *streamNode) Deletable() bool {
+	return false
+}
+
+func (n *streamNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) fuse.Status {
+	size, modified := n.stream.Size()
+
+	out.Mode = fuse.S_IFREG | 0444
+	out.Size = uint64(size)
+	out.SetTimes(nil, &modified, &modified)
+	return fuse.OK
+}
+
+func (n *streamNode) Open(flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EACCES
+	}
+
+	// bypass the page cache as the contents change without the size the
+	// kernel knows about being updated
+	return &nodefs.WithFlags{
+		File:      &streamFile{File: nodefs.NewDefaultFile()},
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, fuse.OK
+}
+
+func (n *streamNode) Read(file nodefs.File, dest []byte, off int64, context *fuse.Context) (fuse.ReadResult, fuse.Status) {
+	f, ok := file.(*streamFile)
+	if !ok {
+		return nil, fuse.EBADF
+	}
+
+	read, skipped, ok := n.stream.ReadAt(dest, f.position(off), context.Cancel)
+	if skipped > 0 {
+		n.logger.Warningf("event stream reader fell behind, skipped %d bytes of records", skipped)
+		f.skip(skipped)
+	}
+	if !ok {
+		return nil, fuse.EINTR
+	}
+
+	return fuse.ReadResultData(dest[:read]), fuse.OK
+}
+
+// streamFile is an open handle on a stream
+type streamFile struct {
+	nodefs.File
+
+	mu sync.Mutex
+	// skew is how far the stream position is ahead of the file offset
+	// after records were skipped
+	skew int64
+}
+
+// position returns the stream position for the file offset off
+func (f *streamFile) position(off int64) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return off + f.skew
+}
+
+// skip records that the stream position moved ahead of the file offset
+func (f *streamFile) skip(skipped int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.skew += skipped
+}
@@ -0,0 +1,50 @@
+// Package fusetest mounts the filesystems of the mount for their tests
+package fusetest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+)
+
+// Mount mounts fs at a new temporary directory, cleanup unmounts and
+// removes it
+func Mount(t *testing.T, fs pathfs.FileSystem) (dir string, cleanup func()) {
+	tmpDir, err := ioutil.TempDir("", "ec2metadata-test")
+	if err != nil {
+		t.Fatalf("creating tempdir failed: %v", err)
+	}
+
+	nfs := pathfs.NewPathNodeFs(fs, nil)
+	state, _, err := nodefs.MountRoot(tmpDir, nfs.Root(), nodefs.NewOptions())
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		t.Fatalf("mounting filesystem failed: %v", err)
+	}
+
+	go state.Serve()
+	state.WaitMount()
+
+	return tmpDir, func() {
+		state.Unmount()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+// Listing returns the entries of dir as "<name> <mode>", e.g.
+// "db dr-x------"
+func Listing(t *testing.T, dir string) []string {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf(`error listing directory: %s`, err)
+	}
+	names := []string{}
+	for _, fileInfo := range fileInfos {
+		names = append(names, fmt.Sprintf("%s %s", fileInfo.Name(), fileInfo.Mode()))
+	}
+	return names
+}
@@ -0,0 +1,74 @@
+// Package fuseutil holds the helpers shared by the filesystems of the mount
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/aws/smithy-go"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// RequestContext returns the context of a FUSE request, which is cancelled
+// if the request is interrupted. Calls made outside of a request have none.
+func RequestContext(c *fuse.Context) context.Context {
+	if c == nil {
+		return context.Background()
+	}
+	return c
+}
+
+// OwnedAttr marks attr as owned by the owner of the mount
+func OwnedAttr(attr *fuse.Attr) *fuse.Attr {
+	attr.Owner = *fuse.CurrentOwner()
+	return attr
+}
+
+// Allowed reports whether the caller of a request is the owner of the mount
+// or root. The kernel only enforces permission bits with default_permissions,
+// so filesystems serving secrets or taking actions check this themselves,
+// as with allow_other any local user can reach them. Calls made outside of a
+// request are always allowed.
+func Allowed(context *fuse.Context) bool {
+	if context == nil {
+		return true
+	}
+	return context.Uid == 0 || context.Uid == uint32(os.Getuid())
+}
+
+// ErrorStatus maps an error returned by an AWS API to an errno: EINTR if the
+// request was interrupted, the errno codes maps its error code to, or EIO
+func ErrorStatus(err error, codes map[string]fuse.Status) fuse.Status {
+	if errors.Is(err, context.Canceled) {
+		return fuse.EINTR
+	}
+
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return fuse.EIO
+	}
+	if code, ok := codes[apiErr.ErrorCode()]; ok {
+		return code
+	}
+	return fuse.EIO
+}
+
+// EscapeName returns the file name of a key that may contain "/" or be "."
+// or "..", none of which can be used as file names. "%" is escaped as "%25",
+// "/" as "%2F", and "." and ".." as "%2E" and "%2E%2E".
+func EscapeName(name string) string {
+	switch name {
+	case ".":
+		return "%2E"
+	case "..":
+		return "%2E%2E"
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(name, "%", "%25"), "/", "%2F")
+}
+
+// ShellQuote quotes value so that a POSIX shell reads it literally
+func ShellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,67 @@
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/aws/smithy-go"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestAllowed(t *testing.T) {
+	other := uint32(os.Getuid() + 1000)
+	for uid, expected := range map[uint32]bool{0: true, uint32(os.Getuid()): true, other: false} {
+		context := &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: uid}}}
+		if Allowed(context) != expected {
+			t.Errorf(`allowed for uid %d: %t, expected %t`, uid, !expected, expected)
+		}
+	}
+	if !Allowed(nil) {
+		t.Errorf(`expected calls outside of a request to be allowed`)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	codes := map[string]fuse.Status{"AccessDenied": fuse.EACCES}
+	for _, test := range []struct {
+		err      error
+		expected fuse.Status
+	}{
+		{errors.New("failed"), fuse.EIO},
+		{fmt.Errorf("failed to query AWS API: %w", context.Canceled), fuse.EINTR},
+		{fmt.Errorf("failed to query AWS API: %w", &smithy.GenericAPIError{Code: "AccessDenied"}), fuse.EACCES},
+		{&smithy.GenericAPIError{Code: "UnknownError"}, fuse.EIO},
+	} {
+		if code := ErrorStatus(test.err, codes); code != test.expected {
+			t.Errorf(`error %q mapped to %s, expected %s`, test.err, code, test.expected)
+		}
+	}
+}
+
+func TestEscapeName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"Name":       "Name",
+		"team/owner": "team%2Fowner",
+		"100%":       "100%25",
+		".":          "%2E",
+		"..":         "%2E%2E",
+		"...":        "...",
+	} {
+		if escaped := EscapeName(name); escaped != expected {
+			t.Errorf(`escaped %q as %q, expected %q`, name, escaped, expected)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, value := range []string{"", "plain", "it's", `$HOME "quoted" \n`, "two\nlines"} {
+		out, err := exec.Command("sh", "-c", "printf %s "+ShellQuote(value)).CombinedOutput()
+		if err != nil || string(out) != value {
+			t.Errorf(`shell read %q as %q, %v`, value, out, err)
+		}
+	}
+}
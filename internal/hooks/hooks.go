@@ -0,0 +1,348 @@
+// Package hooks runs commands when the instance metadata service announces
+// events such as spot interruptions, rebalance recommendations, scheduled
+// maintenance or auto scaling lifecycle transitions.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jszwedko/ec2-metadatafs/logger"
+	"github.com/jszwedko/ec2-metadatafs/metadatafs"
+)
+
+// EventTypes maps the event types hooks can be configured for to the
+// metadata path announcing them
+var EventTypes = map[string]string{
+	"spot-interruption": "meta-data/spot/instance-action",
+	"rebalance":         "meta-data/events/recommendations/rebalance",
+	"maintenance":       "meta-data/events/maintenance/scheduled",
+	"lifecycle-state":   "meta-data/autoscaling/target-lifecycle-state",
+}
+
+// Event is a single event announced by the metadata service
+type Event struct {
+	Type string
+	Path string
+
+	// ID identifies the event across polls and restarts. It is the EventId
+	// of maintenance events and derived from the payload otherwise.
+	ID string
+
+	// Payload is the event as returned by the metadata service
+	Payload []byte
+}
+
+// Runner polls the paths of the event types it has hooks for and runs the
+// matching command once for every distinct event. Events are forgotten once
+// they are no longer announced.
+type Runner struct {
+	// Hooks maps event types to shell commands
+	Hooks map[string]string
+
+	// Timeout is how long a command may run before being killed
+	Timeout time.Duration
+
+	// StateFile, if set, is where delivered events are recorded so that
+	// they are not delivered again after a restart
+	StateFile string
+
+	Logger logger.LeveledLogger
+
+	watcher *metadatafs.Watcher
+
+	mu         sync.Mutex
+	delivered  map[string]time.Time
+	subscribed bool
+	running    sync.WaitGroup
+}
+
+// New returns a Runner for the given hooks, polling every interval. Unknown
+// event types are an error.
+func New(client metadatafs.MetadataClient, hooks map[string]string, interval, timeout time.Duration, stateFile string, l logger.LeveledLogger) (*Runner, error) {
+	paths := []string{}
+	for eventType := range hooks {
+		path, ok := EventTypes[eventType]
+		if !ok {
+			return nil, fmt.Errorf("unknown event type %q, valid types are: %s", eventType, strings.Join(eventTypeNames(), ", "))
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	r := &Runner{
+		Hooks:     hooks,
+		Timeout:   timeout,
+		StateFile: stateFile,
+		Logger:    l,
+		watcher:   metadatafs.NewWatcher(client, paths, interval, l),
+		delivered: map[string]time.Time{},
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func eventTypeNames() []string {
+	names := []string{}
+	for name := range EventTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run polls for events until stop is closed. Events already present when
+// starting are delivered too, unless recorded as delivered in StateFile.
+func (r *Runner) Run(stop <-chan struct{}) {
+	r.Poll()
+	r.watcher.Run(stop)
+	r.running.Wait()
+}
+
+// Poll checks for events once, starting the commands for any not yet
+// delivered. It is only needed when not using Run.
+func (r *Runner) Poll() {
+	r.watcher.Poll()
+
+	r.mu.Lock()
+	subscribed := r.subscribed
+	r.subscribed = true
+	r.mu.Unlock()
+	if subscribed {
+		return
+	}
+
+	// the watcher only reports changes after its first poll, so deliver
+	// whatever is already there and let the subscription handle the rest
+	for _, path := range r.watcher.Paths {
+		if value, ok := r.watcher.Value(path); ok {
+			r.handle(path, value)
+		}
+	}
+	r.watcher.Subscribe(func(c metadatafs.Change) {
+		r.handle(c.Path, c.New)
+	})
+}
+
+// Wait waits for the commands started so far to finish
+func (r *Runner) Wait() {
+	r.running.Wait()
+}
+
+// handle delivers the events found in a value of path, nil if it is missing
+func (r *Runner) handle(path string, value []byte) {
+	for eventType, eventPath := range EventTypes {
+		if eventPath != path {
+			continue
+		}
+
+		var events []Event
+		if value != nil {
+			var err error
+			events, err = parseEvents(eventType, path, value)
+			if err != nil {
+				r.Logger.Warningf("failed to parse %s event from %s: %s", eventType, path, err)
+				return
+			}
+		}
+
+		r.forget(eventType, events)
+		for _, event := range events {
+			r.deliver(event)
+		}
+	}
+}
+
+// forget drops the delivered events of eventType that are no longer
+// announced, so that the record doesn't grow forever and an event coming
+// back, like returning to a lifecycle state, is delivered again
+func (r *Runner) forget(eventType string, current []Event) {
+	announced := map[string]bool{}
+	for _, event := range current {
+		announced[event.ID] = true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	forgotten := false
+	for id := range r.delivered {
+		if strings.HasPrefix(id, eventType+":") && !announced[id] {
+			delete(r.delivered, id)
+			forgotten = true
+		}
+	}
+	if !forgotten {
+		return
+	}
+
+	if err := r.save(); err != nil {
+		r.Logger.Warningf("failed to record %s events no longer announced: %s", eventType, err)
+	}
+}
+
+// parseEvents splits a value into the events it announces
+func parseEvents(eventType, path string, value []byte) ([]Event, error) {
+	value = bytes.TrimSpace(value)
+
+	switch eventType {
+	case "lifecycle-state":
+		// plain text, e.g. InService
+		if len(value) == 0 {
+			return nil, nil
+		}
+		return []Event{{Type: eventType, Path: path, ID: eventType + ":" + string(value), Payload: value}}, nil
+	case "maintenance":
+		scheduled := []json.RawMessage{}
+		if err := json.Unmarshal(value, &scheduled); err != nil {
+			return nil, err
+		}
+
+		events := []Event{}
+		for _, payload := range scheduled {
+			var fields struct{ EventId string }
+			if err := json.Unmarshal(payload, &fields); err != nil {
+				return nil, err
+			}
+			id := fields.EventId
+			if id == "" {
+				id = payloadID(payload)
+			}
+			events = append(events, Event{Type: eventType, Path: path, ID: eventType + ":" + id, Payload: payload})
+		}
+		return events, nil
+	default:
+		if !json.Valid(value) {
+			return nil, fmt.Errorf("invalid JSON: %q", value)
+		}
+		return []Event{{Type: eventType, Path: path, ID: eventType + ":" + payloadID(value), Payload: value}}, nil
+	}
+}
+
+// payloadID identifies an event by its contents
+func payloadID(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:8])
+}
+
+// deliver starts the hook for event unless it was already delivered
+func (r *Runner) deliver(event Event) {
+	command, ok := r.Hooks[event.Type]
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	if _, done := r.delivered[event.ID]; done {
+		r.mu.Unlock()
+		r.Logger.Debugf("skipping already delivered event %s", event.ID)
+		return
+	}
+	// events are recorded before running so that a command that crashes the
+	// instance isn't run again when it comes back
+	r.delivered[event.ID] = time.Now()
+	err := r.save()
+	r.mu.Unlock()
+
+	if err != nil {
+		r.Logger.Warningf("failed to record delivery of event %s: %s", event.ID, err)
+	}
+
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		r.run(command, event)
+	}()
+}
+
+// run runs command for event, logging its output
+func (r *Runner) run(command string, event Event) {
+	r.Logger.Infof("running %s hook for event %s", event.Type, event.ID)
+
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(event.Payload)
+	cmd.Env = append(os.Environ(), eventEnv(event)...)
+	// don't wait on background processes holding on to the output once the
+	// command itself was killed
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		r.Logger.Errorf("%s hook for event %s timed out after %s, output: %s", event.Type, event.ID, r.Timeout, output)
+	case err != nil:
+		r.Logger.Errorf("%s hook for event %s failed: %s, output: %s", event.Type, event.ID, err, output)
+	default:
+		r.Logger.Infof("%s hook for event %s succeeded, output: %s", event.Type, event.ID, output)
+	}
+}
+
+var envUnsafe = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// reservedEnv are the variables set for every event, which fields may not
+// override
+var reservedEnv = map[string]bool{"TYPE": true, "ID": true, "PATH": true, "PAYLOAD": true}
+
+// eventEnv returns the environment variables describing event. Top-level
+// fields of JSON objects are exported individually, e.g. the action of a spot
+// interruption as EC2_METADATAFS_EVENT_ACTION.
+func eventEnv(event Event) []string {
+	env := []string{
+		"EC2_METADATAFS_EVENT_TYPE=" + event.Type,
+		"EC2_METADATAFS_EVENT_ID=" + event.ID,
+		"EC2_METADATAFS_EVENT_PATH=" + event.Path,
+		"EC2_METADATAFS_EVENT_PAYLOAD=" + string(event.Payload),
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(event.Payload, &fields); err != nil {
+		return env
+	}
+
+	keys := []string{}
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var value string
+		switch v := fields[key].(type) {
+		case string:
+			value = v
+		case float64, bool:
+			value = fmt.Sprint(v)
+		default:
+			continue
+		}
+		name := envUnsafe.ReplaceAllString(strings.ToUpper(key), "_")
+		if reservedEnv[name] {
+			continue
+		}
+		env = append(env, "EC2_METADATAFS_EVENT_"+name+"="+value)
+	}
+
+	return env
+}
@@ -0,0 +1,228 @@
+package hooks
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jszwedko/ec2-metadatafs/internal/logging"
+	"github.com/jszwedko/ec2-metadatafs/metadatafs"
+)
+
+// setup serves the given metadata path, returning a function to change its
+// value (nil removes it)
+func setup(t *testing.T, file string, body []byte) (client metadatafs.MetadataClient, set func([]byte), dir string, cleanup func()) {
+	var mu sync.Mutex
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+file, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if body == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	})
+	server := httptest.NewServer(mux)
+
+	tmpDir, err := ioutil.TempDir("", "hooks-test")
+	if err != nil {
+		t.Fatalf("creating tempdir failed: %v", err)
+	}
+
+	return metadatafs.NewIMDSv1Client(server.URL+"/", logging.NewLogger()), func(b []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			body = b
+		}, tmpDir, func() {
+			server.Close()
+			os.RemoveAll(tmpDir)
+		}
+}
+
+// deliveries returns the lines the test hook appended to its log
+func deliveries(t *testing.T, dir string) []string {
+	data, err := ioutil.ReadFile(path.Join(dir, "log"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("reading hook log failed: %v", err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestRunner_spotInterruption(t *testing.T) {
+	client, set, dir, cleanup := setup(t, "meta-data/spot/instance-action", nil)
+	defer cleanup()
+
+	hooks := map[string]string{
+		"spot-interruption": `echo "$EC2_METADATAFS_EVENT_TYPE $EC2_METADATAFS_EVENT_ACTION $(cat)" >> ` + path.Join(dir, "log"),
+	}
+	runner, err := New(client, hooks, time.Hour, time.Minute, path.Join(dir, "state.json"), logging.NewLogger())
+	if err != nil {
+		t.Fatalf("creating runner failed: %v", err)
+	}
+
+	runner.Poll()
+	runner.Wait()
+	if lines := deliveries(t, dir); len(lines) != 0 {
+		t.Fatalf(`expected no deliveries without an event, got %q`, lines)
+	}
+
+	payload := `{"action": "stop", "time": "2026-10-18T12:00:00Z"}`
+	set([]byte(payload))
+	for i := 0; i < 2; i++ {
+		runner.Poll()
+		runner.Wait()
+	}
+
+	lines := deliveries(t, dir)
+	if expected := "spot-interruption stop " + payload; len(lines) != 1 || lines[0] != expected {
+		t.Fatalf(`expected a single delivery %q, got %q`, expected, lines)
+	}
+
+	// a new runner must not deliver the recorded event again
+	runner, err = New(client, hooks, time.Hour, time.Minute, path.Join(dir, "state.json"), logging.NewLogger())
+	if err != nil {
+		t.Fatalf("creating runner failed: %v", err)
+	}
+	runner.Poll()
+	runner.Wait()
+
+	if lines := deliveries(t, dir); len(lines) != 1 {
+		t.Fatalf(`expected the event not to be delivered again after restarting, got %q`, lines)
+	}
+
+	set([]byte(`{"action": "terminate", "time": "2026-10-18T12:00:00Z"}`))
+	runner.Poll()
+	runner.Wait()
+
+	if lines := deliveries(t, dir); len(lines) != 2 || !strings.HasPrefix(lines[1], "spot-interruption terminate ") {
+		t.Errorf(`expected a delivery for the new event, got %q`, lines)
+	}
+}
+
+func TestRunner_maintenance(t *testing.T) {
+	client, set, dir, cleanup := setup(t, "meta-data/events/maintenance/scheduled", []byte(`[]`))
+	defer cleanup()
+
+	hooks := map[string]string{
+		"maintenance": `echo "$EC2_METADATAFS_EVENT_ID $EC2_METADATAFS_EVENT_CODE" >> ` + path.Join(dir, "log"),
+	}
+	runner, err := New(client, hooks, time.Hour, time.Minute, "", logging.NewLogger())
+	if err != nil {
+		t.Fatalf("creating runner failed: %v", err)
+	}
+
+	runner.Poll()
+	set([]byte(`[{"EventId": "instance-event-1", "Code": "system-reboot"}]`))
+	runner.Poll()
+	runner.Wait()
+	set([]byte(`[{"EventId": "instance-event-1", "Code": "system-reboot"}, {"EventId": "instance-event-2", "Code": "instance-stop"}]`))
+	runner.Poll()
+	runner.Wait()
+
+	lines := deliveries(t, dir)
+	expected := []string{"maintenance:instance-event-1 system-reboot", "maintenance:instance-event-2 instance-stop"}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf(`expected deliveries %q, got %q`, expected, lines)
+	}
+}
+
+func TestRunner_lifecycleState(t *testing.T) {
+	client, set, dir, cleanup := setup(t, "meta-data/autoscaling/target-lifecycle-state", []byte("InService"))
+	defer cleanup()
+
+	hooks := map[string]string{
+		"lifecycle-state": `echo "$(cat)" >> ` + path.Join(dir, "log"),
+	}
+	runner, err := New(client, hooks, time.Hour, time.Minute, "", logging.NewLogger())
+	if err != nil {
+		t.Fatalf("creating runner failed: %v", err)
+	}
+
+	for _, state := range []string{"InService", "Standby", "InService"} {
+		set([]byte(state))
+		runner.Poll()
+		runner.Wait()
+	}
+
+	lines := deliveries(t, dir)
+	expected := []string{"InService", "Standby", "InService"}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf(`expected deliveries %q when returning to a state, got %q`, expected, lines)
+	}
+}
+
+func TestRunner_forget(t *testing.T) {
+	client, set, dir, cleanup := setup(t, "meta-data/events/maintenance/scheduled", []byte(`[{"EventId": "instance-event-1"}]`))
+	defer cleanup()
+
+	hooks := map[string]string{"maintenance": "true"}
+	runner, err := New(client, hooks, time.Hour, time.Minute, path.Join(dir, "state.json"), logging.NewLogger())
+	if err != nil {
+		t.Fatalf("creating runner failed: %v", err)
+	}
+
+	runner.Poll()
+	set([]byte(`[{"EventId": "instance-event-2"}]`))
+	runner.Poll()
+	runner.Wait()
+
+	if _, ok := runner.delivered["maintenance:instance-event-1"]; ok || len(runner.delivered) != 1 {
+		t.Errorf(`expected only the announced event to be recorded, got %v`, runner.delivered)
+	}
+
+	set(nil)
+	runner.Poll()
+
+	// the state file must not keep events that are gone either
+	runner, err = New(client, hooks, time.Hour, time.Minute, path.Join(dir, "state.json"), logging.NewLogger())
+	if err != nil {
+		t.Fatalf("creating runner failed: %v", err)
+	}
+	if len(runner.delivered) != 0 {
+		t.Errorf(`expected no recorded events once they disappeared, got %v`, runner.delivered)
+	}
+}
+
+func TestRunner_timeout(t *testing.T) {
+	client, _, dir, cleanup := setup(t, "meta-data/autoscaling/target-lifecycle-state", []byte("Terminated"))
+	defer cleanup()
+
+	hooks := map[string]string{
+		"lifecycle-state": `sleep 10; echo done >> ` + path.Join(dir, "log"),
+	}
+	runner, err := New(client, hooks, time.Hour, 100*time.Millisecond, "", logging.NewLogger())
+	if err != nil {
+		t.Fatalf("creating runner failed: %v", err)
+	}
+
+	start := time.Now()
+	runner.Poll()
+	runner.Wait()
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf(`expected the hook to be killed after its timeout, took %s`, elapsed)
+	}
+	if lines := deliveries(t, dir); len(lines) != 0 {
+		t.Errorf(`expected the hook not to complete, got %q`, lines)
+	}
+}
+
+func TestNew_unknownEventType(t *testing.T) {
+	_, err := New(nil, map[string]string{"bogus": "true"}, time.Hour, time.Minute, "", logging.NewLogger())
+	if err == nil {
+		t.Errorf(`expected an error for an unknown event type`)
+	}
+}
@@ -0,0 +1,69 @@
+package hooks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// state is what is persisted to Runner.StateFile
+type state struct {
+	// Delivered maps the IDs of delivered events to when they were delivered
+	Delivered map[string]time.Time `json:"delivered"`
+}
+
+// load reads the delivered events from StateFile, if it exists
+func (r *Runner) load() error {
+	if r.StateFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(r.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s := state{}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	for id, t := range s.Delivered {
+		r.delivered[id] = t
+	}
+
+	return nil
+}
+
+// save writes the delivered events to StateFile, replacing it atomically so
+// that a crash never leaves it truncated. Must be called with mu held.
+func (r *Runner) save() error {
+	if r.StateFile == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(state{Delivered: r.delivered}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(r.StateFile), filepath.Base(r.StateFile)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), r.StateFile)
+}
@@ -1,30 +1,51 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"log/syslog"
+	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
 	"github.com/jessevdk/go-flags"
+	"github.com/jszwedko/ec2-metadatafs/autoscalingfs"
+	"github.com/jszwedko/ec2-metadatafs/instancefs"
 	"github.com/jszwedko/ec2-metadatafs/internal/cachingfs"
+	"github.com/jszwedko/ec2-metadatafs/internal/eventstream"
+	"github.com/jszwedko/ec2-metadatafs/internal/hooks"
 	"github.com/jszwedko/ec2-metadatafs/internal/logging"
 	"github.com/jszwedko/ec2-metadatafs/metadatafs"
+	"github.com/jszwedko/ec2-metadatafs/secretsfs"
+	"github.com/jszwedko/ec2-metadatafs/ssmfs"
 	"github.com/jszwedko/ec2-metadatafs/tagsfs"
 	"github.com/sevlyar/go-daemon"
 )
@@ -103,10 +124,55 @@ type Options struct {
 	Tags         bool         `short:"t" long:"tags"        description:"Mount EC2 instance tags at <mount point>/tags"`
 	MountOptions mountOptions `short:"o" long:"options"     description:"Mount options, see below for description"`
 
+	TagsWritable bool   `long:"tags-writable" description:"Allow tags to be created, updated and deleted through <mount point>/tags"`
+	TagsSource   string `long:"tags-source"   description:"Where to read tags from: imds (instance metadata tags), api (EC2 API) or auto (imds if enabled, else api)" default:"api" choice:"imds" choice:"api" choice:"auto"`
+
+	TagsFile string `long:"tags-file" description:"Read tags from a JSON file of keys to values instead of tags source"`
+
+	TagsRefresh time.Duration `long:"tags-refresh" description:"How long tags read from the AWS API are served before being fetched again, 0 to fetch on every access" default:"1m"`
+	TagsNested  bool          `long:"tags-nested"  description:"Show tag keys containing / as nested directories instead of escaping them"`
+	TagsRelated bool          `long:"tags-related" description:"Also show the tags of the instance's volumes, network interfaces, security groups, subnet and VPC"`
+
+	TagsInclude     []string `long:"tags-include"      description:"Only show tags whose keys match the given glob, can be specified multiple times"`
+	TagsExclude     []string `long:"tags-exclude"      description:"Hide tags whose keys match the given glob, can be specified multiple times"`
+	TagsStripPrefix string   `long:"tags-strip-prefix" description:"Show tag keys starting with the given prefix without it"`
+
+	Instance        bool          `long:"instance"         description:"Mount the instance as described by the EC2 API at <mount point>/instance"`
+	InstanceRefresh time.Duration `long:"instance-refresh" description:"How long the instance is served before being described again, 0 to describe it on every access" default:"1m"`
+
+	AutoScaling        bool          `long:"autoscaling"         description:"Mount the instance's Auto Scaling group at <mount point>/autoscaling"`
+	AutoScalingRefresh time.Duration `long:"autoscaling-refresh" description:"How long the Auto Scaling group is served before being described again, 0 to describe it on every access" default:"10s"`
+
+	SSMPath    string        `long:"ssm-path"    description:"Mount the SSM parameters beneath the given path at <mount point>/ssm"`
+	SSMRefresh time.Duration `long:"ssm-refresh" description:"How long SSM parameters are served before being fetched again, 0 to fetch them on every access" default:"5m"`
+
+	Secrets        []string      `long:"secret"          description:"Mount the given Secrets Manager secret, by name or ARN, under <mount point>/secrets, can be specified multiple times"`
+	SecretsRefresh time.Duration `long:"secrets-refresh" description:"How long secrets are served before being described again, 0 to describe them on every access" default:"5m"`
+
+	EC2Endpoint string `long:"ec2-endpoint" description:"EC2 API endpoint used for tags and the instance, e.g. a VPC endpoint (default: the regional endpoint)"`
+	Region      string `long:"region"       description:"AWS region of the AWS APIs (default: the instance's region)"`
+	FIPS        bool   `long:"fips"         description:"Use the FIPS endpoints of the AWS APIs"`
+	CABundle    string `long:"ca-bundle"    description:"PEM file of CA certificates to trust for the AWS APIs along with the system's, e.g. for a private endpoint"`
+
+	Watch         []string      `short:"w" long:"watch"          description:"Poll the given metadata path for changes and notify inotify watchers, can be specified multiple times"`
+	WatchInterval time.Duration `          long:"watch-interval" description:"How often to poll watched paths and hook events for changes" default:"5s"`
+
+	Hooks       []string      `long:"hook"         description:"Run a command for every distinct event of a type, as TYPE=COMMAND (see below), can be specified multiple times"`
+	HookTimeout time.Duration `long:"hook-timeout" description:"How long a hook command may run before being killed" default:"30s"`
+	HookState   string        `long:"hook-state"   description:"File recording delivered events so they are not delivered again after a restart"`
+
+	WaitTimeout time.Duration `long:"wait-timeout" description:"How long opening a file under <mount point>/.wait blocks before failing, 0 to wait indefinitely" default:"0"`
+
+	SnapshotSensitive bool `long:"snapshot-sensitive" description:"Include credentials, user-data and other sensitive paths in <mount point>/.snapshot.json"`
+
+	Env []string `long:"env" description:"Also set a variable to the value of a metadata path in <mount point>/.env, as NAME=PATH (see below), can be specified multiple times"`
+
+	TemplatesDir string `long:"templates-dir" description:"Render each Go text/template in the directory to a file at <mount point> (see below)"`
+
 	DisableSyslog  bool   `short:"n" long:"no-syslog"        description:"Disable syslog when daemonized"`
 	SyslogFacility string `short:"F" long:"syslog-facility"  description:"Syslog facility to use when daemonized (see below for options)" default:"USER"`
 
-	AWSCredentials awsCredentials `group:"AWS Credentials (only used when mounting tags)"`
+	AWSCredentials awsCredentials `group:"AWS Credentials (only used when mounting tags, instance, autoscaling, ssm or secrets)"`
 
 	Args struct {
 		Mountpoint string `positional-arg-name:"mountpoint"   description:"Directory to mount the filesystem at"`
@@ -117,23 +183,149 @@ type awsCredentials struct {
 	AWSAccessKeyID     string `long:"aws-access-key-id"     description:"AWS Access Key ID (adds to credential chain, see below)"`
 	AWSSecretAccessKey string `long:"aws-secret-access-key" description:"AWS Secret Access key (adds to credential chain, see below)"`
 	AWSSessionToken    string `long:"aws-session-token"     description:"AWS session token (adds to credential chain, see below)"`
+	AWSProfile         string `long:"aws-profile"           description:"Profile of the shared credentials file to use (see below)"`
+	AWSRoleARN         string `long:"aws-role-arn"          description:"IAM role to assume with the credentials from the chain (see below)"`
+	AWSExternalID      string `long:"aws-external-id"       description:"External ID to pass when assuming --aws-role-arn"`
+}
+
+// credentialChain returns the credentials used for the AWS API, assuming
+// AWSRoleARN with them if set. Instance role credentials are read through
+// client and STS is called with cfg.
+func (a *awsCredentials) credentialChain(client metadatafs.MetadataClient, cfg aws.Config, logger *logging.Logger) aws.CredentialsProvider {
+	chain := &credentialChain{logger: logger}
+	if a.AWSAccessKeyID != "" || a.AWSSecretAccessKey != "" {
+		chain.add("flags or mount options", credentials.NewStaticCredentialsProvider(a.AWSAccessKeyID, a.AWSSecretAccessKey, a.AWSSessionToken))
+	}
+	chain.add("environment", aws.CredentialsProviderFunc(envCredentials))
+	chain.add("shared credentials file", sharedCredentials(a.AWSProfile))
+
+	// web identity tokens are how EKS pods assume their service account's
+	// role
+	tokenFile, roleARN := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+	if tokenFile != "" && roleARN != "" {
+		sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+		if sessionName == "" {
+			sessionName = "ec2-metadatafs"
+		}
+		chain.add("web identity token", stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(cfg), roleARN, stscreds.IdentityTokenFile(tokenFile), func(o *stscreds.WebIdentityRoleOptions) {
+			o.RoleSessionName = sessionName
+		}))
+	}
+
+	chain.add("instance role", ec2rolecreds.New(func(o *ec2rolecreds.Options) {
+		o.Client = &roleCredentialsClient{client: client}
+	}))
+
+	if a.AWSRoleARN == "" {
+		return aws.NewCredentialsCache(chain)
+	}
+
+	logger.Infof("assuming role %s for the AWS API", a.AWSRoleARN)
+	cfg.Credentials = aws.NewCredentialsCache(chain)
+	role := &credentialChain{logger: logger}
+	role.add("role "+a.AWSRoleARN, stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), a.AWSRoleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = fmt.Sprintf("ec2-metadatafs-%d", time.Now().UnixNano())
+		if a.AWSExternalID != "" {
+			o.ExternalID = aws.String(a.AWSExternalID)
+		}
+	}))
+	return aws.NewCredentialsCache(role)
+}
+
+// credentialChain retrieves credentials from the first of its providers that
+// has them, logging which one supplied them
+type credentialChain struct {
+	names     []string
+	providers []aws.CredentialsProvider
+	logger    *logging.Logger
+}
+
+func (c *credentialChain) add(name string, provider aws.CredentialsProvider) {
+	c.names = append(c.names, name)
+	c.providers = append(c.providers, provider)
 }
 
-func (a *awsCredentials) credentialChain() *credentials.Credentials {
-	return credentials.NewChainCredentials([]credentials.Provider{
-		&credentials.StaticProvider{
-			Value: credentials.Value{
-				AccessKeyID:     a.AWSAccessKeyID,
-				SecretAccessKey: a.AWSSecretAccessKey,
-				SessionToken:    a.AWSSessionToken,
-			},
-		},
-		&credentials.EnvProvider{},
-		&credentials.SharedCredentialsProvider{},
-		&ec2rolecreds.EC2RoleProvider{Client: ec2metadata.New(session.New())},
+func (c *credentialChain) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	errs := []string{}
+	for i, provider := range c.providers {
+		creds, err := provider.Retrieve(ctx)
+		if err == nil {
+			c.logger.Infof("using AWS credentials from %s", c.names[i])
+			return creds, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", c.names[i], err))
+	}
+
+	err := fmt.Errorf("no AWS credentials found (%s)", strings.Join(errs, "; "))
+	c.logger.Errorf("failed to retrieve AWS credentials: %s", err)
+	return aws.Credentials{}, err
+}
+
+// envCredentials reads credentials from $AWS_ACCESS_KEY_ID,
+// $AWS_SECRET_ACCESS_KEY and $AWS_SESSION_TOKEN
+func envCredentials(ctx context.Context) (aws.Credentials, error) {
+	env, err := config.NewEnvConfig()
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	if !env.Credentials.HasKeys() {
+		return aws.Credentials{}, fmt.Errorf("$AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY are not set")
+	}
+	return env.Credentials, nil
+}
+
+// sharedCredentials reads credentials for profile, or $AWS_PROFILE, from the
+// shared credentials file
+func sharedCredentials(profile string) aws.CredentialsProvider {
+	return aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		env, err := config.NewEnvConfig()
+		if err != nil {
+			return aws.Credentials{}, err
+		}
+
+		if profile == "" {
+			profile = env.SharedConfigProfile
+		}
+		if profile == "" {
+			profile = config.DefaultSharedConfigProfile
+		}
+
+		shared, err := config.LoadSharedConfigProfile(ctx, profile, func(o *config.LoadSharedConfigOptions) {
+			if env.SharedCredentialsFile != "" {
+				o.CredentialsFiles = []string{env.SharedCredentialsFile}
+			}
+			if env.SharedConfigFile != "" {
+				o.ConfigFiles = []string{env.SharedConfigFile}
+			}
+		})
+		if err != nil {
+			return aws.Credentials{}, err
+		}
+		if !shared.Credentials.HasKeys() {
+			return aws.Credentials{}, fmt.Errorf("profile %s has no credentials", profile)
+		}
+		return shared.Credentials, nil
 	})
 }
 
+// roleCredentialsClient reads the instance role credentials through our own
+// metadata client, so that the IMDS version and endpoint options apply
+type roleCredentialsClient struct {
+	client metadatafs.MetadataClient
+}
+
+func (c *roleCredentialsClient) GetMetadata(ctx context.Context, input *imds.GetMetadataInput, optFns ...func(*imds.Options)) (*imds.GetMetadataOutput, error) {
+	resp, err := c.client.Get("meta-data/" + strings.TrimPrefix(input.Path, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected HTTP status code from AWS metadata API for %s: %d", input.Path, resp.StatusCode)
+	}
+	return &imds.GetMetadataOutput{Content: resp.Body}, nil
+}
+
 // mountOptions implements flags.Marshaller and flags.Unmarshaller interface to
 // read `mount` style options from the user
 type mountOptions struct {
@@ -189,31 +381,248 @@ func (o *mountOptions) ExtractOption(s string) (ok bool, value string) {
 }
 
 // mountTags mounts another endpoint onto the FUSE FS at tags/ exposing the EC2
-// instance tags as files
-func mountTags(nfs *pathfs.PathNodeFs, options *Options, logger *logging.Logger) {
-	svc := ec2metadata.New(session.New(), &aws.Config{Endpoint: aws.String(options.MetadataServiceEndpoint)})
-	instanceID, err := svc.GetMetadata("instance-id")
-	if err != nil {
-		logger.Fatalf("failed to query instance id to initialize tags mount: %v\n", err)
+// instance tags as files, and returns the filesystem so that templates can
+// look tags up
+func mountTags(nfs *pathfs.PathNodeFs, client metadatafs.MetadataClient, awsConfig func() aws.Config, events *eventstream.Stream, options *Options, logger *logging.Logger) *tagsfs.TagsFs {
+	source := options.TagsSource
+	if source == "auto" {
+		available, err := tagsfs.IMDSTagsAvailable(client)
+		switch {
+		case err != nil:
+			logger.Warningf("failed to check for instance metadata tags, falling back to the AWS API: %v", err)
+			source = "api"
+		case available:
+			source = "imds"
+		default:
+			logger.Infof("instance metadata tags are not enabled, falling back to the AWS API")
+			source = "api"
+		}
 	}
-	region, err := svc.Region()
-	if err != nil {
-		logger.Fatalf("failed to query instance region to initialize tags mount: %v\n", err)
+
+	if options.TagsFile != "" {
+		source = "file"
 	}
 
-	sess := session.New(&aws.Config{
-		Region:      aws.String(region),
-		Credentials: options.AWSCredentials.credentialChain(),
-	})
+	var ts tagsfs.TagSource
+	switch source {
+	case "imds":
+		logger.Debugf("reading tags from the instance metadata service")
+		ts = tagsfs.NewIMDSSource(client, logger)
+		if options.TagsWritable {
+			logger.Warningf("tags read from the instance metadata service are read-only, ignoring tags_writable")
+		}
+	case "api":
+		logger.Debugf("reading tags from the AWS API")
+		ts = apiTagSource(client, awsConfig, options, logger)
+	case "file":
+		logger.Debugf("reading tags from %s", options.TagsFile)
+		ts = tagsfs.NewFileSource(options.TagsFile, logger)
+		if options.TagsWritable {
+			logger.Warningf("tags read from a file are read-only, ignoring tags_writable")
+		}
+	default:
+		logger.Fatalf("unknown tags source %s", source)
+	}
+
+	tfs := tagsfs.NewFromSource(ts, logger)
+	tfs.Writable = options.TagsWritable
+	tfs.NestedKeys = options.TagsNested
+	if len(options.TagsInclude) > 0 || len(options.TagsExclude) > 0 || options.TagsStripPrefix != "" {
+		filter, err := tagsfs.NewKeyFilter(options.TagsInclude, options.TagsExclude, options.TagsStripPrefix)
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+		tfs.Filter = filter
+	}
+	tfs.OnChange = func(name string, old, new []byte) {
+		logger.Infof("tag %s changed", name)
+		events.Publish(eventstream.NewRecord(path.Join("tags", name), old, new, time.Now()))
+	}
+
+	var fs pathfs.FileSystem = tfs
+	if options.TagsRelated {
+		if ec2Source, ok := ts.(*tagsfs.EC2Source); ok {
+			fs = tagsfs.NewRelated(tfs, ec2Source, client, logger)
+		} else {
+			logger.Warningf("tags of related resources are only available from the AWS API, ignoring tags_related")
+		}
+	}
 
 	status := nfs.Mount(
 		"tags",
-		pathfs.NewPathNodeFs(tagsfs.New(ec2.New(sess), instanceID, logger), nil).Root(), nil)
+		pathfs.NewPathNodeFs(fs, nil).Root(), nil)
 	if status != fuse.OK {
 		logger.Fatalf("tags mount fail: %v\n", status)
 	}
+	return tfs
+}
+
+// apiTagSource returns a TagSource reading the instance tags from the AWS API
+func apiTagSource(client metadatafs.MetadataClient, awsConfig func() aws.Config, options *Options, logger *logging.Logger) *tagsfs.EC2Source {
+	instanceID, err := metadatafs.FetchValue(client, "meta-data/instance-id")
+	if err != nil || instanceID == nil {
+		logger.Fatalf("failed to query instance id to initialize tags mount: %v\n", err)
+	}
+
+	source := tagsfs.NewEC2Source(newEC2Client(awsConfig, options, logger), string(instanceID), logger)
+	source.RefreshInterval = options.TagsRefresh
+	return source
+}
+
+// newEC2Client returns a client of the configured EC2 API endpoint
+func newEC2Client(awsConfig func() aws.Config, options *Options, logger *logging.Logger) *ec2.Client {
+	return ec2.NewFromConfig(awsConfig(), func(o *ec2.Options) {
+		if options.EC2Endpoint != "" {
+			logger.Debugf("using EC2 API endpoint %s", options.EC2Endpoint)
+			o.BaseEndpoint = aws.String(options.EC2Endpoint)
+		}
+	})
+}
+
+// mountInstance mounts another endpoint onto the FUSE FS at instance/
+// exposing the instance as described by the EC2 API
+func mountInstance(nfs *pathfs.PathNodeFs, client metadatafs.MetadataClient, awsConfig func() aws.Config, options *Options, logger *logging.Logger) {
+	instanceID, err := metadatafs.FetchValue(client, "meta-data/instance-id")
+	if err != nil || instanceID == nil {
+		logger.Fatalf("failed to query instance id to initialize instance mount: %v\n", err)
+	}
+
+	ifs := instancefs.New(newEC2Client(awsConfig, options, logger), string(instanceID), logger)
+	ifs.RefreshInterval = options.InstanceRefresh
+
+	status := nfs.Mount(
+		"instance",
+		pathfs.NewPathNodeFs(ifs, nil).Root(), nil)
+	if status != fuse.OK {
+		logger.Fatalf("instance mount fail: %v\n", status)
+	}
+}
+
+// mountAutoScaling mounts another endpoint onto the FUSE FS at autoscaling/
+// exposing the instance's Auto Scaling group
+func mountAutoScaling(nfs *pathfs.PathNodeFs, client metadatafs.MetadataClient, awsConfig func() aws.Config, options *Options, logger *logging.Logger) {
+	instanceID, err := metadatafs.FetchValue(client, "meta-data/instance-id")
+	if err != nil || instanceID == nil {
+		logger.Fatalf("failed to query instance id to initialize autoscaling mount: %v\n", err)
+	}
+
+	svc := autoscaling.NewFromConfig(awsConfig())
+
+	afs := autoscalingfs.New(svc, string(instanceID), logger)
+	afs.RefreshInterval = options.AutoScalingRefresh
+
+	status := nfs.Mount(
+		"autoscaling",
+		pathfs.NewPathNodeFs(afs, nil).Root(), nil)
+	if status != fuse.OK {
+		logger.Fatalf("autoscaling mount fail: %v\n", status)
+	}
+}
+
+// mountSSM mounts another endpoint onto the FUSE FS at ssm/ exposing the SSM
+// parameters beneath the configured path
+func mountSSM(nfs *pathfs.PathNodeFs, awsConfig func() aws.Config, options *Options, logger *logging.Logger) {
+	svc := ssm.NewFromConfig(awsConfig())
+
+	sfs := ssmfs.New(svc, options.SSMPath, logger)
+	sfs.RefreshInterval = options.SSMRefresh
+
+	status := nfs.Mount(
+		"ssm",
+		pathfs.NewPathNodeFs(sfs, nil).Root(), nil)
+	if status != fuse.OK {
+		logger.Fatalf("ssm mount fail: %v\n", status)
+	}
+}
+
+// mountSecrets mounts another endpoint onto the FUSE FS at secrets/ exposing
+// the allowlisted Secrets Manager secrets
+func mountSecrets(nfs *pathfs.PathNodeFs, awsConfig func() aws.Config, options *Options, logger *logging.Logger) {
+	svc := secretsmanager.NewFromConfig(awsConfig())
+
+	sfs := secretsfs.New(svc, options.Secrets, logger)
+	sfs.RefreshInterval = options.SecretsRefresh
+
+	status := nfs.Mount(
+		"secrets",
+		pathfs.NewPathNodeFs(sfs, nil).Root(), nil)
+	if status != fuse.OK {
+		logger.Fatalf("secrets mount fail: %v\n", status)
+	}
 }
 
+// loadAWSConfig loads the configuration shared by the AWS API clients: the
+// region, the FIPS setting, the CA bundle and the credential chain
+func loadAWSConfig(client metadatafs.MetadataClient, options *Options, logger *logging.Logger) aws.Config {
+	region := options.Region
+	if region == "" {
+		value, err := metadatafs.FetchValue(client, "meta-data/placement/region")
+		if err != nil || value == nil {
+			logger.Fatalf("failed to query instance region to initialize AWS API client: %v\n", err)
+		}
+		region = string(value)
+	}
+
+	loadOptions := []func(*config.LoadOptions) error{
+		config.WithRegion(region),
+		config.WithRetryer(func() aws.Retryer { return retry.NewStandard() }),
+	}
+	if options.FIPS {
+		loadOptions = append(loadOptions, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+	if options.CABundle != "" {
+		pool, err := caBundlePool(options.CABundle)
+		if err != nil {
+			logger.Fatalf("failed to load CA bundle: %v\n", err)
+		}
+		httpClient := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			if tr.TLSClientConfig == nil {
+				tr.TLSClientConfig = &tls.Config{}
+			}
+			tr.TLSClientConfig.RootCAs = pool
+		})
+		loadOptions = append(loadOptions, config.WithHTTPClient(httpClient))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background(), loadOptions...)
+	if err != nil {
+		logger.Fatalf("failed to load AWS configuration: %v\n", err)
+	}
+	cfg.Credentials = options.AWSCredentials.credentialChain(client, cfg, logger)
+	return cfg
+}
+
+// caBundlePool returns the system's trusted CA certificates along with those
+// of the PEM file. config.WithCustomCABundle would trust the file's alone,
+// breaking every endpoint with a public certificate.
+func caBundlePool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+const (
+	// eventsFile is the name of the event stream file at the mount root
+	eventsFile = ".events"
+
+	// eventsRetained is how many bytes of recent records new readers of
+	// the event stream get
+	eventsRetained = 1 << 20
+
+	// waitDir is where the blocking view of the metadata is mounted
+	waitDir = ".wait"
+)
+
 func prepareServer(options *Options, logger *logging.Logger) *fuse.Server {
 	var fs pathfs.FileSystem
 
@@ -228,21 +637,52 @@ func prepareServer(options *Options, logger *logging.Logger) *fuse.Server {
 		fmt.Printf("unknown --instance-medatata-service-version %s", options.MetadataServiceVersion)
 		os.Exit(1)
 	}
-	fs = metadatafs.New(client, logger)
+	mfs := metadatafs.New(client, logger)
+	mfs.SnapshotSensitive = options.SnapshotSensitive
+	for _, mapping := range options.Env {
+		variable, err := metadatafs.ParseEnvVariable(mapping)
+		if err != nil {
+			logger.Fatalf("invalid env: %s", err)
+		}
+		mfs.EnvVariables = append(mfs.EnvVariables, variable)
+	}
+	mfs.TemplatesDir = options.TemplatesDir
+	fs = mfs
+	var cache cachingfs.FileSystem
+	var ttl time.Duration
 	switch {
 	case options.CacheSec == 0:
 		logger.Debugf("caching disabled")
 	case options.CacheSec <= 0:
 		logger.Debugf("indefinite caching enabled")
-		fs = cachingfs.New(fs, time.Duration(-1)*time.Second)
+		ttl = time.Duration(-1) * time.Second
+		cache = cachingfs.New(fs, ttl)
+		fs = cache
 	default:
 		logger.Debugf("caching enabled (%d seconds)", options.CacheSec)
-		fs = cachingfs.New(fs, time.Duration(options.CacheSec)*time.Second)
+		ttl = time.Duration(options.CacheSec) * time.Second
+		cache = cachingfs.New(fs, ttl)
+		fs = cache
 	}
 
+	mfs.TemplateTTL = ttl
+
+	// the kernel's entry and attribute caches follow the same policy so that
+	// repeated lookups don't need to reach us at all
+	kernelOptions := cachingfs.KernelOptions(ttl)
+	logger.Debugf("kernel entry timeout %s, attribute timeout %s, negative timeout %s",
+		kernelOptions.EntryTimeout, kernelOptions.AttrTimeout, kernelOptions.NegativeTimeout)
+
 	nfs := pathfs.NewPathNodeFs(fs, nil)
+	conn := nodefs.NewFileSystemConnector(nfs.Root(), kernelOptions)
+
+	// changes seen to watched paths and tags can be followed by reading the
+	// hidden event stream file
+	events := eventstream.New(eventsRetained)
+	nfs.Root().Inode().NewChild(eventsFile, false, events.Node(logger))
+
 	server, err := fuse.NewServer(
-		nodefs.NewFileSystemConnector(nfs.Root(), nil).RawFS(),
+		conn.RawFS(),
 		options.Args.Mountpoint,
 		&fuse.MountOptions{Options: options.MountOptions.opts})
 	if err != nil {
@@ -251,15 +691,74 @@ func prepareServer(options *Options, logger *logging.Logger) *fuse.Server {
 
 	server.SetDebug(len(options.Verbose) >= moreVerbose)
 
+	if len(options.Watch) > 0 {
+		watchChanges(server, mfs, cache, events, client, options, logger)
+	}
+
+	// files under .wait block until the path appears or changes
+	go func() {
+		server.WaitMount()
+		waitFs := metadatafs.NewWaitFs(mfs, options.WatchInterval, options.WaitTimeout, logger)
+		status := nfs.Mount(waitDir, pathfs.NewPathNodeFs(waitFs, nil).Root(), cachingfs.KernelOptions(0))
+		if status != fuse.OK {
+			logger.Errorf("%s mount fail: %v", waitDir, status)
+		}
+	}()
+
+	if len(options.Hooks) > 0 {
+		runHooks(client, options, logger)
+	}
+
+	// the AWS API clients share their configuration and credentials
+	awsConfig := sync.OnceValue(func() aws.Config {
+		return loadAWSConfig(client, options, logger)
+	})
+
 	if options.Tags {
 		go func() {
 			server.WaitMount()
 			logger.Debugf("mounting tags")
-			mountTags(nfs, options, logger)
+			mfs.SetTags(mountTags(nfs, client, awsConfig, events, options, logger))
 			logger.Debugf("tags mounted")
 		}()
 	}
 
+	if options.Instance {
+		go func() {
+			server.WaitMount()
+			logger.Debugf("mounting instance")
+			mountInstance(nfs, client, awsConfig, options, logger)
+			logger.Debugf("instance mounted")
+		}()
+	}
+
+	if options.AutoScaling {
+		go func() {
+			server.WaitMount()
+			logger.Debugf("mounting autoscaling")
+			mountAutoScaling(nfs, client, awsConfig, options, logger)
+			logger.Debugf("autoscaling mounted")
+		}()
+	}
+
+	if options.SSMPath != "" {
+		go func() {
+			server.WaitMount()
+			logger.Debugf("mounting ssm")
+			mountSSM(nfs, awsConfig, options, logger)
+			logger.Debugf("ssm mounted")
+		}()
+	}
+
+	if len(options.Secrets) > 0 {
+		go func() {
+			server.WaitMount()
+			logger.Debugf("mounting secrets")
+			mountSecrets(nfs, awsConfig, options, logger)
+			logger.Debugf("secrets mounted")
+		}()
+	}
+
 	// Unmount when the process exits
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
@@ -272,9 +771,75 @@ func prepareServer(options *Options, logger *logging.Logger) *fuse.Server {
 		os.Exit(1)
 	}()
 
+	// Drop all cached metadata when the process is sent SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if cache == nil {
+				logger.Infof("received SIGHUP, but caching is disabled")
+				continue
+			}
+			logger.Infof("received SIGHUP, invalidating cache")
+			cache.InvalidateTree("")
+		}
+	}()
+
 	return server
 }
 
+// watchChanges polls the watched paths once mounted, telling the kernel, the
+// cache and any inotify watchers about changes
+func watchChanges(server *fuse.Server, mfs *metadatafs.MetadataFs, cache cachingfs.FileSystem, events *eventstream.Stream, client metadatafs.MetadataClient, options *Options, logger *logging.Logger) {
+	// changes are replayed through the mount, which needs an absolute path
+	// as the daemon changes its working directory
+	mountpoint, err := filepath.Abs(options.Args.Mountpoint)
+	if err != nil {
+		logger.Fatalf("could not resolve mount point: %s", err)
+	}
+	mfs.Mountpoint = mountpoint
+
+	mfs.Watcher = metadatafs.NewWatcher(client, options.Watch, options.WatchInterval, logger)
+	mfs.Watcher.Subscribe(func(c metadatafs.Change) {
+		logger.Infof("watched path %s changed", c.Path)
+		events.Publish(eventstream.NewRecord(c.Path, c.Old, c.New, c.Time))
+		mfs.Notify(c)
+		if cache != nil {
+			dir := path.Dir(c.Path)
+			if dir == "." {
+				dir = ""
+			}
+			cache.Invalidate(c.Path)
+			cache.Invalidate(dir)
+		}
+	})
+
+	go func() {
+		server.WaitMount()
+		logger.Debugf("watching %v for changes every %s", options.Watch, options.WatchInterval)
+		mfs.Watcher.Run(nil)
+	}()
+}
+
+// runHooks starts running the configured hook commands for metadata events
+func runHooks(client metadatafs.MetadataClient, options *Options, logger *logging.Logger) {
+	commands := map[string]string{}
+	for _, hook := range options.Hooks {
+		parts := strings.SplitN(hook, "=", 2)
+		if len(parts) != 2 {
+			logger.Fatalf("invalid hook %q, expected TYPE=COMMAND", hook)
+		}
+		commands[parts[0]] = parts[1]
+	}
+
+	runner, err := hooks.New(client, commands, options.WatchInterval, options.HookTimeout, options.HookState, logger)
+	if err != nil {
+		logger.Fatalf("could not set up hooks: %s", err)
+	}
+
+	go runner.Run(nil)
+}
+
 // signal the parent of our process that we started successfully so it can exit
 func sigalParent(logger *logging.Logger) {
 	pid, err := strconv.Atoi(os.Getenv("EC2_METADATAFS_NOTIFY"))
@@ -346,26 +911,70 @@ Mount options:
   -o instance_metadata_service_version=VERSION    Instance Metadata Service version, v1 or v2, same as --instance-metadata-service-version=
   -o instance_metadata_service_token_ttl=TTL      Instance Metadata Service token TTL, only valid with service_version=v2, same as --instance-metadata-service-token-ttl=
   -o tags                                          Mount the instance tags at <mount point>/tags, same as --tags
+  -o tags_writable                                Allow tags to be created, updated and deleted (see below), same as --tags-writable
+  -o tags_source=SOURCE                           Where to read tags from, imds, api or auto (see below), same as --tags-source=
+  -o tags_file=PATH                               Read tags from a JSON file instead (see below), same as --tags-file=
+  -o tags_refresh=DURATION                        How long tags read from the AWS API are served before being fetched again, same as --tags-refresh=
+  -o tags_nested                                  Show tag keys containing / as nested directories (see below), same as --tags-nested
+  -o tags_related                                 Also show the tags of related resources (see below), same as --tags-related
+  -o tags_include=GLOB                            Only show tags whose keys match GLOB (see below), same as --tags-include=
+  -o tags_exclude=GLOB                            Hide tags whose keys match GLOB (see below), same as --tags-exclude=
+  -o tags_strip_prefix=PREFIX                     Show tag keys starting with PREFIX without it (see below), same as --tags-strip-prefix=
+  -o instance                                     Mount the instance as described by the EC2 API at <mount point>/instance (see below), same as --instance
+  -o instance_refresh=DURATION                    How long the instance is served before being described again, same as --instance-refresh=
+  -o autoscaling                                  Mount the instance's Auto Scaling group at <mount point>/autoscaling (see below), same as --autoscaling
+  -o autoscaling_refresh=DURATION                 How long the Auto Scaling group is served before being described again, same as --autoscaling-refresh=
+  -o ssm_path=PATH                                Mount the SSM parameters beneath PATH at <mount point>/ssm (see below), same as --ssm-path=
+  -o ssm_refresh=DURATION                         How long SSM parameters are served before being fetched again, same as --ssm-refresh=
+  -o secret=SECRET                                Mount the Secrets Manager secret SECRET, by name or ARN, under <mount point>/secrets (see below), can be repeated, same as --secret=
+  -o secrets_refresh=DURATION                     How long secrets are served before being described again, same as --secrets-refresh=
+  -o ec2_endpoint=URL                             EC2 API endpoint used for tags and the instance (see below), same as --ec2-endpoint=
+  -o region=REGION                                AWS region of the AWS APIs (see below), same as --region=
+  -o fips                                         Use the FIPS endpoints of the AWS APIs (see below), same as --fips
+  -o ca_bundle=FILE                               PEM file of CA certificates to trust for the AWS APIs (see below), same as --ca-bundle=
   -o aws_access_key_id=ID                         AWS API access key (see below), same as --aws-access-key-id=
   -o aws_secret_access_key=KEY                    AWS API secret key (see below), same as --aws-secret-access-key=
   -o aws_session_token=KEY                        AWS API session token (see below), same as --aws-session-token=
+  -o aws_profile=PROFILE                          Profile of the shared credentials file (see below), same as --aws-profile=
+  -o aws_role_arn=ARN                             IAM role to assume (see below), same as --aws-role-arn=
+  -o aws_external_id=ID                           External ID to pass when assuming the role, same as --aws-external-id=
   -o cachesec=SEC                                 Number of seconds to cache files attributes and directory listings, same as --cachesec
+  -o watch=PATH                                   Poll the metadata path for changes and notify inotify watchers, can be repeated, same as --watch=
+  -o watch_interval=DURATION                      How often to poll watched paths and hook events for changes, same as --watch-interval=
+  -o hook=TYPE=COMMAND                            Run a command for every distinct event of a type (see below), can be repeated, no commas, same as --hook=
+  -o hook_timeout=DURATION                        How long a hook command may run before being killed, same as --hook-timeout=
+  -o hook_state=FILE                              File recording delivered events, same as --hook-state=
+  -o wait_timeout=DURATION                        How long opening a file under .wait blocks before failing, same as --wait-timeout=
+  -o snapshot_sensitive                           Include sensitive paths in .snapshot.json (see below), same as --snapshot-sensitive
+  -o env=NAME=PATH                                Also set a variable in .env (see below), can be repeated, same as --env=
+  -o templates_dir=DIR                            Render the templates in DIR at the root (see below), same as --templates-dir=
   -o syslog_facility=                             Syslog facility to send messages upon when daemonized (see below)
   -o no_syslog                                    Disable logging to syslog when daemonized
   -o FUSEOPTION=OPTIONVALUE                       FUSE mount option, please see the OPTIONS section of your FUSE manual for valid options
 
 AWS credential chain:
-  AWS credentials only required when mounting the instance tags (--tags or -o tags).
+  AWS credentials are only required when mounting tags from the AWS API (--tags),
+  the instance (--instance), the Auto Scaling group (--autoscaling), SSM
+  parameters (--ssm-path) or secrets (--secret).
 
   Checks for credentials in the following places, in order:
 
   - Provided AWS credentials via flags or mount options
   - $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY, and $AWS_SESSION_TOKEN environment variables
-  - Shared credentials file -- respects $AWS_DEFAULT_PROFILE and $AWS_SHARED_CREDENTIALS_FILE
-  - IAM role associated with the instance
+  - Shared credentials file -- uses the --aws-profile profile, else respects
+    $AWS_PROFILE, and respects $AWS_SHARED_CREDENTIALS_FILE
+  - Web identity token -- when $AWS_WEB_IDENTITY_TOKEN_FILE and $AWS_ROLE_ARN
+    are set, as in EKS pods with IAM roles for service accounts
+  - IAM role associated with the instance, read through the Instance Metadata
+    Service with the configured IMDS version and endpoint
 
   Note that the AWS session token is only needed for temporary credentials from AWS security token service.
 
+  With --aws-role-arn, the credentials found are used to assume that role,
+  passing --aws-external-id if set, e.g. to read the tags of an instance with
+  a role of another account. The provider that supplied the credentials is
+  logged whenever they are retrieved.
+
 Instance Metadata Service (IMDS) Version:
 
 AWS has two modes for interacting with the metadata API:
@@ -384,12 +993,306 @@ Caching of the following is supported and controlled via the cachesec parameter:
 * File attributes
 * Directory attributes
 * Directory listings
+* Rendered templates (see Templates)
 
 When accessed this metadata will be cached for the number of seconds specified
 by cachesec. Use 0, the default, to disable caching and -1 to cache
 indefinitely (good if you never expect instance metadata to change). This cache
 is kept in memory and lost when the process is restarted.
 
+The kernel's entry and attribute caches use the same timeout, so repeated stat
+calls are answered without reaching ec2-metadatafs at all. Lookups of paths
+that do not exist are never cached. When a refreshed value is found to have
+changed, the kernel is told to drop what it has cached for it.
+
+When caching is enabled, cached entries can be dropped without remounting by
+writing paths to the hidden <mount point>/.control/invalidate file, one per
+line. A trailing slash also drops everything beneath the path and / drops
+everything. Only the user running ec2-metadatafs and root can write it. Sending
+the process SIGHUP drops everything as well.
+
+  $ echo meta-data/network/ > /var/run/aws/.control/invalidate
+
+Watching for changes:
+
+FUSE filesystems cannot learn about changes made to the metadata on their own,
+so inotify watchers on the mount would never be woken up. Paths given with
+--watch are polled every --watch-interval and, when one appears, changes or
+disappears, the kernel caches are dropped and inotify watchers see IN_CREATE,
+IN_MODIFY or IN_DELETE for it, as if the file had been changed locally.
+Watched directories, like meta-data/events/maintenance/scheduled, are touched
+when they change instead, so watchers of the directory see IN_ATTRIB.
+
+  $ ec2-metadatafs --watch meta-data/spot/instance-action /var/run/aws
+  $ inotifywait /var/run/aws/meta-data/spot/
+
+Every change seen to a watched path, or to a tag when it is read or, with
+tags from the AWS API, refreshed, is also written as a line of JSON with path,
+old, new and timestamp (old and new are null when the path is missing) to the
+hidden <mount point>/.events file.
+Reading it returns the recent records and then blocks, like a pipe, until new
+ones arrive. Every reader follows the stream at its own pace; readers falling
+too far behind skip the records they missed.
+
+  $ tail -f /var/run/aws/.events
+
+Waiting for changes:
+
+Files under the hidden <mount point>/.wait directory mirror the metadata, but
+opening one whose path does not exist yet blocks until it appears, and then
+returns its content. A path that already exists is returned at once. Listing a
+directory under .wait blocks until its entries change. The metadata service is
+polled every --watch-interval while waiting. Opening fails with ETIMEDOUT after
+--wait-timeout, and with O_NONBLOCK fails with EAGAIN instead of waiting.
+
+poll() and select() are not implemented: go-fuse answers FUSE poll requests
+itself, so they report the files as ready immediately. Event loops can wait on
+a pipe from a child process reading the file instead.
+
+  $ cat /var/run/aws/.wait/meta-data/spot/instance-action
+
+Snapshot:
+
+The hidden <mount point>/.snapshot.json file holds the whole metadata tree as
+a single JSON object, with an object per directory and a string per file. It
+is generated when opened by walking the tree with several concurrent requests,
+so every reader gets one consistent document. Paths that hold credentials or
+often secrets are left out unless --snapshot-sensitive is given: user-data,
+meta-data/iam/security-credentials, meta-data/identity-credentials and the
+signatures in dynamic/instance-identity.
+
+  $ cp /var/run/aws/.snapshot.json support-bundle/metadata.json
+
+Environment file:
+
+The hidden <mount point>/.env file sets well-known variables, one per line and
+quoted so that it can be sourced by a shell: INSTANCE_ID, INSTANCE_TYPE,
+AMI_ID, ACCOUNT_ID, REGION, AZ, ARCHITECTURE and PRIVATE_IP, from the instance
+identity document where it has them, and AZ_ID, PUBLIC_IP, LOCAL_HOSTNAME,
+PUBLIC_HOSTNAME and MAC. --env NAME=PATH sets another variable to the value of a
+metadata path, or replaces a well-known one. Variables whose value does not
+exist, such as PUBLIC_IP for instances without a public address, are left out.
+The file is generated when opened.
+
+  $ ec2-metadatafs --env VPC_ID=meta-data/network/interfaces/macs/0e:49:61:0f:c3:11/vpc-id /var/run/aws
+  $ . /var/run/aws/.env && echo "$INSTANCE_ID in $AZ"
+
+Templates:
+
+Every file of --templates-dir is a Go text/template shown at the root of the
+mount under its name, less any .tmpl extension, and rendered when it is
+opened. With cachesec, the output is kept for as long as attributes are (see
+Caching), but a template is rendered again as soon as its file is modified, so
+that edits take effect without remounting. Hidden files, directories and
+templates named like an entry of the root are skipped. Along with the standard
+functions, templates can call:
+
+* meta "PATH": the value of a metadata path
+* tag "KEY": the value of an instance tag, with --tags
+* json "PATH": the value of a metadata path parsed as JSON
+
+Values that do not exist are empty, or nil for json, so that they can be
+tested with if or with. Errors in a template, or in reading the values it
+uses, fail the open with EIO and are logged.
+
+  $ cat /etc/ec2-metadatafs/templates/labels.tmpl
+  instance="{{meta "meta-data/instance-id"}}",name="{{tag "Name"}}"
+  region="{{(json "dynamic/instance-identity/document").region}}"
+  $ ec2-metadatafs --tags --templates-dir /etc/ec2-metadatafs/templates /var/run/aws
+  $ cat /var/run/aws/labels
+
+Hooks:
+
+Commands can be run whenever the metadata service announces an event. The
+paths of the configured event types are polled every --watch-interval and the
+command is run once for every distinct event with /bin/sh -c, with the event
+payload on stdin. Event types:
+
+* spot-interruption: meta-data/spot/instance-action
+* rebalance: meta-data/events/recommendations/rebalance
+* maintenance: meta-data/events/maintenance/scheduled, once per EventId
+* lifecycle-state: meta-data/autoscaling/target-lifecycle-state
+
+The event is described by EC2_METADATAFS_EVENT_TYPE, EC2_METADATAFS_EVENT_ID,
+EC2_METADATAFS_EVENT_PATH and EC2_METADATAFS_EVENT_PAYLOAD, along with every
+top-level field of a JSON payload, e.g. EC2_METADATAFS_EVENT_ACTION for spot
+interruptions. Commands are killed after --hook-timeout. Delivered events are
+remembered in memory, or in --hook-state to survive restarts, until they are
+no longer announced, so returning to a lifecycle state runs the command again.
+Mount options are separated by commas, so commands containing a comma must be
+given with --hook rather than -o hook=.
+
+  $ ec2-metadatafs --hook 'spot-interruption=/usr/local/bin/drain' --hook-state /var/lib/ec2-metadatafs/hooks.json /var/run/aws
+
+Tags source:
+
+Tags are read with the EC2 DescribeTags API by default, which requires AWS
+credentials (see above). All of the instance's tags are fetched at once and
+served for --tags-refresh before being fetched again. When the API throttles
+requests, the previously fetched tags keep being served and fetches back off.
+When instance metadata tags are enabled for the instance, --tags-source=imds
+reads them from meta-data/tags/instance/ through the Instance Metadata Service
+instead, using the configured IMDS version and needing no credentials. These
+tags are read-only. --tags-source=auto uses the Instance Metadata Service when
+it serves the tags and the AWS API otherwise.
+
+  $ ec2-metadatafs --tags --tags-source=auto /var/run/aws
+
+With --tags-file, tags are read from a JSON file holding an object of tag keys
+to values, e.g. {"Name": "web-1"}, instead. The file is read again on every
+access and its tags are read-only.
+
+  $ ec2-metadatafs --tags --tags-file=/etc/ec2-metadatafs/tags.json /var/run/aws
+
+Tag keys:
+
+Tag keys can contain characters that are not allowed in file names, so they
+are escaped: %% is shown as %%25 and / as %%2F, and the keys . and .. are shown
+as %%2E and %%2E%%2E. Only the escaped name of a key finds it, so writing to
+tags/team%%2Fowner sets the tag team/owner. With --tags-nested, keys are
+instead split on / into directories, so the key team/owner is the file owner
+in the directory team. Keys that cannot be split, as they have empty, . or ..
+components, are still shown escaped, and a key that is also the directory of
+other keys is hidden. Keys whose names would be longer than 255 bytes are
+hidden as well.
+
+  $ cat /var/run/aws/tags/team%%2Fowner
+
+With --tags-include, only the tags whose keys match one of the given globs are
+shown, and --tags-exclude hides the tags whose keys match one of its globs. In
+globs, * matches any characters, including /, ? a single character and [...]
+one of a set of characters. Both can be given several times, and as mount
+options. Hidden tags do not exist as far as the mount is concerned: they cannot
+be read, and tags matching no include glob or an exclude glob cannot be
+created. With --tags-strip-prefix, keys starting with the prefix are shown
+without it, so app:env is shown as env. A tag named like a stripped key is
+hidden in its favor, and writing to a stripped key changes the tag with the
+prefix.
+
+  $ ec2-metadatafs --tags --tags-exclude='aws:*' --tags-strip-prefix=app: /var/run/aws
+
+tags/tags.json holds all of the tags shown as a single JSON object, and
+tags/tags.env a TAG_<KEY>='value' line per tag, quoted so that it can be
+sourced by a shell. Keys are upper-cased in tags.env, with characters other
+than letters, digits and _ replaced with _. Both files are generated from a
+single fetch of the tags when opened, so that they are consistent, and tags
+named like them are only shown within them.
+
+  $ . /var/run/aws/tags/tags.env && echo "$TAG_NAME"
+
+Related resources:
+
+With --tags-related, tags/ also holds the tags of the resources related to the
+instance, found through the Instance Metadata Service and DescribeInstances:
+
+* volumes/<volume id>/: the attached EBS volumes
+* network-interfaces/<interface id>/: the attached network interfaces
+* security-groups/<group id>/: the security groups of all network interfaces
+* subnet/ and vpc/: the subnet and VPC of the primary network interface
+
+The resources are looked up again every --tags-refresh. Instance tags named
+like these directories are hidden. Listing the volumes requires the
+ec2:DescribeInstances permission. The tags of these resources, which may be
+shared with other instances, are read-only even with --tags-writable.
+
+  $ cat /var/run/aws/tags/subnet/Name
+
+Writable tags:
+
+With --tags-writable, tags can be changed through <mount point>/tags. Writing
+a file sets the tag with CreateTags once the file is closed, so a whole write
+is a single API call, and a single trailing newline is dropped. Removing a
+file deletes the tag with DeleteTags and renaming one moves the value to the
+new key. AWS errors are mapped to errnos, e.g. EACCES when the credentials
+lack ec2:CreateTags or ec2:DeleteTags, EINVAL for invalid keys or values and
+ENOSPC when the instance has too many tags. Only the user running
+ec2-metadatafs and root can change tags, even with allow_other, and writes
+past the longest possible tag value fail with EFBIG.
+
+  $ echo web > /var/run/aws/tags/Role
+
+AWS API endpoints:
+
+The AWS APIs are called at their regional endpoints in the instance's region,
+found through the Instance Metadata Service. --region calls them in another
+region and --fips uses their FIPS endpoints. --ec2-endpoint sets any other
+endpoint of the EC2 API, used for tags and instance/, such as a VPC interface
+endpoint or a local EC2 emulator. --ca-bundle adds the CA certificates of a
+PEM file to those trusted for every AWS API, including STS when assuming a
+role, for endpoints with private certificates.
+
+  $ ec2-metadatafs --tags --ec2-endpoint=https://vpce-0123-abcd.ec2.us-east-1.vpce.amazonaws.com --ca-bundle=/etc/pki/private-ca.pem /var/run/aws
+
+Instance attributes:
+
+With --instance, instance/ holds the instance as returned by the EC2
+DescribeInstances API, described again every --instance-refresh, with a
+directory per object and list and a file per field, named as in the API.
+List items are named by their index, and missing fields are left out.
+DisableApiTermination, the termination protection, is added from
+DescribeInstanceAttribute. This needs the ec2:DescribeInstances and
+ec2:DescribeInstanceAttribute permissions.
+
+  $ cat /var/run/aws/instance/IamInstanceProfile/Arn
+  $ cat /var/run/aws/instance/SecurityGroups/0/GroupName
+
+Auto Scaling group:
+
+With --autoscaling, autoscaling/ holds the Auto Scaling group of the instance,
+described with the AWS API every --autoscaling-refresh using the same region,
+FIPS setting and credentials as tags:
+
+* group-name, desired-capacity, min-size, max-size: the group
+* lifecycle-state, health-status, protected-from-scale-in: the instance
+* launch-template-id, launch-template-name, launch-template-version or
+  launch-configuration-name: what the instance was launched from
+* lifecycle-hooks/<hook name>/: the transition, default-result and
+  heartbeat-timeout of each lifecycle hook, and two write-only files:
+  writing CONTINUE or ABANDON to complete completes the instance's pending
+  lifecycle action, and closing heartbeat after opening it for writing, e.g.
+  with touch, records a heartbeat
+
+The action is taken when the file is closed, which fails if the API call
+does. The files are owned by the user running ec2-metadatafs, and only that
+user and root can take actions, even with allow_other. autoscaling/ is empty
+if the instance is not in a group.
+
+  $ touch /var/run/aws/autoscaling/lifecycle-hooks/drain/heartbeat
+  $ echo CONTINUE > /var/run/aws/autoscaling/lifecycle-hooks/drain/complete
+
+SSM parameters:
+
+With --ssm-path, ssm/ holds the SSM Parameter Store parameters beneath the
+path, fetched with GetParametersByPath every --ssm-refresh using the same
+region, FIPS setting and credentials as tags. Parameter names are split on /
+into directories, relative to the path, and SecureString parameters are
+decrypted. A parameter that is also the directory of other parameters is
+hidden. As values may be secrets, files are mode 0400 and directories 0500,
+owned by the user running ec2-metadatafs, and only that user and root can
+read them, even with allow_other. This needs the ssm:GetParametersByPath
+permission, and kms:Decrypt for SecureString parameters.
+
+  $ ec2-metadatafs --ssm-path=/app/prod /var/run/aws
+  $ cat /var/run/aws/ssm/db/password
+
+Secrets Manager secrets:
+
+With --secret, secrets/ holds the given Secrets Manager secrets, each in a
+directory named by the secret's name or ARN as given, escaped like tag keys,
+e.g. secrets/prod%%2Fdb/ for prod/db. The directory holds the AWSCURRENT and
+AWSPREVIOUS versions of the secret as files and, when AWSCURRENT is a JSON
+object, keys/ with a file per field. The same region, FIPS setting and
+credentials as tags are used. Secrets are described every --secrets-refresh,
+and as soon as their next rotation is due, and versions are only fetched when
+they change. While a rotation is in progress, secrets are described every 10
+seconds until the new version is current. Like SSM parameters, secrets can
+only be read by the user running ec2-metadatafs and root. This needs the
+secretsmanager:DescribeSecret and secretsmanager:GetSecretValue permissions,
+and kms:Decrypt for secrets encrypted with customer managed keys.
+
+  $ ec2-metadatafs --secret=prod/db /var/run/aws
+  $ cat /var/run/aws/secrets/prod%%2Fdb/keys/password
+
 Valid syslog facilities:
   %s
 
@@ -456,6 +1359,18 @@ Report bugs to:
 		options.AWSCredentials.AWSSessionToken = value
 	}
 
+	if ok, value := options.MountOptions.ExtractOption("aws_profile"); ok {
+		options.AWSCredentials.AWSProfile = value
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("aws_role_arn"); ok {
+		options.AWSCredentials.AWSRoleARN = value
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("aws_external_id"); ok {
+		options.AWSCredentials.AWSExternalID = value
+	}
+
 	if ok, value := options.MountOptions.ExtractOption("cachesec"); ok {
 		options.CacheSec, err = strconv.Atoi(value)
 		if err != nil {
@@ -468,6 +1383,193 @@ Report bugs to:
 		options.Tags = true
 	}
 
+	if ok, _ := options.MountOptions.ExtractOption("tags_writable"); ok {
+		options.TagsWritable = true
+	}
+
+	if ok, _ := options.MountOptions.ExtractOption("tags_nested"); ok {
+		options.TagsNested = true
+	}
+
+	if ok, _ := options.MountOptions.ExtractOption("tags_related"); ok {
+		options.TagsRelated = true
+	}
+
+	for {
+		ok, value := options.MountOptions.ExtractOption("tags_include")
+		if !ok {
+			break
+		}
+		options.TagsInclude = append(options.TagsInclude, value)
+	}
+
+	for {
+		ok, value := options.MountOptions.ExtractOption("tags_exclude")
+		if !ok {
+			break
+		}
+		options.TagsExclude = append(options.TagsExclude, value)
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("tags_strip_prefix"); ok {
+		options.TagsStripPrefix = value
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("tags_refresh"); ok {
+		options.TagsRefresh, err = time.ParseDuration(value)
+		if err != nil {
+			fmt.Printf("error parsing tags_refresh as duration: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if ok, _ := options.MountOptions.ExtractOption("instance"); ok {
+		options.Instance = true
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("instance_refresh"); ok {
+		options.InstanceRefresh, err = time.ParseDuration(value)
+		if err != nil {
+			fmt.Printf("error parsing instance_refresh as duration: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if ok, _ := options.MountOptions.ExtractOption("autoscaling"); ok {
+		options.AutoScaling = true
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("autoscaling_refresh"); ok {
+		options.AutoScalingRefresh, err = time.ParseDuration(value)
+		if err != nil {
+			fmt.Printf("error parsing autoscaling_refresh as duration: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("ssm_path"); ok {
+		options.SSMPath = value
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("ssm_refresh"); ok {
+		options.SSMRefresh, err = time.ParseDuration(value)
+		if err != nil {
+			fmt.Printf("error parsing ssm_refresh as duration: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	for {
+		ok, value := options.MountOptions.ExtractOption("secret")
+		if !ok {
+			break
+		}
+		options.Secrets = append(options.Secrets, value)
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("secrets_refresh"); ok {
+		options.SecretsRefresh, err = time.ParseDuration(value)
+		if err != nil {
+			fmt.Printf("error parsing secrets_refresh as duration: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("tags_file"); ok {
+		options.TagsFile = value
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("ec2_endpoint"); ok {
+		options.EC2Endpoint = value
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("region"); ok {
+		options.Region = value
+	}
+
+	if ok, _ := options.MountOptions.ExtractOption("fips"); ok {
+		options.FIPS = true
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("ca_bundle"); ok {
+		options.CABundle = value
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("tags_source"); ok {
+		switch value {
+		case "imds", "api", "auto":
+			options.TagsSource = value
+		default:
+			fmt.Printf("unknown tags_source %s, expected imds, api or auto\n", value)
+			os.Exit(1)
+		}
+	}
+
+	for {
+		ok, value := options.MountOptions.ExtractOption("watch")
+		if !ok {
+			break
+		}
+		options.Watch = append(options.Watch, value)
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("watch_interval"); ok {
+		options.WatchInterval, err = time.ParseDuration(value)
+		if err != nil {
+			fmt.Printf("error parsing watch_interval as duration: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if options.WatchInterval <= 0 {
+		fmt.Printf("watch interval must be positive, got %s\n", options.WatchInterval)
+		os.Exit(1)
+	}
+
+	for {
+		ok, value := options.MountOptions.ExtractOption("hook")
+		if !ok {
+			break
+		}
+		options.Hooks = append(options.Hooks, value)
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("hook_timeout"); ok {
+		options.HookTimeout, err = time.ParseDuration(value)
+		if err != nil {
+			fmt.Printf("error parsing hook_timeout as duration: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("hook_state"); ok {
+		options.HookState = value
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("wait_timeout"); ok {
+		options.WaitTimeout, err = time.ParseDuration(value)
+		if err != nil {
+			fmt.Printf("error parsing wait_timeout as duration: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if ok, _ := options.MountOptions.ExtractOption("snapshot_sensitive"); ok {
+		options.SnapshotSensitive = true
+	}
+
+	for {
+		ok, value := options.MountOptions.ExtractOption("env")
+		if !ok {
+			break
+		}
+		options.Env = append(options.Env, value)
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("templates_dir"); ok {
+		options.TemplatesDir = value
+	}
+
 	if ok, _ := options.MountOptions.ExtractOption("no_syslog"); ok {
 		options.DisableSyslog = true
 	}
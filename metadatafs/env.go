@@ -0,0 +1,165 @@
+package metadatafs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/jszwedko/ec2-metadatafs/internal/fuseutil"
+)
+
+// The hidden .env file at the root sets well-known variables, e.g.
+// INSTANCE_ID='i-123456', one per line and quoted so that it can be sourced
+// by a shell. Most come from the instance identity document, falling back to
+// the tree if it lacks them, the others and those of EnvVariables from the
+// tree. Variables whose value does not exist are left out. Like
+// .snapshot.json, the file is generated when opened.
+
+// envFile is the name of the environment file at the root
+const envFile = ".env"
+
+// identityDocument is the path of the instance identity document
+const identityDocument = "dynamic/instance-identity/document"
+
+// EnvVariable is a variable of .env and the metadata path of its value
+type EnvVariable struct {
+	Name string
+	Path string
+
+	// field of the instance identity document holding the value, used in
+	// preference to Path
+	field string
+}
+
+// wellKnownEnvVariables are the variables always set in .env, in order
+var wellKnownEnvVariables = []EnvVariable{
+	{Name: "INSTANCE_ID", field: "instanceId", Path: "meta-data/instance-id"},
+	{Name: "INSTANCE_TYPE", field: "instanceType", Path: "meta-data/instance-type"},
+	{Name: "AMI_ID", field: "imageId", Path: "meta-data/ami-id"},
+	{Name: "ACCOUNT_ID", field: "accountId"},
+	{Name: "REGION", field: "region", Path: "meta-data/placement/region"},
+	{Name: "AZ", field: "availabilityZone", Path: "meta-data/placement/availability-zone"},
+	{Name: "AZ_ID", Path: "meta-data/placement/availability-zone-id"},
+	{Name: "ARCHITECTURE", field: "architecture"},
+	{Name: "PRIVATE_IP", field: "privateIp", Path: "meta-data/local-ipv4"},
+	{Name: "PUBLIC_IP", Path: "meta-data/public-ipv4"},
+	{Name: "LOCAL_HOSTNAME", Path: "meta-data/local-hostname"},
+	{Name: "PUBLIC_HOSTNAME", Path: "meta-data/public-hostname"},
+	{Name: "MAC", Path: "meta-data/mac"},
+}
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ParseEnvVariable parses a NAME=PATH mapping of a variable of .env to a
+// metadata path
+func ParseEnvVariable(mapping string) (EnvVariable, error) {
+	parts := strings.SplitN(mapping, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return EnvVariable{}, fmt.Errorf("invalid mapping %q, expected NAME=PATH", mapping)
+	}
+	if !envNameRegexp.MatchString(parts[0]) {
+		return EnvVariable{}, fmt.Errorf("invalid variable name %q", parts[0])
+	}
+	return EnvVariable{Name: parts[0], Path: strings.Trim(parts[1], "/")}, nil
+}
+
+// envVariables returns the variables of .env in order, with those of
+// EnvVariables replacing the well-known variables of the same name
+func (fs *MetadataFs) envVariables() []EnvVariable {
+	extra := map[string]bool{}
+	for _, v := range fs.EnvVariables {
+		extra[v.Name] = true
+	}
+
+	variables := []EnvVariable{}
+	for _, v := range wellKnownEnvVariables {
+		if !extra[v.Name] {
+			variables = append(variables, v)
+		}
+	}
+	return append(variables, fs.EnvVariables...)
+}
+
+// envAttr returns the attributes of .env, ok is false for other paths. Like
+// the snapshot, it is reported as empty and opened with direct I/O.
+func (fs *MetadataFs) envAttr(name string) (attr *fuse.Attr, code fuse.Status, ok bool) {
+	if name != envFile {
+		return nil, fuse.OK, false
+	}
+	return &fuse.Attr{Mode: fuse.S_IFREG | 0444}, fuse.OK, true
+}
+
+// envOpen generates .env, ok is false for other paths
+func (fs *MetadataFs) envOpen(name string, flags uint32) (file nodefs.File, code fuse.Status, ok bool) {
+	if name != envFile {
+		return nil, fuse.OK, false
+	}
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM, true
+	}
+
+	content, err := fs.env()
+	if err != nil {
+		fs.Logger.Errorf("failed to generate %s: %s", envFile, err)
+		return nil, fuse.EIO, true
+	}
+
+	return &nodefs.WithFlags{
+		File:      nodefs.NewDataFile(content),
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, fuse.OK, true
+}
+
+// env fetches the values of the variables and returns them as shell
+// assignments
+func (fs *MetadataFs) env() ([]byte, error) {
+	variables := fs.envVariables()
+
+	var document map[string]interface{}
+	data, err := FetchValue(fs.Client, identityDocument)
+	if err != nil {
+		return nil, fmt.Errorf("reading %q: %s", identityDocument, err)
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, &document); err != nil {
+			return nil, fmt.Errorf("parsing %q: %s", identityDocument, err)
+		}
+	}
+
+	values := make([][]byte, len(variables))
+	errs := make([]error, len(variables))
+	var wg sync.WaitGroup
+	for i, v := range variables {
+		if value, ok := document[v.field].(string); ok && v.field != "" {
+			values[i] = []byte(value)
+			continue
+		}
+		if v.Path == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, v EnvVariable) {
+			defer wg.Done()
+			values[i], errs[i] = fs.value(v.Path)
+		}(i, v)
+	}
+	wg.Wait()
+
+	var buf bytes.Buffer
+	for i, v := range variables {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("reading %q for %s: %s", v.Path, v.Name, errs[i])
+		}
+		if values[i] == nil {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s=%s\n", v.Name, fuseutil.ShellQuote(string(values[i])))
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,243 @@
+package metadatafs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+)
+
+// The scheduled and past maintenance events are served as JSON arrays, which
+// are exploded into a directory per event holding a file per field, e.g.
+// meta-data/events/maintenance/scheduled/instance-event-1234/NotBefore.
+
+// maintenanceEvent is an element of the maintenance event arrays
+type maintenanceEvent struct {
+	Code        string
+	Description string
+	EventId     string
+	NotAfter    string
+	NotBefore   string
+	State       string
+}
+
+// maintenanceFields are the files in each event directory
+var maintenanceFields = []string{"Code", "Description", "NotAfter", "NotBefore", "State"}
+
+func (e *maintenanceEvent) field(name string) (string, bool) {
+	switch name {
+	case "Code":
+		return e.Code, true
+	case "Description":
+		return e.Description, true
+	case "NotAfter":
+		return e.NotAfter, true
+	case "NotBefore":
+		return e.NotBefore, true
+	case "State":
+		return e.State, true
+	default:
+		return "", false
+	}
+}
+
+// maintenanceTimeFormat is the format of NotBefore and NotAfter, e.g.
+// 21 Jan 2019 09:00:43 GMT
+const maintenanceTimeFormat = "2 Jan 2006 15:04:05 MST"
+
+// modified returns the time the event starts, or ends if it has no start,
+// so that sorting by mtime sorts by start time
+func (e *maintenanceEvent) modified() (time.Time, bool) {
+	for _, value := range []string{e.NotBefore, e.NotAfter} {
+		if t, err := time.Parse(maintenanceTimeFormat, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+var maintenancePathRegexp = regexp.MustCompile(`^(meta-data/events/maintenance/(?:scheduled|history))(?:/([^/]+)(?:/([^/]+))?)?$`)
+
+// maintenancePath splits a path beneath one of the maintenance event arrays
+// into the array, the event ID and the field, ok is false for other paths
+func maintenancePath(name string) (list, eventID, field string, ok bool) {
+	m := maintenancePathRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return "", "", "", false
+	}
+	return m[1], m[2], m[3], true
+}
+
+// maintenanceEvents fetches and parses one of the event arrays
+func (fs *MetadataFs) maintenanceEvents(list string) ([]maintenanceEvent, *http.Response, fuse.Status) {
+	resp, err := fs.Client.Get(list)
+	if err != nil {
+		fs.Logger.Errorf("failed to query AWS metadata API: %s", err)
+		return nil, nil, fuse.EIO
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		fs.Logger.Debugf("returning ENOENT for %s", list)
+		return nil, nil, fuse.ENOENT
+	case http.StatusUnauthorized:
+		fs.Logger.Errorf("got 401 from AWS metadata API for %s; instance may only support IMDSv2", list)
+		return nil, nil, fuse.EACCES
+	case http.StatusOK:
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			fs.Logger.Errorf("failed to query AWS metadata API: %s", err)
+			return nil, nil, fuse.EIO
+		}
+
+		events := []maintenanceEvent{}
+		if err := json.Unmarshal(body, &events); err != nil {
+			fs.Logger.Errorf("failed to parse maintenance events from %s: %s", list, err)
+			return nil, nil, fuse.EIO
+		}
+		return events, resp, fuse.OK
+	default:
+		fs.Logger.Errorf("unknown HTTP status code from AWS metadata API: %d", resp.StatusCode)
+		return nil, nil, fuse.EIO
+	}
+}
+
+// value returns the current content of the file name, or nil if it does not
+// exist
+func (fs *MetadataFs) value(name string) ([]byte, error) {
+	list, eventID, field, ok := maintenancePath(name)
+	if !ok || field == "" {
+		return FetchValue(fs.Client, name)
+	}
+
+	event, code := fs.maintenanceEvent(list, eventID)
+	switch code {
+	case fuse.OK:
+		value, _ := event.field(field)
+		return []byte(value), nil
+	case fuse.ENOENT:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("failed to fetch maintenance event %s: %s", eventID, code)
+	}
+}
+
+// maintenanceEvent returns the event with the given ID from one of the
+// event arrays
+func (fs *MetadataFs) maintenanceEvent(list, eventID string) (*maintenanceEvent, fuse.Status) {
+	events, _, code := fs.maintenanceEvents(list)
+	if code != fuse.OK {
+		return nil, code
+	}
+
+	for i := range events {
+		if events[i].EventId == eventID {
+			return &events[i], fuse.OK
+		}
+	}
+
+	fs.Logger.Debugf("no maintenance event %s in %s", eventID, list)
+	return nil, fuse.ENOENT
+}
+
+// maintenanceAttr returns the attributes of the event arrays and the
+// directories and files they are exploded into, ok is false for other paths
+func (fs *MetadataFs) maintenanceAttr(name string) (attr *fuse.Attr, code fuse.Status, ok bool) {
+	list, eventID, field, ok := maintenancePath(name)
+	if !ok {
+		return nil, fuse.OK, false
+	}
+
+	if eventID == "" {
+		_, resp, code := fs.maintenanceEvents(list)
+		if code != fuse.OK {
+			return nil, code, true
+		}
+		return fs.httpResponseToAttr(resp, true), fuse.OK, true
+	}
+
+	event, code := fs.maintenanceEvent(list, eventID)
+	if code != fuse.OK {
+		return nil, code, true
+	}
+
+	attr = &fuse.Attr{Size: 4096, Mode: fuse.S_IFDIR | 0555}
+	if field != "" {
+		value, found := event.field(field)
+		if !found {
+			return nil, fuse.ENOENT, true
+		}
+		attr = &fuse.Attr{Size: uint64(len(value)), Mode: fuse.S_IFREG | 0444}
+	}
+
+	if modified, found := event.modified(); found {
+		attr.SetTimes(nil, &modified, &modified)
+	}
+	return attr, fuse.OK, true
+}
+
+// maintenanceOpenDir lists the events of an array or the fields of an event,
+// ok is false for other paths
+func (fs *MetadataFs) maintenanceOpenDir(name string) (entries []fuse.DirEntry, code fuse.Status, ok bool) {
+	list, eventID, field, ok := maintenancePath(name)
+	if !ok {
+		return nil, fuse.OK, false
+	}
+
+	switch {
+	case field != "":
+		return nil, fuse.ENOTDIR, true
+	case eventID != "":
+		if _, code := fs.maintenanceEvent(list, eventID); code != fuse.OK {
+			return nil, code, true
+		}
+
+		for _, field := range maintenanceFields {
+			entries = append(entries, fuse.DirEntry{Name: field, Mode: fuse.S_IFREG})
+		}
+		return entries, fuse.OK, true
+	default:
+		events, _, code := fs.maintenanceEvents(list)
+		if code != fuse.OK {
+			return nil, code, true
+		}
+
+		entries = make([]fuse.DirEntry, 0, len(events))
+		for _, event := range events {
+			if event.EventId == "" {
+				continue
+			}
+			entries = append(entries, fuse.DirEntry{Name: event.EventId, Mode: fuse.S_IFDIR})
+		}
+		return entries, fuse.OK, true
+	}
+}
+
+// maintenanceOpen returns a field of an event, ok is false for other paths
+func (fs *MetadataFs) maintenanceOpen(name string) (file nodefs.File, code fuse.Status, ok bool) {
+	list, eventID, field, ok := maintenancePath(name)
+	if !ok {
+		return nil, fuse.OK, false
+	}
+
+	if field == "" {
+		return nil, fuse.EISDIR, true
+	}
+
+	event, code := fs.maintenanceEvent(list, eventID)
+	if code != fuse.OK {
+		return nil, code, true
+	}
+
+	value, found := event.field(field)
+	if !found {
+		return nil, fuse.ENOENT, true
+	}
+	return nodefs.NewDataFile([]byte(value)), fuse.OK, true
+}
@@ -7,6 +7,7 @@ import (
 	"path"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -22,7 +23,38 @@ type MetadataFs struct {
 
 	Client MetadataClient
 
+	// Watcher, if set, polls paths for changes made upstream
+	Watcher *Watcher
+
+	// Mountpoint, if set, is used to replay changes for inotify watchers
+	Mountpoint string
+
+	// SnapshotSensitive includes the sensitive paths in .snapshot.json
+	SnapshotSensitive bool
+
+	// EnvVariables are set in .env along with the well-known variables
+	EnvVariables []EnvVariable
+
+	// TemplatesDir, if set, holds templates rendered at the root
+	TemplatesDir string
+
+	// TemplateTTL is how long a rendered template is served before being
+	// rendered again, 0 to render it on every open and negative to keep it
+	// until it is invalidated or the template changes
+	TemplateTTL time.Duration
+
 	Logger logger.LeveledLogger
+
+	nodeFs *pathfs.PathNodeFs
+
+	replaysMu sync.Mutex
+	replays   map[string]*replay
+
+	tagsMu sync.Mutex
+	tags   TagLookup
+
+	renderedMu sync.Mutex
+	rendered   map[string]*renderedTemplate
 }
 
 // MetadataClient is a client for accessing the AWS Instance Metadata Service
@@ -41,6 +73,39 @@ func New(client MetadataClient, l logger.LeveledLogger) *MetadataFs {
 	}
 }
 
+// OnMount keeps the PathNodeFs the filesystem was mounted with so that
+// changes can be pushed to the kernel
+func (fs *MetadataFs) OnMount(nodeFs *pathfs.PathNodeFs) {
+	fs.nodeFs = nodeFs
+}
+
+// Notify replays the change through the mount so that inotify watchers wake
+// up (see replayChange) and tells the kernel to drop anything it has cached
+// for the changed path and its parent directory
+func (fs *MetadataFs) Notify(c Change) {
+	if fs.nodeFs == nil {
+		return
+	}
+
+	dir, name := path.Split(c.Path)
+	dir = strings.TrimRight(dir, "/")
+
+	fs.replayChange(c)
+
+	fs.Logger.Debugf("notifying kernel of change to %s", c.Path)
+	if c.Disappeared() {
+		parent, child := fs.nodeFs.Node(dir), fs.nodeFs.Node(c.Path)
+		if parent != nil && child != nil {
+			fs.nodeFs.Connector().DeleteNotify(parent, child, name)
+		} else {
+			fs.nodeFs.EntryNotify(dir, name)
+		}
+	} else {
+		fs.nodeFs.Notify(c.Path)
+	}
+	fs.nodeFs.Notify(dir)
+}
+
 // StatFs returns the statistics of the filesystem
 //
 // Currently stubbed to return the empty struct to satisfy programs like `df`
@@ -51,6 +116,22 @@ func (fs *MetadataFs) StatFs(name string) *fuse.StatfsOut {
 
 // GetAttr returns an fuse.Attr representing a read-only file or directory
 func (fs *MetadataFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if attr, status, ok := fs.replayAttr(name); ok {
+		return attr, status
+	}
+	if attr, status, ok := fs.maintenanceAttr(name); ok {
+		return attr, status
+	}
+	if attr, status, ok := fs.snapshotAttr(name); ok {
+		return attr, status
+	}
+	if attr, status, ok := fs.envAttr(name); ok {
+		return attr, status
+	}
+	if attr, status, ok := fs.templateAttr(name); ok {
+		return attr, status
+	}
+
 	resp, err := fs.Client.Head(name)
 	if err != nil {
 		fs.Logger.Errorf("failed to query AWS metadata API: %s", err)
@@ -79,6 +160,10 @@ func (fs *MetadataFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, f
 
 // OpenDir returns the list of paths under the given path
 func (fs *MetadataFs) OpenDir(name string, context *fuse.Context) (c []fuse.DirEntry, code fuse.Status) {
+	if entries, status, ok := fs.maintenanceOpenDir(name); ok {
+		return entries, status
+	}
+
 	resp, err := fs.Client.Get(name)
 	if err != nil {
 		fs.Logger.Errorf("failed to query AWS metadata API: %s", err)
@@ -135,6 +220,10 @@ func (fs *MetadataFs) OpenDir(name string, context *fuse.Context) (c []fuse.DirE
 			}
 		}
 
+		if name == "" {
+			dirEntries = append(dirEntries, fs.templateEntries()...)
+		}
+
 		return dirEntries, fuse.OK
 	default:
 		fs.Logger.Errorf("unknown HTTP status code from AWS metadata API: %d", resp.StatusCode)
@@ -144,6 +233,22 @@ func (fs *MetadataFs) OpenDir(name string, context *fuse.Context) (c []fuse.DirE
 
 // Open returns a datafile representing the HTTP response body
 func (fs *MetadataFs) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 && fs.pendingReplay(name, context) != nil {
+		return newDiscardFile(), fuse.OK
+	}
+	if file, status, ok := fs.maintenanceOpen(name); ok {
+		return file, status
+	}
+	if file, status, ok := fs.snapshotOpen(name, flags); ok {
+		return file, status
+	}
+	if file, status, ok := fs.envOpen(name, flags); ok {
+		return file, status
+	}
+	if file, status, ok := fs.templateOpen(name, flags, context); ok {
+		return file, status
+	}
+
 	resp, err := fs.Client.Get(name)
 	if err != nil {
 		fs.Logger.Errorf("failed to query AWS metadata API: %s", err)
@@ -197,7 +302,15 @@ func (fs *MetadataFs) httpResponseToAttr(resp *http.Response, dir bool) *fuse.At
 var directoryRexep = regexp.MustCompile(strings.Replace(`^(
 |
 meta-data|
+meta-data/autoscaling|
 meta-data/block-device-mapping|
+meta-data/events|
+meta-data/events/maintenance|
+meta-data/events/maintenance/history|
+meta-data/events/maintenance/history/[^/]+|
+meta-data/events/maintenance/scheduled|
+meta-data/events/maintenance/scheduled/[^/]+|
+meta-data/events/recommendations|
 meta-data/iam|
 meta-data/iam/security-credentials|
 meta-data/network/interfaces|
@@ -1,19 +1,25 @@
 package metadatafs
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
@@ -21,6 +27,10 @@ import (
 )
 
 func setup(t *testing.T) (mux *http.ServeMux, workdir string, cleanup func()) {
+	return setupWith(t, nil)
+}
+
+func setupWith(t *testing.T, configure func(*MetadataFs)) (mux *http.ServeMux, workdir string, cleanup func()) {
 	mux = http.NewServeMux()
 	server := httptest.NewServer(mux)
 
@@ -30,6 +40,9 @@ func setup(t *testing.T) (mux *http.ServeMux, workdir string, cleanup func()) {
 	}
 
 	fs := New(NewIMDSv1Client(server.URL+"/", logging.NewLogger()), logging.NewLogger())
+	if configure != nil {
+		configure(fs)
+	}
 	nfs := pathfs.NewPathNodeFs(fs, nil)
 	state, _, err := nodefs.MountRoot(tmpDir, nfs.Root(), nodefs.NewOptions())
 	if err != nil {
@@ -37,6 +50,7 @@ func setup(t *testing.T) (mux *http.ServeMux, workdir string, cleanup func()) {
 	}
 
 	go state.Serve()
+	state.WaitMount()
 
 	return mux, tmpDir, func() {
 		server.Close()
@@ -59,6 +73,7 @@ func setupWithoutServer(t *testing.T) (workdir string, cleanup func()) {
 	}
 
 	go state.Serve()
+	state.WaitMount()
 
 	return tmpDir, func() {
 		state.Unmount()
@@ -427,3 +442,730 @@ func TestMetadatFs_ReadOnly(t *testing.T) {
 		t.Fatalf(`expected to get permissions error, got %s`, err)
 	}
 }
+
+func setupWatcher(t *testing.T, paths ...string) (mux *http.ServeMux, workdir string, watcher *Watcher, cleanup func()) {
+	mux = http.NewServeMux()
+	server := httptest.NewServer(mux)
+
+	tmpDir, err := ioutil.TempDir("", "ec2metadata-test")
+	if err != nil {
+		t.Fatalf("creating tempdir failed: %v", err)
+	}
+
+	client := NewIMDSv1Client(server.URL+"/", logging.NewLogger())
+	fs := New(client, logging.NewLogger())
+	fs.Mountpoint = tmpDir
+	fs.Watcher = NewWatcher(client, paths, time.Hour, logging.NewLogger())
+	fs.Watcher.Subscribe(fs.Notify)
+
+	nfs := pathfs.NewPathNodeFs(fs, nil)
+	state, _, err := nodefs.MountRoot(tmpDir, nfs.Root(), nodefs.NewOptions())
+	if err != nil {
+		t.Fatalf("mounting filesystem failed: %v", err)
+	}
+
+	go state.Serve()
+	state.WaitMount()
+
+	return mux, tmpDir, fs.Watcher, func() {
+		server.Close()
+		state.Unmount()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+// serveMutableFile serves a file whose body can be changed, or removed by
+// setting it to nil
+func serveMutableFile(mux *http.ServeMux, file string, body []byte) (set func(body []byte)) {
+	var mu sync.Mutex
+
+	dir, filename := path.Split(file)
+	serveDirectory(mux, dir, []string{filename}, time.Now())
+
+	mux.HandleFunc(file, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if body == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Add("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Add("Last-Modified", time.Now().Format(time.RFC1123))
+		if r.Method == "GET" {
+			w.Write(body)
+		}
+	})
+
+	return func(b []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		body = b
+	}
+}
+
+// inotifyEvents watches dir and returns a function returning the masks of the
+// events seen for name since the last call
+func inotifyEvents(t *testing.T, dir, name string) (events func() uint32, cleanup func()) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK)
+	if err != nil {
+		t.Fatalf("initializing inotify failed: %v", err)
+	}
+
+	if _, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_ALL_EVENTS); err != nil {
+		t.Fatalf("watching %s failed: %v", dir, err)
+	}
+
+	return func() uint32 {
+			var mask uint32
+			buf := make([]byte, 4096)
+			n, _ := syscall.Read(fd, buf)
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				eventName := strings.TrimRight(string(buf[offset+syscall.SizeofInotifyEvent:offset+syscall.SizeofInotifyEvent+int(event.Len)]), "\x00")
+				if eventName == name {
+					mask |= event.Mask
+				}
+				offset += syscall.SizeofInotifyEvent + int(event.Len)
+			}
+			return mask
+		}, func() {
+			syscall.Close(fd)
+		}
+}
+
+func TestMetadatFs_Watcher_inotify(t *testing.T) {
+	mux, dir, watcher, cleanup := setupWatcher(t, "meta-data/spot/instance-action")
+	defer cleanup()
+
+	set := serveMutableFile(mux, "/meta-data/spot/instance-action", nil)
+	watcher.Poll()
+
+	if _, err := os.Stat(path.Join(dir, "meta-data/spot")); err != nil {
+		t.Fatalf(`error retrieving stat %s`, err)
+	}
+
+	events, stop := inotifyEvents(t, path.Join(dir, "meta-data/spot"), "instance-action")
+	defer stop()
+
+	for _, tt := range []struct {
+		body     []byte
+		expected uint32
+		what     string
+	}{
+		{[]byte(`{"action": "stop"}`), syscall.IN_CREATE, "appears"},
+		{[]byte(`{"action": "terminate"}`), syscall.IN_MODIFY, "changes"},
+		{nil, syscall.IN_DELETE, "disappears"},
+	} {
+		set(tt.body)
+		watcher.Poll()
+
+		if mask := events(); mask&tt.expected == 0 {
+			t.Errorf(`expected inotify event %#x when the file %s, got %#x`, tt.expected, tt.what, mask)
+		}
+
+		contents, err := ioutil.ReadFile(path.Join(dir, "meta-data/spot/instance-action"))
+		switch {
+		case tt.body == nil && !os.IsNotExist(err):
+			t.Errorf(`expected the file to no longer exist, got %v`, err)
+		case tt.body != nil && string(contents) != string(tt.body):
+			t.Errorf(`contents were %s after the file %s, expected %s (%v)`, contents, tt.what, tt.body, err)
+		}
+	}
+}
+
+func TestMetadatFs_Watcher_inotifyDirectory(t *testing.T) {
+	mux, dir, watcher, cleanup := setupWatcher(t, "meta-data/events/maintenance/scheduled")
+	defer cleanup()
+
+	set := serveMutableFile(mux, "/meta-data/events/maintenance/scheduled", []byte(`[]`))
+	watcher.Poll()
+
+	scheduled := path.Join(dir, "meta-data/events/maintenance/scheduled")
+	if _, err := os.Stat(scheduled); err != nil {
+		t.Fatalf(`error retrieving stat %s`, err)
+	}
+
+	events, stop := inotifyEvents(t, scheduled, "")
+	defer stop()
+
+	set([]byte(`[{"Code": "system-reboot", "EventId": "instance-event-0d59937288b749b32", "State": "active"}]`))
+	watcher.Poll()
+
+	if mask := events(); mask&syscall.IN_ATTRIB == 0 {
+		t.Errorf(`expected inotify event %#x when the directory changes, got %#x`, syscall.IN_ATTRIB, mask)
+	}
+
+	fileInfos, err := ioutil.ReadDir(scheduled)
+	if err != nil || len(fileInfos) != 1 || fileInfos[0].Name() != "instance-event-0d59937288b749b32" {
+		t.Errorf(`expected the new event to be listed after the directory changes, got %v (%v)`, fileInfos, err)
+	}
+}
+
+func TestMetadatFs_replay_otherProcess(t *testing.T) {
+	var mfs *MetadataFs
+	mux, dir, cleanup := setupWith(t, func(fs *MetadataFs) {
+		mfs = fs
+	})
+	defer cleanup()
+	serveTree(mux, map[string]string{
+		"meta-data":             "instance-id\nmac",
+		"meta-data/instance-id": "i-123456",
+		"meta-data/mac":         "0e:00:00:00:00:01",
+	})
+
+	// changes being replayed are only accepted from the daemon itself
+	mfs.replays = map[string]*replay{
+		"meta-data/instance-id": {change: Change{Path: "meta-data/instance-id", Old: []byte("i-1"), New: []byte("i-123456")}},
+		"meta-data/mac":         {change: Change{Path: "meta-data/mac", Old: []byte("0e:00:00:00:00:01")}},
+		"meta-data/public-ipv4": {change: Change{Path: "meta-data/public-ipv4", New: []byte("1.2.3.4")}},
+	}
+	for _, command := range []string{
+		`printf x >> "$1/meta-data/instance-id"`,
+		`rm -f "$1/meta-data/mac"`,
+		`printf x > "$1/meta-data/public-ipv4"`,
+	} {
+		if out, err := exec.Command("sh", "-c", command, "sh", dir).CombinedOutput(); err == nil {
+			t.Errorf(`expected %q to fail from another process, got %q`, command, out)
+		}
+	}
+}
+
+func TestWatcher_Poll(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	set := serveMutableFile(mux, "/meta-data/spot/instance-action", []byte("a"))
+
+	watcher := NewWatcher(NewIMDSv1Client(server.URL+"/", logging.NewLogger()), []string{"meta-data/spot/instance-action"}, time.Hour, logging.NewLogger())
+	changes := []Change{}
+	watcher.Subscribe(func(c Change) { changes = append(changes, c) })
+
+	watcher.Poll()
+	watcher.Poll()
+	if len(changes) != 0 {
+		t.Fatalf(`expected no changes before the value changes, got %+v`, changes)
+	}
+
+	set([]byte(""))
+	watcher.Poll()
+	set(nil)
+	watcher.Poll()
+
+	if len(changes) != 2 {
+		t.Fatalf(`expected 2 changes, got %+v`, changes)
+	}
+	if string(changes[0].Old) != "a" || changes[0].New == nil || len(changes[0].New) != 0 {
+		t.Errorf(`expected change from "a" to empty, got %+v`, changes[0])
+	}
+	if !changes[1].Disappeared() || changes[1].Appeared() {
+		t.Errorf(`expected the file to disappear, got %+v`, changes[1])
+	}
+}
+
+func setupWait(t *testing.T, timeout time.Duration) (mux *http.ServeMux, workdir string, cleanup func()) {
+	mux = http.NewServeMux()
+	server := httptest.NewServer(mux)
+
+	tmpDir, err := ioutil.TempDir("", "ec2metadata-test")
+	if err != nil {
+		t.Fatalf("creating tempdir failed: %v", err)
+	}
+
+	fs := New(NewIMDSv1Client(server.URL+"/", logging.NewLogger()), logging.NewLogger())
+	nfs := pathfs.NewPathNodeFs(NewWaitFs(fs, 10*time.Millisecond, timeout, logging.NewLogger()), nil)
+	state, _, err := nodefs.MountRoot(tmpDir, nfs.Root(), nodefs.NewOptions())
+	if err != nil {
+		t.Fatalf("mounting filesystem failed: %v", err)
+	}
+
+	go state.Serve()
+	state.WaitMount()
+
+	return mux, tmpDir, func() {
+		server.Close()
+		state.Unmount()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestWaitFs_Open_appears(t *testing.T) {
+	mux, dir, cleanup := setupWait(t, 0)
+	defer cleanup()
+
+	set := serveMutableFile(mux, "/meta-data/spot/instance-action", nil)
+
+	read := make(chan string)
+	go func() {
+		contents, err := ioutil.ReadFile(path.Join(dir, "meta-data/spot/instance-action"))
+		if err != nil {
+			t.Errorf(`error reading file: %s`, err)
+		}
+		read <- string(contents)
+	}()
+
+	select {
+	case contents := <-read:
+		t.Fatalf(`expected open to block until the file appears, got %q`, contents)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	set([]byte(`{"action": "stop"}`))
+
+	select {
+	case contents := <-read:
+		if contents != `{"action": "stop"}` {
+			t.Errorf(`contents were %q, expected %q`, contents, `{"action": "stop"}`)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf(`open did not return after the file appeared`)
+	}
+}
+
+func TestWaitFs_Open_exists(t *testing.T) {
+	// a blocked open would fail with ETIMEDOUT
+	mux, dir, cleanup := setupWait(t, time.Second)
+	defer cleanup()
+
+	serveMutableFile(mux, "/meta-data/spot/instance-action", []byte(`{"action": "stop"}`))
+
+	contents, err := ioutil.ReadFile(path.Join(dir, "meta-data/spot/instance-action"))
+	if err != nil || string(contents) != `{"action": "stop"}` {
+		t.Errorf(`read instance-action: %q, %v, expected it to be returned at once`, contents, err)
+	}
+}
+
+func TestWaitFs_Open_nonblocking(t *testing.T) {
+	mux, dir, cleanup := setupWait(t, 0)
+	defer cleanup()
+
+	serveMutableFile(mux, "/meta-data/spot/instance-action", nil)
+	mux.HandleFunc("/meta-data/instance-id", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "i-123456")
+	})
+
+	_, err := os.OpenFile(path.Join(dir, "meta-data/spot/instance-action"), os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if syscallError := (&os.PathError{}); !errors.As(err, &syscallError) || syscallError.Err != syscall.EAGAIN {
+		t.Errorf(`expected EAGAIN for a missing file, got %v`, err)
+	}
+
+	f, err := os.OpenFile(path.Join(dir, "meta-data/instance-id"), os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatalf(`error opening existing file: %s`, err)
+	}
+	defer f.Close()
+	if contents, _ := ioutil.ReadAll(f); string(contents) != "i-123456" {
+		t.Errorf(`contents were %q, expected %q`, contents, "i-123456")
+	}
+}
+
+func TestWaitFs_Open_timeout(t *testing.T) {
+	mux, dir, cleanup := setupWait(t, 50*time.Millisecond)
+	defer cleanup()
+
+	serveMutableFile(mux, "/meta-data/spot/instance-action", nil)
+
+	_, err := ioutil.ReadFile(path.Join(dir, "meta-data/spot/instance-action"))
+	if syscallError := (&os.PathError{}); !errors.As(err, &syscallError) || syscallError.Err != syscall.ETIMEDOUT {
+		t.Errorf(`expected ETIMEDOUT, got %v`, err)
+	}
+}
+
+func TestMetadatFs_maintenanceEvents(t *testing.T) {
+	mux, dir, cleanup := setup(t)
+	defer cleanup()
+
+	serveFile(mux, "/meta-data/events/maintenance/scheduled", `[
+  {
+    "NotBefore" : "21 Jan 2019 09:00:43 GMT",
+    "Code" : "system-reboot",
+    "Description" : "scheduled reboot",
+    "EventId" : "instance-event-0d59937288b749b32",
+    "NotAfter" : "21 Jan 2019 09:17:23 GMT",
+    "State" : "active"
+  },
+  {
+    "NotBefore" : "20 Jan 2019 09:00:43 GMT",
+    "Code" : "instance-stop",
+    "Description" : "scheduled stop",
+    "EventId" : "instance-event-0e79937288b749b31",
+    "NotAfter" : "20 Jan 2019 09:17:23 GMT",
+    "State" : "active"
+  }
+]`, time.Now())
+
+	fileInfos, err := ioutil.ReadDir(path.Join(dir, "meta-data/events/maintenance/scheduled"))
+	if err != nil {
+		t.Fatalf(`error listing directory: %s`, err)
+	}
+
+	names := []string{}
+	for _, fileInfo := range fileInfos {
+		names = append(names, fileInfo.Name())
+		if !fileInfo.IsDir() {
+			t.Errorf(`expected %s to be a directory`, fileInfo.Name())
+		}
+	}
+	expected := []string{"instance-event-0d59937288b749b32", "instance-event-0e79937288b749b31"}
+	if !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %+v, expected %+v`, names, expected)
+	}
+
+	info, err := os.Stat(path.Join(dir, "meta-data/events/maintenance/scheduled/instance-event-0d59937288b749b32"))
+	if err != nil {
+		t.Fatalf(`error retrieving stat %s`, err)
+	}
+	if expected := time.Date(2019, 1, 21, 9, 0, 43, 0, time.UTC); !info.ModTime().Equal(expected) {
+		t.Errorf(`modified time was %s, expected NotBefore %s`, info.ModTime(), expected)
+	}
+
+	fileInfos, err = ioutil.ReadDir(path.Join(dir, "meta-data/events/maintenance/scheduled/instance-event-0d59937288b749b32"))
+	if err != nil {
+		t.Fatalf(`error listing directory: %s`, err)
+	}
+	names = []string{}
+	for _, fileInfo := range fileInfos {
+		names = append(names, fileInfo.Name())
+	}
+	if expected := []string{"Code", "Description", "NotAfter", "NotBefore", "State"}; !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %+v, expected %+v`, names, expected)
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(dir, "meta-data/events/maintenance/scheduled/instance-event-0e79937288b749b31/Code"))
+	if err != nil {
+		t.Fatalf(`error reading file: %s`, err)
+	}
+	if string(contents) != "instance-stop" {
+		t.Errorf(`contents were %q, expected %q`, contents, "instance-stop")
+	}
+
+	if _, err := os.Stat(path.Join(dir, "meta-data/events/maintenance/scheduled/instance-event-missing")); !os.IsNotExist(err) {
+		t.Errorf(`expected an unknown event not to exist, got %v`, err)
+	}
+}
+
+// serveTree serves the files and directory listings of tree by path, with ""
+// the root
+func serveTree(mux *http.ServeMux, tree map[string]string) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, ok := tree[strings.Trim(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if body == "500" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Add("Last-Modified", time.Now().Format(time.RFC1123))
+		if r.Method == "GET" {
+			fmt.Fprint(w, body)
+		}
+	})
+}
+
+var snapshotTree = map[string]string{
+	"":                                       "dynamic/\nmeta-data/\nuser-data",
+	"meta-data":                              "iam/\ninstance-id\nplacement/",
+	"meta-data/instance-id":                  "i-123456",
+	"meta-data/iam":                          "info\nsecurity-credentials/",
+	"meta-data/iam/info":                     `{"Code": "Success"}`,
+	"meta-data/iam/security-credentials":     "web",
+	"meta-data/iam/security-credentials/web": `{"SecretAccessKey": "secret"}`,
+	"meta-data/placement":                    "availability-zone\nregion",
+	"meta-data/placement/availability-zone":  "us-east-1a",
+	"meta-data/placement/region":             "us-east-1",
+	"user-data":                              "#!/bin/sh\nexport PASSWORD=secret\n",
+	"dynamic":                                "instance-identity/",
+	"dynamic/instance-identity":              "document\npkcs7",
+	"dynamic/instance-identity/document":     `{"region": "us-east-1"}`,
+	"dynamic/instance-identity/pkcs7":        "MIAGCSqGSIb3DQEHAqCAMIACAQExCzAJBgUrDgMCGgUAMIAGCSqGSIb3DQEHAaCAJIAEggHc",
+}
+
+func readSnapshot(t *testing.T, dir string) interface{} {
+	contents, err := ioutil.ReadFile(path.Join(dir, ".snapshot.json"))
+	if err != nil {
+		t.Fatalf(`error reading snapshot: %s`, err)
+	}
+	var snapshot interface{}
+	if err := json.Unmarshal(contents, &snapshot); err != nil {
+		t.Fatalf(`error parsing snapshot %q: %s`, contents, err)
+	}
+	return snapshot
+}
+
+func TestMetadatFs_snapshot(t *testing.T) {
+	mux, dir, cleanup := setup(t)
+	defer cleanup()
+	serveTree(mux, snapshotTree)
+
+	expected := map[string]interface{}{
+		"meta-data": map[string]interface{}{
+			"instance-id": "i-123456",
+			"iam":         map[string]interface{}{"info": `{"Code": "Success"}`},
+			"placement": map[string]interface{}{
+				"availability-zone": "us-east-1a",
+				"region":            "us-east-1",
+			},
+		},
+		"dynamic": map[string]interface{}{
+			"instance-identity": map[string]interface{}{"document": `{"region": "us-east-1"}`},
+		},
+	}
+	if snapshot := readSnapshot(t, dir); !reflect.DeepEqual(expected, snapshot) {
+		t.Errorf(`read snapshot %v, expected %v`, snapshot, expected)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, ".snapshot.json"), []byte("{}"), 0644); !errors.Is(err, syscall.EPERM) {
+		t.Errorf(`expected EPERM writing the snapshot, got %v`, err)
+	}
+}
+
+func TestMetadatFs_snapshot_sensitive(t *testing.T) {
+	mux, dir, cleanup := setupWith(t, func(fs *MetadataFs) {
+		fs.SnapshotSensitive = true
+	})
+	defer cleanup()
+	serveTree(mux, snapshotTree)
+
+	snapshot := readSnapshot(t, dir).(map[string]interface{})
+	if snapshot["user-data"] != snapshotTree["user-data"] {
+		t.Errorf(`expected user-data in snapshot, got %q`, snapshot["user-data"])
+	}
+	credentials := snapshot["meta-data"].(map[string]interface{})["iam"].(map[string]interface{})["security-credentials"]
+	if !reflect.DeepEqual(map[string]interface{}{"web": `{"SecretAccessKey": "secret"}`}, credentials) {
+		t.Errorf(`expected credentials in snapshot, got %v`, credentials)
+	}
+}
+
+func TestMetadatFs_snapshot_error(t *testing.T) {
+	mux, dir, cleanup := setup(t)
+	defer cleanup()
+
+	tree := map[string]string{}
+	for name, value := range snapshotTree {
+		tree[name] = value
+	}
+	tree["meta-data/placement/region"] = "500"
+	serveTree(mux, tree)
+
+	if _, err := ioutil.ReadFile(path.Join(dir, ".snapshot.json")); !errors.Is(err, syscall.EIO) {
+		t.Errorf(`expected EIO, got %v`, err)
+	}
+}
+
+func TestMetadatFs_env(t *testing.T) {
+	extra, err := ParseEnvVariable("ROLE=meta-data/iam/info")
+	if err != nil {
+		t.Fatalf(`error parsing mapping: %s`, err)
+	}
+	override, err := ParseEnvVariable("AZ_ID=/meta-data/placement/group-name/")
+	if err != nil {
+		t.Fatalf(`error parsing mapping: %s`, err)
+	}
+	mux, dir, cleanup := setupWith(t, func(fs *MetadataFs) {
+		fs.EnvVariables = []EnvVariable{extra, override}
+	})
+	defer cleanup()
+	serveTree(mux, map[string]string{
+		"dynamic/instance-identity/document": `{"instanceId": "i-123456", "region": "us-east-1", "availabilityZone": "us-east-1a", "privateIp": "10.0.0.1", "pendingTime": "2026-10-01T12:00:00Z"}`,
+		"meta-data/instance-type":            "t3.micro",
+		"meta-data/local-hostname":           "ip-10-0-0-1.ec2.internal",
+		"meta-data/mac":                      "0e:00:00:00:00:01",
+		"meta-data/iam/info":                 `{"Code": "it's"}`,
+		"meta-data/placement/group-name":     "cluster",
+	})
+
+	contents, err := ioutil.ReadFile(path.Join(dir, ".env"))
+	if err != nil {
+		t.Fatalf(`error reading .env: %s`, err)
+	}
+	expected := `INSTANCE_ID='i-123456'
+INSTANCE_TYPE='t3.micro'
+REGION='us-east-1'
+AZ='us-east-1a'
+PRIVATE_IP='10.0.0.1'
+LOCAL_HOSTNAME='ip-10-0-0-1.ec2.internal'
+MAC='0e:00:00:00:00:01'
+ROLE='{"Code": "it'\''s"}'
+AZ_ID='cluster'
+`
+	if string(contents) != expected {
+		t.Errorf(`read .env %q, expected %q`, contents, expected)
+	}
+
+	out, err := exec.Command("sh", "-c", `. "$1" && printf %s "$ROLE"`, "sh", path.Join(dir, ".env")).CombinedOutput()
+	if err != nil || string(out) != `{"Code": "it's"}` {
+		t.Errorf(`sourced ROLE %q, %v`, out, err)
+	}
+}
+
+func TestParseEnvVariable(t *testing.T) {
+	for _, mapping := range []string{"ROLE", "ROLE=", "1ROLE=meta-data/iam/info", "RO-LE=meta-data/iam/info"} {
+		if _, err := ParseEnvVariable(mapping); err == nil {
+			t.Errorf(`expected error parsing %q`, mapping)
+		}
+	}
+}
+
+// fakeTags implements TagLookup
+type fakeTags map[string]string
+
+func (t fakeTags) Tag(ctx context.Context, key string) (string, bool, error) {
+	value, ok := t[key]
+	return value, ok, nil
+}
+
+func TestMetadatFs_templates(t *testing.T) {
+	templatesDir, err := ioutil.TempDir("", "ec2metadata-templates")
+	if err != nil {
+		t.Fatalf("creating tempdir failed: %v", err)
+	}
+	defer os.RemoveAll(templatesDir)
+	for name, text := range map[string]string{
+		"labels.tmpl":    `instance="{{meta "meta-data/instance-id"}}",name="{{tag "Name"}}",team="{{tag "Team"}}",region="{{(json "dynamic/instance-identity/document").region}}"`,
+		"hosts":          `{{meta "/meta-data/local-ipv4/"}} {{or (meta "meta-data/public-hostname") "none"}}`,
+		"broken.tmpl":    `{{meta`,
+		"failing.tmpl":   `{{meta "meta-data/placement/region"}}`,
+		".hidden.tmpl":   `hidden`,
+		"meta-data.tmpl": `shadowed`,
+	} {
+		if err := ioutil.WriteFile(path.Join(templatesDir, name), []byte(text), 0644); err != nil {
+			t.Fatalf("writing template failed: %v", err)
+		}
+	}
+
+	mux, dir, cleanup := setupWith(t, func(fs *MetadataFs) {
+		fs.TemplatesDir = templatesDir
+		fs.SetTags(fakeTags{"Name": "web"})
+	})
+	defer cleanup()
+	serveTree(mux, map[string]string{
+		"":                                   "dynamic/\nmeta-data/",
+		"dynamic":                            "instance-identity/",
+		"meta-data":                          "instance-id\nlocal-ipv4\nplacement/",
+		"meta-data/instance-id":              "i-123456",
+		"meta-data/local-ipv4":               "10.0.0.1",
+		"meta-data/placement/region":         "500",
+		"dynamic/instance-identity/document": `{"region": "us-east-1"}`,
+	})
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf(`error listing directory: %s`, err)
+	}
+	names := []string{}
+	for _, fileInfo := range fileInfos {
+		names = append(names, fileInfo.Name())
+	}
+	if expected := []string{"broken", "dynamic", "failing", "hosts", "labels", "meta-data"}; !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %q, expected %q`, names, expected)
+	}
+
+	for name, expected := range map[string]string{
+		"labels": `instance="i-123456",name="web",team="",region="us-east-1"`,
+		"hosts":  `10.0.0.1 none`,
+	} {
+		contents, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil || string(contents) != expected {
+			t.Errorf(`read %s: %q, %v, expected %q`, name, contents, err, expected)
+		}
+	}
+
+	// templates are read again on every open
+	if err := ioutil.WriteFile(path.Join(templatesDir, "hosts"), []byte(`{{meta "meta-data/local-ipv4"}} localhost`), 0644); err != nil {
+		t.Fatalf("writing template failed: %v", err)
+	}
+	if contents, err := ioutil.ReadFile(path.Join(dir, "hosts")); err != nil || string(contents) != "10.0.0.1 localhost" {
+		t.Errorf(`read edited hosts: %q, %v`, contents, err)
+	}
+
+	for _, name := range []string{"broken", "failing"} {
+		if _, err := ioutil.ReadFile(path.Join(dir, name)); !errors.Is(err, syscall.EIO) {
+			t.Errorf(`expected EIO reading %s, got %v`, name, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(dir, ".hidden")); !os.IsNotExist(err) {
+		t.Errorf(`expected hidden template not to exist, got %v`, err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "labels"), []byte("x"), 0644); !errors.Is(err, syscall.EPERM) {
+		t.Errorf(`expected EPERM writing a template, got %v`, err)
+	}
+}
+
+func TestMetadatFs_templates_cached(t *testing.T) {
+	templatesDir, err := ioutil.TempDir("", "ec2metadata-templates")
+	if err != nil {
+		t.Fatalf("creating tempdir failed: %v", err)
+	}
+	defer os.RemoveAll(templatesDir)
+	template := path.Join(templatesDir, "id")
+	if err := ioutil.WriteFile(template, []byte(`{{meta "meta-data/instance-id"}}`), 0644); err != nil {
+		t.Fatalf("writing template failed: %v", err)
+	}
+
+	var mfs *MetadataFs
+	mux, dir, cleanup := setupWith(t, func(fs *MetadataFs) {
+		fs.TemplatesDir = templatesDir
+		fs.TemplateTTL = time.Hour
+		mfs = fs
+	})
+	defer cleanup()
+
+	var requests int32
+	mux.HandleFunc("/meta-data/instance-id", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, "i-123456")
+	})
+
+	read := func(expected string, expectedRequests int32) {
+		t.Helper()
+		if contents, err := ioutil.ReadFile(path.Join(dir, "id")); err != nil || string(contents) != expected {
+			t.Errorf(`read id: %q, %v, expected %q`, contents, err, expected)
+		}
+		if n := atomic.LoadInt32(&requests); n != expectedRequests {
+			t.Errorf(`made %d requests, expected %d`, n, expectedRequests)
+		}
+	}
+
+	read("i-123456", 1)
+	read("i-123456", 1)
+
+	// modifying the template renders it again
+	if err := ioutil.WriteFile(template, []byte(`id={{meta "meta-data/instance-id"}}`), 0644); err != nil {
+		t.Fatalf("writing template failed: %v", err)
+	}
+	modified := time.Now().Add(time.Minute)
+	if err := os.Chtimes(template, modified, modified); err != nil {
+		t.Fatalf("changing template times failed: %v", err)
+	}
+	read("id=i-123456", 2)
+
+	// as does invalidating it
+	mfs.DropContent(func(name string) bool { return name == "id" })
+	read("id=i-123456", 3)
+	read("id=i-123456", 3)
+}
+
+func TestMetadatFs_templates_noTags(t *testing.T) {
+	templatesDir, err := ioutil.TempDir("", "ec2metadata-templates")
+	if err != nil {
+		t.Fatalf("creating tempdir failed: %v", err)
+	}
+	defer os.RemoveAll(templatesDir)
+	if err := ioutil.WriteFile(path.Join(templatesDir, "name"), []byte(`{{tag "Name"}}`), 0644); err != nil {
+		t.Fatalf("writing template failed: %v", err)
+	}
+
+	_, dir, cleanup := setupWith(t, func(fs *MetadataFs) {
+		fs.TemplatesDir = templatesDir
+	})
+	defer cleanup()
+
+	if _, err := ioutil.ReadFile(path.Join(dir, "name")); !errors.Is(err, syscall.EIO) {
+		t.Errorf(`expected EIO, got %v`, err)
+	}
+}
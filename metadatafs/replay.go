@@ -0,0 +1,185 @@
+package metadatafs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+)
+
+// FUSE has no way for a filesystem to raise inotify events itself: the
+// kernel only generates them for operations that go through the VFS. To wake
+// up inotify watchers, changes found by a Watcher are replayed through the
+// mount by writing to, creating or unlinking the changed file. While a change
+// is being replayed, the filesystem accepts those operations for its path
+// from its own process and discards them. Everyone else still gets EPERM.
+//
+// Directories, like meta-data/events/maintenance/scheduled, are touched
+// instead, which raises IN_ATTRIB for watchers of the directory. Directories
+// appearing upstream are not replayed, as nobody can be watching them yet.
+
+// replay is a change being replayed through the mount
+type replay struct {
+	change Change
+
+	// created is set once an appearing file has been created, after which
+	// its real attributes are returned
+	created bool
+}
+
+// replayChange performs the operation on the mount matching c
+func (fs *MetadataFs) replayChange(c Change) {
+	if fs.Mountpoint == "" || isDir(c.Path) && c.Appeared() {
+		return
+	}
+
+	fs.replaysMu.Lock()
+	if fs.replays == nil {
+		fs.replays = map[string]*replay{}
+	}
+	fs.replays[c.Path] = &replay{change: c}
+	fs.replaysMu.Unlock()
+
+	defer func() {
+		fs.replaysMu.Lock()
+		delete(fs.replays, c.Path)
+		fs.replaysMu.Unlock()
+	}()
+
+	name := filepath.Join(fs.Mountpoint, c.Path)
+
+	var err error
+	switch {
+	case isDir(c.Path):
+		now := time.Now()
+		err = os.Chtimes(name, now, now)
+	case c.Disappeared():
+		err = syscall.Unlink(name)
+	case c.Appeared():
+		err = writeFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, c.New)
+	default:
+		err = writeFile(name, os.O_WRONLY, c.New)
+	}
+
+	if err != nil {
+		fs.Logger.Warningf("failed to replay change to %s for inotify watchers: %s", c.Path, err)
+	}
+}
+
+func writeFile(name string, flag int, data []byte) error {
+	f, err := os.OpenFile(name, flag, 0444)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// pendingReplay returns the change being replayed for name, if any and if
+// the request comes from this process
+func (fs *MetadataFs) pendingReplay(name string, context *fuse.Context) *replay {
+	if !replaying(context) {
+		return nil
+	}
+
+	fs.replaysMu.Lock()
+	defer fs.replaysMu.Unlock()
+
+	return fs.replays[name]
+}
+
+// replaying reports whether a request was made by this process, and so can
+// be part of a replay. The kernel passes the ID of the calling thread, which
+// is only the process ID for the main thread.
+func replaying(context *fuse.Context) bool {
+	if context == nil {
+		return false
+	}
+	if context.Pid == uint32(os.Getpid()) {
+		return true
+	}
+	_, err := os.Stat(fmt.Sprintf("/proc/self/task/%d", context.Pid))
+	return err == nil
+}
+
+// replayAttr returns the attributes seen by the kernel while replaying a
+// change, and false if the real attributes should be used
+func (fs *MetadataFs) replayAttr(name string) (*fuse.Attr, fuse.Status, bool) {
+	fs.replaysMu.Lock()
+	defer fs.replaysMu.Unlock()
+
+	r := fs.replays[name]
+	switch {
+	case r == nil:
+		return nil, fuse.OK, false
+	case r.change.Appeared() && !r.created:
+		return nil, fuse.ENOENT, true
+	case r.change.Disappeared() && isDir(name):
+		return &fuse.Attr{Mode: fuse.S_IFDIR | 0555}, fuse.OK, true
+	case r.change.Disappeared():
+		return &fuse.Attr{Size: uint64(len(r.change.Old)), Mode: fuse.S_IFREG | 0444}, fuse.OK, true
+	default:
+		return nil, fuse.OK, false
+	}
+}
+
+// Create accepts the creation of a file that is appearing upstream
+func (fs *MetadataFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if !replaying(context) {
+		return fs.FileSystem.Create(name, flags, mode, context)
+	}
+
+	fs.replaysMu.Lock()
+	defer fs.replaysMu.Unlock()
+
+	r := fs.replays[name]
+	if r == nil || !r.change.Appeared() {
+		return fs.FileSystem.Create(name, flags, mode, context)
+	}
+
+	r.created = true
+	return newDiscardFile(), fuse.OK
+}
+
+// Unlink accepts the removal of a file that is disappearing upstream
+func (fs *MetadataFs) Unlink(name string, context *fuse.Context) fuse.Status {
+	if r := fs.pendingReplay(name, context); r == nil || !r.change.Disappeared() {
+		return fs.FileSystem.Unlink(name, context)
+	}
+
+	return fuse.OK
+}
+
+// Utimens accepts touching a directory that changed upstream
+func (fs *MetadataFs) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if r := fs.pendingReplay(name, context); r == nil || !isDir(name) {
+		return fs.FileSystem.Utimens(name, atime, mtime, context)
+	}
+
+	return fuse.OK
+}
+
+// discardFile accepts and drops writes replaying a change
+type discardFile struct {
+	nodefs.File
+}
+
+func newDiscardFile() nodefs.File {
+	return &discardFile{File: nodefs.NewDefaultFile()}
+}
+
+func (f *discardFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	return uint32(len(data)), fuse.OK
+}
+
+func (f *discardFile) Flush() fuse.Status {
+	return fuse.OK
+}
@@ -0,0 +1,213 @@
+package metadatafs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+)
+
+// The hidden .snapshot.json file at the root holds the whole tree as a single
+// JSON object, with an object per directory and a string per file, e.g.
+// {"meta-data": {"instance-id": "i-123456", ...}, ...}. It is generated by
+// walking the tree when the file is opened, so every reader gets a document
+// taken at one point in time. Paths that vanish during the walk are left out,
+// any other error fails the open.
+//
+// The sensitive paths, which hold credentials or commonly secrets, are left
+// out unless SnapshotSensitive is set.
+
+// snapshotFile is the name of the snapshot at the root
+const snapshotFile = ".snapshot.json"
+
+// snapshotConcurrency is how many requests the walk makes at once
+const snapshotConcurrency = 16
+
+// sensitivePaths are the paths left out of the snapshot by default, along
+// with everything beneath them
+var sensitivePaths = []string{
+	"user-data",
+	"meta-data/iam/security-credentials",
+	"meta-data/identity-credentials",
+	"dynamic/instance-identity/pkcs7",
+	"dynamic/instance-identity/rsa2048",
+	"dynamic/instance-identity/signature",
+}
+
+// isSensitive reports whether name is or is beneath a sensitive path
+func isSensitive(name string) bool {
+	for _, p := range sensitivePaths {
+		if name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshotAttr returns the attributes of the snapshot, ok is false for other
+// paths. The size is not known without generating it, so it is reported
+// as empty and the file is opened with direct I/O.
+func (fs *MetadataFs) snapshotAttr(name string) (attr *fuse.Attr, code fuse.Status, ok bool) {
+	if name != snapshotFile {
+		return nil, fuse.OK, false
+	}
+	return &fuse.Attr{Mode: fuse.S_IFREG | 0444}, fuse.OK, true
+}
+
+// snapshotOpen generates the snapshot, ok is false for other paths
+func (fs *MetadataFs) snapshotOpen(name string, flags uint32) (file nodefs.File, code fuse.Status, ok bool) {
+	if name != snapshotFile {
+		return nil, fuse.OK, false
+	}
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM, true
+	}
+
+	tree, err := fs.snapshot()
+	if err != nil {
+		fs.Logger.Errorf("failed to generate %s: %s", snapshotFile, err)
+		return nil, fuse.EIO, true
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(tree); err != nil {
+		fs.Logger.Errorf("failed to encode %s: %s", snapshotFile, err)
+		return nil, fuse.EIO, true
+	}
+
+	return &nodefs.WithFlags{
+		File:      nodefs.NewDataFile(buf.Bytes()),
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, fuse.OK, true
+}
+
+// snapshotWalk is a concurrent walk of the tree
+type snapshotWalk struct {
+	fs        *MetadataFs
+	sensitive bool
+	sem       chan struct{}
+	wg        sync.WaitGroup
+
+	mu     sync.Mutex
+	dirs   []string
+	values map[string]string
+	err    error
+}
+
+// snapshot walks the tree and returns it as nested maps of values
+func (fs *MetadataFs) snapshot() (map[string]interface{}, error) {
+	w := &snapshotWalk{
+		fs:        fs,
+		sensitive: fs.SnapshotSensitive,
+		sem:       make(chan struct{}, snapshotConcurrency),
+		values:    map[string]string{},
+	}
+
+	fs.Logger.Debugf("walking the metadata tree for %s", snapshotFile)
+	w.wg.Add(1)
+	go w.walkDir("")
+	w.wg.Wait()
+	if w.err != nil {
+		return nil, w.err
+	}
+
+	// directories come after their parents in dirs, as the walk only starts
+	// on the entries of a directory once it is recorded
+	root := map[string]interface{}{}
+	objects := map[string]map[string]interface{}{"": root}
+	for _, dir := range w.dirs {
+		if dir == "" {
+			continue
+		}
+		object := map[string]interface{}{}
+		objects[parentDir(dir)][path.Base(dir)] = object
+		objects[dir] = object
+	}
+	for name, value := range w.values {
+		objects[parentDir(name)][path.Base(name)] = value
+	}
+	return root, nil
+}
+
+// parentDir returns the directory containing name, "" at the root
+func parentDir(name string) string {
+	if dir := path.Dir(name); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// fail records the first error of the walk
+func (w *snapshotWalk) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// walkDir records the directory name and walks its entries
+func (w *snapshotWalk) walkDir(name string) {
+	defer w.wg.Done()
+
+	w.sem <- struct{}{}
+	entries, code := w.fs.OpenDir(name, nil)
+	<-w.sem
+
+	switch code {
+	case fuse.OK:
+	case fuse.ENOENT:
+		return
+	default:
+		w.fail(fmt.Errorf("listing %q: %s", name, code))
+		return
+	}
+
+	w.mu.Lock()
+	w.dirs = append(w.dirs, name)
+	w.mu.Unlock()
+
+	for _, entry := range entries {
+		child := path.Join(name, entry.Name)
+		if !w.sensitive && isSensitive(child) {
+			w.fs.Logger.Debugf("leaving sensitive path %s out of %s", child, snapshotFile)
+			continue
+		}
+
+		w.wg.Add(1)
+		if entry.Mode&fuse.S_IFDIR != 0 {
+			go w.walkDir(child)
+		} else {
+			go w.readFile(child)
+		}
+	}
+}
+
+// readFile records the value of the file name
+func (w *snapshotWalk) readFile(name string) {
+	defer w.wg.Done()
+
+	w.sem <- struct{}{}
+	value, err := w.fs.value(name)
+	<-w.sem
+
+	if err != nil {
+		w.fail(fmt.Errorf("reading %q: %s", name, err))
+		return
+	}
+	if value == nil {
+		return
+	}
+
+	w.mu.Lock()
+	w.values[name] = string(value)
+	w.mu.Unlock()
+}
@@ -0,0 +1,288 @@
+package metadatafs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/jszwedko/ec2-metadatafs/internal/fuseutil"
+)
+
+// Each file of TemplatesDir is a Go text/template that is shown at the root
+// under its name, less any .tmpl extension, and rendered when opened. Hidden
+// files, directories and templates named like an entry of the root are
+// skipped. The output is kept for TemplateTTL, but a template is rendered
+// again as soon as its file is modified, so templates can be edited without
+// remounting. Along with the standard functions, they can call:
+//
+//   - meta "path": the metadata value at path, e.g. meta "meta-data/instance-id"
+//   - tag "key": the value of the instance tag key, if tags are mounted
+//   - json "path": the metadata value at path parsed as JSON, e.g.
+//     (json "dynamic/instance-identity/document").region
+//
+// Values that do not exist are empty, or nil for json. Any other failure,
+// including errors in the template, fails the open with EIO.
+
+// templateExt is the extension left out of the names of templates
+const templateExt = ".tmpl"
+
+// reservedTemplateNames are the entries of the root that templates can't
+// shadow
+var reservedTemplateNames = map[string]bool{
+	"meta-data":   true,
+	"dynamic":     true,
+	"user-data":   true,
+	"tags":        true,
+	"instance":    true,
+	"autoscaling": true,
+	"ssm":         true,
+	"secrets":     true,
+}
+
+// TagLookup looks up the instance tags for the tag template function
+type TagLookup interface {
+	// Tag returns the value of a tag, ok is false if there is no such tag
+	Tag(ctx context.Context, key string) (value string, ok bool, err error)
+}
+
+// SetTags sets where the tag template function looks up tags. Until it is
+// set, tag fails.
+func (fs *MetadataFs) SetTags(tags TagLookup) {
+	fs.tagsMu.Lock()
+	defer fs.tagsMu.Unlock()
+	fs.tags = tags
+}
+
+// templates returns the paths of the templates by the name they are shown
+// under
+func (fs *MetadataFs) templates() (map[string]string, error) {
+	templates := map[string]string{}
+	if fs.TemplatesDir == "" {
+		return templates, nil
+	}
+
+	infos, err := ioutil.ReadDir(fs.TemplatesDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		name := strings.TrimSuffix(info.Name(), templateExt)
+		switch {
+		case strings.HasPrefix(info.Name(), "."), info.IsDir():
+			continue
+		case name == "" || reservedTemplateNames[name]:
+			fs.Logger.Debugf("skipping template %s, named like an entry of the root", info.Name())
+			continue
+		case templates[name] != "":
+			fs.Logger.Debugf("skipping template %s, %s is also named %s", info.Name(), filepath.Base(templates[name]), name)
+			continue
+		}
+		templates[name] = filepath.Join(fs.TemplatesDir, info.Name())
+	}
+	return templates, nil
+}
+
+// template returns the path of the template shown at name, ok is false if
+// there is none
+func (fs *MetadataFs) template(name string) (file string, ok bool) {
+	if fs.TemplatesDir == "" || name == "" || strings.Contains(name, "/") {
+		return "", false
+	}
+
+	templates, err := fs.templates()
+	if err != nil {
+		fs.Logger.Errorf("failed to read templates from %s: %s", fs.TemplatesDir, err)
+		return "", false
+	}
+	file, ok = templates[name]
+	return file, ok
+}
+
+// templateEntries returns the entries of the templates for the root listing
+func (fs *MetadataFs) templateEntries() []fuse.DirEntry {
+	templates, err := fs.templates()
+	if err != nil {
+		fs.Logger.Errorf("failed to read templates from %s: %s", fs.TemplatesDir, err)
+		return nil
+	}
+
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]fuse.DirEntry, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFREG})
+	}
+	return entries
+}
+
+// templateAttr returns the attributes of a template, ok is false for other
+// paths. Like the snapshot, it is reported as empty and opened with direct
+// I/O, and it was last modified when the template was.
+func (fs *MetadataFs) templateAttr(name string) (attr *fuse.Attr, code fuse.Status, ok bool) {
+	file, ok := fs.template(name)
+	if !ok {
+		return nil, fuse.OK, false
+	}
+
+	attr = &fuse.Attr{Mode: fuse.S_IFREG | 0444}
+	if info, err := os.Stat(file); err == nil {
+		modified := info.ModTime()
+		attr.SetTimes(nil, &modified, &modified)
+	}
+	return attr, fuse.OK, true
+}
+
+// templateOpen renders a template, ok is false for other paths
+func (fs *MetadataFs) templateOpen(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status, ok bool) {
+	path, ok := fs.template(name)
+	if !ok {
+		return nil, fuse.OK, false
+	}
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM, true
+	}
+
+	content, err := fs.renderCached(fuseutil.RequestContext(context), name, path)
+	if err != nil {
+		fs.Logger.Errorf("failed to render template %s: %s", name, err)
+		return nil, fuse.EIO, true
+	}
+
+	return &nodefs.WithFlags{
+		File:      nodefs.NewDataFile(content),
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, fuse.OK, true
+}
+
+// renderedTemplate is the output of a template kept for TemplateTTL
+type renderedTemplate struct {
+	content  []byte
+	modified time.Time
+	expires  time.Time
+}
+
+// renderCached returns the output of the template at path shown at name,
+// rendering it again if TemplateTTL has passed or the template was modified.
+// Failures are not kept.
+func (fs *MetadataFs) renderCached(ctx context.Context, name, path string) ([]byte, error) {
+	if fs.TemplateTTL == 0 {
+		return fs.render(ctx, path)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.renderedMu.Lock()
+	cached, ok := fs.rendered[name]
+	fs.renderedMu.Unlock()
+	if ok && cached.modified.Equal(info.ModTime()) && (fs.TemplateTTL < 0 || time.Now().Before(cached.expires)) {
+		return cached.content, nil
+	}
+
+	content, err := fs.render(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.renderedMu.Lock()
+	defer fs.renderedMu.Unlock()
+	if fs.rendered == nil {
+		fs.rendered = map[string]*renderedTemplate{}
+	}
+	fs.rendered[name] = &renderedTemplate{
+		content:  content,
+		modified: info.ModTime(),
+		expires:  time.Now().Add(fs.TemplateTTL),
+	}
+	return content, nil
+}
+
+// DropContent drops the rendered templates whose names match
+// Satisfies cachingfs.ContentCache
+func (fs *MetadataFs) DropContent(match func(name string) bool) {
+	fs.renderedMu.Lock()
+	defer fs.renderedMu.Unlock()
+
+	for name := range fs.rendered {
+		if match(name) {
+			delete(fs.rendered, name)
+		}
+	}
+}
+
+// render parses and executes the template at path
+func (fs *MetadataFs) render(ctx context.Context, path string) ([]byte, error) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := template.New(filepath.Base(path)).Funcs(fs.templateFuncs(ctx)).Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// templateFuncs returns the functions templates can call
+func (fs *MetadataFs) templateFuncs(ctx context.Context) template.FuncMap {
+	return template.FuncMap{
+		"meta": func(name string) (string, error) {
+			value, err := fs.value(strings.Trim(name, "/"))
+			if err != nil {
+				return "", fmt.Errorf("reading %q: %s", name, err)
+			}
+			return string(value), nil
+		},
+		"tag": func(key string) (string, error) {
+			fs.tagsMu.Lock()
+			tags := fs.tags
+			fs.tagsMu.Unlock()
+			if tags == nil {
+				return "", fmt.Errorf("reading tag %q: tags are not mounted", key)
+			}
+
+			value, _, err := tags.Tag(ctx, key)
+			if err != nil {
+				return "", fmt.Errorf("reading tag %q: %s", key, err)
+			}
+			return value, nil
+		},
+		"json": func(name string) (interface{}, error) {
+			value, err := fs.value(strings.Trim(name, "/"))
+			if err != nil {
+				return nil, fmt.Errorf("reading %q: %s", name, err)
+			}
+			if value == nil {
+				return nil, nil
+			}
+
+			var parsed interface{}
+			if err := json.Unmarshal(value, &parsed); err != nil {
+				return nil, fmt.Errorf("parsing %q: %s", name, err)
+			}
+			return parsed, nil
+		},
+	}
+}
@@ -0,0 +1,171 @@
+package metadatafs
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/jszwedko/ec2-metadatafs/logger"
+)
+
+// WaitFs mirrors a MetadataFs, except that opening a file that does not exist
+// yet blocks until it appears, and opening a directory blocks until its
+// listing changes. It is meant to be mounted at .wait so that scripts can
+// replace their sleep loops with e.g. `cat .wait/meta-data/spot/instance-action`.
+//
+// The waiting happens in open() rather than read() as pathfs only lets opens
+// be interrupted.
+//
+// poll() and select() are not implemented: go-fuse answers FUSE poll requests
+// with ENOSYS itself, without passing them to the RawFileSystem, and triggers
+// one while mounting so that the kernel stops sending them, so they report the
+// files as ready immediately.
+// Satisfies pathfs.FileSystem
+type WaitFs struct {
+	pathfs.FileSystem
+
+	Metadata *MetadataFs
+
+	// Interval is how often the metadata service is polled while waiting
+	Interval time.Duration
+
+	// Timeout, if not 0, is how long to wait before failing with ETIMEDOUT
+	Timeout time.Duration
+
+	Logger logger.LeveledLogger
+}
+
+// NewWaitFs returns a WaitFs for the given MetadataFs
+func NewWaitFs(metadata *MetadataFs, interval, timeout time.Duration, l logger.LeveledLogger) *WaitFs {
+	return &WaitFs{
+		FileSystem: pathfs.NewReadonlyFileSystem(pathfs.NewDefaultFileSystem()),
+		Metadata:   metadata,
+		Interval:   interval,
+		Timeout:    timeout,
+		Logger:     l,
+	}
+}
+
+// GetAttr returns a directory for the paths known to be directories and an
+// empty file for everything else, as files can be waited for before they
+// exist
+func (fs *WaitFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if isDir(name) {
+		return &fuse.Attr{Size: 4096, Mode: fuse.S_IFDIR | 0555}, fuse.OK
+	}
+	return &fuse.Attr{Mode: fuse.S_IFREG | 0444}, fuse.OK
+}
+
+// OpenDir returns the listing of name once it differs from the current one
+func (fs *WaitFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	old, code := fs.Metadata.OpenDir(name, context)
+	if code != fuse.OK && code != fuse.ENOENT {
+		return nil, code
+	}
+
+	var entries []fuse.DirEntry
+	code = fs.wait(name, context, func() (bool, fuse.Status) {
+		var code fuse.Status
+		entries, code = fs.Metadata.OpenDir(name, context)
+		switch code {
+		case fuse.OK:
+			return !sameDirEntries(old, entries), fuse.OK
+		case fuse.ENOENT:
+			return false, fuse.OK
+		default:
+			return false, code
+		}
+	})
+
+	return entries, code
+}
+
+// Open returns the content of name, waiting for it to exist if it does not
+// yet. With O_NONBLOCK it fails with EAGAIN instead of waiting.
+func (fs *WaitFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EACCES
+	}
+
+	value, err := fs.Metadata.value(name)
+	if err != nil {
+		fs.Logger.Errorf("failed to query AWS metadata API: %s", err)
+		return nil, fuse.EIO
+	}
+
+	if value == nil {
+		if flags&syscall.O_NONBLOCK != 0 {
+			return nil, fuse.Status(syscall.EAGAIN)
+		}
+
+		code := fs.wait(name, context, func() (bool, fuse.Status) {
+			value, err = fs.Metadata.value(name)
+			if err != nil {
+				fs.Logger.Errorf("failed to query AWS metadata API: %s", err)
+				return false, fuse.EIO
+			}
+			return value != nil, fuse.OK
+		})
+		if code != fuse.OK {
+			return nil, code
+		}
+	}
+
+	// the size reported by GetAttr is meaningless, so don't let the kernel
+	// rely on it
+	return &nodefs.WithFlags{
+		File:      nodefs.NewDataFile(value),
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, fuse.OK
+}
+
+// wait calls done every Interval until it returns true or an error, the
+// Timeout passes or the request is interrupted
+func (fs *WaitFs) wait(name string, context *fuse.Context, done func() (bool, fuse.Status)) fuse.Status {
+	var cancel <-chan struct{}
+	if context != nil {
+		cancel = context.Cancel
+	}
+
+	var timeout <-chan time.Time
+	if fs.Timeout > 0 {
+		timer := time.NewTimer(fs.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	ticker := time.NewTicker(fs.Interval)
+	defer ticker.Stop()
+
+	fs.Logger.Debugf("waiting for %s to change", name)
+	for {
+		select {
+		case <-cancel:
+			return fuse.EINTR
+		case <-timeout:
+			fs.Logger.Debugf("timed out waiting for %s to change", name)
+			return fuse.Status(syscall.ETIMEDOUT)
+		case <-ticker.C:
+		}
+
+		if ok, code := done(); code != fuse.OK || ok {
+			return code
+		}
+	}
+}
+
+// sameDirEntries reports whether two listings have the same entries in the
+// same order
+func sameDirEntries(a, b []fuse.DirEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Mode != b[i].Mode {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,158 @@
+package metadatafs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jszwedko/ec2-metadatafs/logger"
+)
+
+// Change describes a watched path appearing, changing or disappearing
+type Change struct {
+	Path string
+
+	// Old is nil if the path did not exist before
+	Old []byte
+	// New is nil if the path no longer exists
+	New []byte
+
+	Time time.Time
+}
+
+// Appeared returns whether the path did not exist before the change
+func (c Change) Appeared() bool {
+	return c.Old == nil
+}
+
+// Disappeared returns whether the path no longer exists after the change
+func (c Change) Disappeared() bool {
+	return c.New == nil
+}
+
+// Watcher polls a set of paths from the metadata service and tells its
+// subscribers whenever one appears, changes or disappears
+//
+// FUSE has no way of learning about changes made upstream, so this is what
+// allows programs using inotify on the mount to wake up (see
+// MetadataFs.Notify)
+type Watcher struct {
+	Client   MetadataClient
+	Paths    []string
+	Interval time.Duration
+	Logger   logger.LeveledLogger
+
+	mu          sync.Mutex
+	values      map[string][]byte
+	subscribers []func(Change)
+}
+
+// NewWatcher returns a Watcher polling the given paths every interval
+func NewWatcher(client MetadataClient, paths []string, interval time.Duration, l logger.LeveledLogger) *Watcher {
+	return &Watcher{
+		Client:   client,
+		Paths:    paths,
+		Interval: interval,
+		Logger:   l,
+		values:   map[string][]byte{},
+	}
+}
+
+// Subscribe registers f to be called with every change found. Subscribers
+// are called in the order they subscribed, from the polling goroutine.
+func (w *Watcher) Subscribe(f func(Change)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.subscribers = append(w.subscribers, f)
+}
+
+// Value returns the last value seen for a watched path and whether it
+// existed. ok is false if the path is not watched or has not been polled yet.
+func (w *Watcher) Value(path string) (value []byte, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	value, ok = w.values[path]
+	return value, ok
+}
+
+// Run polls the watched paths every interval until stop is closed
+func (w *Watcher) Run(stop <-chan struct{}) {
+	w.Poll()
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.Poll()
+		}
+	}
+}
+
+// Poll fetches every watched path once, notifying subscribers of any that
+// changed since the last poll. The first poll of a path only records its
+// value.
+func (w *Watcher) Poll() {
+	for _, path := range w.Paths {
+		value, err := FetchValue(w.Client, path)
+		if err != nil {
+			w.Logger.Warningf("failed to poll %s for changes: %s", path, err)
+			continue
+		}
+
+		w.mu.Lock()
+		old, seen := w.values[path]
+		w.values[path] = value
+		subscribers := w.subscribers
+		w.mu.Unlock()
+
+		if !seen || sameValue(old, value) {
+			continue
+		}
+
+		w.Logger.Debugf("detected change to watched path %s", path)
+		change := Change{Path: path, Old: old, New: value, Time: time.Now()}
+		for _, f := range subscribers {
+			f(change)
+		}
+	}
+}
+
+// sameValue compares two values, telling a missing path apart from an empty
+// file
+func sameValue(a, b []byte) bool {
+	return (a == nil) == (b == nil) && string(a) == string(b)
+}
+
+// FetchValue returns the current value of path, or nil if it does not exist.
+// Any status other than 200 and 404 is an error.
+func FetchValue(client MetadataClient, path string) ([]byte, error) {
+	resp, err := client.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, nil
+	case http.StatusOK:
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if body == nil {
+			body = []byte{}
+		}
+		return body, nil
+	default:
+		return nil, fmt.Errorf("unexpected HTTP status code from AWS metadata API: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,345 @@
+package secretsfs
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/jszwedko/ec2-metadatafs/internal/fuseutil"
+	"github.com/jszwedko/ec2-metadatafs/logger"
+)
+
+// The filesystem shows an allowlist of secrets, each as a directory named by
+// the secret's name or ARN as given, holding:
+//
+//   - AWSCURRENT and AWSPREVIOUS: the value of the secret version with that
+//     stage, left out if there is none
+//   - keys/<key>: the fields of AWSCURRENT if it is a JSON object, strings as
+//     is and other values as JSON
+//
+// Secret names and keys are escaped like tag keys, with fuseutil.EscapeName:
+// "%" as "%25", "/" as "%2F" and the names "." and ".." as "%2E" and "%2E%2E".
+//
+// Secrets are described again every RefreshInterval, and earlier once their
+// next scheduled rotation is due. Versions are only fetched when the version
+// IDs of their stages change, and while a rotation is in progress, i.e. a
+// version has the AWSPENDING stage, the secret is described again every
+// pendingRefreshInterval so that the new AWSCURRENT shows up quickly.
+//
+// As with SSM parameters, only the owner of the mount and root can read the
+// values and list the directories.
+
+// Version stages shown
+const (
+	currentStage  = "AWSCURRENT"
+	previousStage = "AWSPREVIOUS"
+	pendingStage  = "AWSPENDING"
+)
+
+// keysDir holds the fields of a JSON secret
+const keysDir = "keys"
+
+// pendingRefreshInterval is how often a secret being rotated is described
+const pendingRefreshInterval = 10 * time.Second
+
+// SecretsManagerAPI is the part of the Secrets Manager API client used
+// Satisfied by *secretsmanager.Client
+type SecretsManagerAPI interface {
+	DescribeSecret(ctx context.Context, params *secretsmanager.DescribeSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DescribeSecretOutput, error)
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// SecretsFs represents a filesystem that exposes Secrets Manager secrets
+// Satisfies pathfs.FileSystem
+type SecretsFs struct {
+	pathfs.FileSystem
+
+	Client SecretsManagerAPI
+	Logger logger.LeveledLogger
+
+	// RefreshInterval is how long a secret is served before it is described
+	// again, 0 to describe it on every access
+	RefreshInterval time.Duration
+
+	secrets map[string]*secret
+	names   []string
+}
+
+// secret is an allowlisted secret and the versions of it last fetched
+type secret struct {
+	id string
+
+	mu       sync.Mutex
+	values   map[string][]byte
+	versions map[string]string
+	expires  time.Time
+}
+
+// New initializes a new SecretsFs for the secrets with the given names or
+// ARNs
+func New(client SecretsManagerAPI, ids []string, l logger.LeveledLogger) *SecretsFs {
+	fs := &SecretsFs{
+		FileSystem: pathfs.NewReadonlyFileSystem(pathfs.NewDefaultFileSystem()),
+		Client:     client,
+		Logger:     l,
+		secrets:    map[string]*secret{},
+	}
+	for _, id := range ids {
+		name := fuseutil.EscapeName(id)
+		if _, ok := fs.secrets[name]; ok {
+			continue
+		}
+		fs.secrets[name] = &secret{id: id}
+		fs.names = append(fs.names, name)
+	}
+	sort.Strings(fs.names)
+	return fs
+}
+
+// stages returns the values of a secret by stage, describing it again and
+// fetching the versions that changed if it has expired
+func (fs *SecretsFs) stages(ctx context.Context, s *secret) (map[string][]byte, fuse.Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.values != nil && time.Now().Before(s.expires) {
+		return s.values, fuse.OK
+	}
+
+	if err := fs.refresh(ctx, s); err != nil {
+		fs.Logger.Errorf("failed to query AWS API for secret %s: %s", s.id, err)
+		return nil, fuseutil.ErrorStatus(err, errorCodes)
+	}
+	return s.values, fuse.OK
+}
+
+// refresh describes a secret and fetches the versions of the shown stages
+// that were not already fetched
+func (fs *SecretsFs) refresh(ctx context.Context, s *secret) error {
+	fs.Logger.Debugf("issuing request to AWS API to describe secret %s", s.id)
+
+	out, err := fs.Client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(s.id)})
+	if err != nil {
+		return err
+	}
+
+	versions := map[string]string{}
+	pending := false
+	for versionID, stages := range out.VersionIdsToStages {
+		for _, stage := range stages {
+			switch stage {
+			case currentStage, previousStage:
+				versions[stage] = versionID
+			case pendingStage:
+				pending = true
+			}
+		}
+	}
+
+	// versions move between stages on rotation, so reuse them by ID
+	fetched := map[string][]byte{}
+	for stage, versionID := range s.versions {
+		fetched[versionID] = s.values[stage]
+	}
+
+	values := map[string][]byte{}
+	for stage, versionID := range versions {
+		if value, ok := fetched[versionID]; ok {
+			values[stage] = value
+			continue
+		}
+
+		fs.Logger.Debugf("issuing request to AWS API for %s of secret %s", stage, s.id)
+		version, err := fs.Client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+			SecretId:  aws.String(s.id),
+			VersionId: aws.String(versionID),
+		})
+		if err != nil {
+			return err
+		}
+		if version.SecretString != nil {
+			values[stage] = []byte(*version.SecretString)
+		} else {
+			values[stage] = version.SecretBinary
+		}
+	}
+
+	now := time.Now()
+	s.expires = now.Add(fs.RefreshInterval)
+	if next := out.NextRotationDate; next != nil && next.After(now) && next.Before(s.expires) {
+		s.expires = *next
+	}
+	if pending && fs.RefreshInterval > pendingRefreshInterval {
+		s.expires = now.Add(pendingRefreshInterval)
+	}
+	s.values = values
+	s.versions = versions
+	return nil
+}
+
+// keys returns the fields of a secret value by escaped name, ok is false if
+// it is not a JSON object
+func keys(value []byte) (fields map[string][]byte, ok bool) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(value, &object); err != nil || object == nil {
+		return nil, false
+	}
+
+	fields = make(map[string][]byte, len(object))
+	for key, raw := range object {
+		if key == "" {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			fields[fuseutil.EscapeName(key)] = []byte(s)
+		} else {
+			fields[fuseutil.EscapeName(key)] = raw
+		}
+	}
+	return fields, true
+}
+
+// lookup returns the contents of the file at name, isDir is true if it is the
+// directory of a secret or its keys directory. The directories of allowlisted
+// secrets exist without looking the secrets up.
+func (fs *SecretsFs) lookup(ctx context.Context, name string) (contents []byte, isDir bool, code fuse.Status) {
+	components := strings.Split(name, "/")
+	s, ok := fs.secrets[components[0]]
+	if !ok || len(components) > 3 {
+		return nil, false, fuse.ENOENT
+	}
+	if len(components) == 1 {
+		return nil, true, fuse.OK
+	}
+
+	values, code := fs.stages(ctx, s)
+	if code != fuse.OK {
+		return nil, false, code
+	}
+
+	switch {
+	case components[1] == keysDir:
+		fields, ok := keys(values[currentStage])
+		if !ok {
+			return nil, false, fuse.ENOENT
+		}
+		if len(components) == 2 {
+			return nil, true, fuse.OK
+		}
+		value, ok := fields[components[2]]
+		if !ok {
+			return nil, false, fuse.ENOENT
+		}
+		return value, false, fuse.OK
+	case len(components) == 2:
+		value, ok := values[components[1]]
+		if !ok {
+			return nil, false, fuse.ENOENT
+		}
+		return value, false, fuse.OK
+	default:
+		return nil, false, fuse.ENOENT
+	}
+}
+
+// GetAttr returns the attributes of a secret value or directory
+func (fs *SecretsFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if name == "" {
+		return fuseutil.OwnedAttr(&fuse.Attr{Size: 4096, Mode: fuse.S_IFDIR | 0500}), fuse.OK
+	}
+
+	contents, isDir, code := fs.lookup(fuseutil.RequestContext(context), name)
+	if code != fuse.OK {
+		return nil, code
+	}
+	if isDir {
+		return fuseutil.OwnedAttr(&fuse.Attr{Size: 4096, Mode: fuse.S_IFDIR | 0500}), fuse.OK
+	}
+	return fuseutil.OwnedAttr(&fuse.Attr{Size: uint64(len(contents)), Mode: fuse.S_IFREG | 0400}), fuse.OK
+}
+
+// OpenDir lists the secrets, the stages of a secret or the keys of a JSON
+// secret
+func (fs *SecretsFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if !fuseutil.Allowed(context) {
+		return nil, fuse.EACCES
+	}
+
+	if name == "" {
+		entries := make([]fuse.DirEntry, 0, len(fs.names))
+		for _, name := range fs.names {
+			entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFDIR})
+		}
+		return entries, fuse.OK
+	}
+
+	components := strings.Split(name, "/")
+	s, ok := fs.secrets[components[0]]
+	if !ok || len(components) > 2 || (len(components) == 2 && components[1] != keysDir) {
+		return nil, fuse.ENOENT
+	}
+
+	values, code := fs.stages(fuseutil.RequestContext(context), s)
+	if code != fuse.OK {
+		return nil, code
+	}
+
+	entries := []fuse.DirEntry{}
+	if len(components) == 1 {
+		for _, stage := range []string{currentStage, previousStage} {
+			if _, ok := values[stage]; ok {
+				entries = append(entries, fuse.DirEntry{Name: stage, Mode: fuse.S_IFREG})
+			}
+		}
+		if _, ok := keys(values[currentStage]); ok {
+			entries = append(entries, fuse.DirEntry{Name: keysDir, Mode: fuse.S_IFDIR})
+		}
+		return entries, fuse.OK
+	}
+
+	fields, ok := keys(values[currentStage])
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	for key := range fields {
+		entries = append(entries, fuse.DirEntry{Name: key, Mode: fuse.S_IFREG})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, fuse.OK
+}
+
+// Open returns a secret value or the value of a key
+func (fs *SecretsFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	if !fuseutil.Allowed(context) {
+		return nil, fuse.EACCES
+	}
+
+	contents, isDir, code := fs.lookup(fuseutil.RequestContext(context), name)
+	if code != fuse.OK {
+		return nil, code
+	}
+	if isDir {
+		return nil, fuse.EISDIR
+	}
+	return nodefs.NewDataFile(contents), fuse.OK
+}
+
+// errorCodes maps the error codes of the Secrets Manager API to errnos
+var errorCodes = map[string]fuse.Status{
+	"AccessDeniedException":     fuse.EACCES,
+	"DecryptionFailure":         fuse.EACCES,
+	"ThrottlingException":       fuse.EAGAIN,
+	"ResourceNotFoundException": fuse.ENOENT,
+}
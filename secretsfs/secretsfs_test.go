@@ -0,0 +1,278 @@
+package secretsfs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/smithy-go"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jszwedko/ec2-metadatafs/internal/fusetest"
+	"github.com/jszwedko/ec2-metadatafs/internal/logging"
+)
+
+// fakeSecretsManager implements SecretsManagerAPI for a single secret,
+// recording the calls made as "describe" and "get <version id>"
+type fakeSecretsManager struct {
+	mu           sync.Mutex
+	name         string
+	values       map[string]string
+	stages       map[string][]string
+	nextRotation *time.Time
+	err          error
+	calls        []string
+}
+
+func (c *fakeSecretsManager) DescribeSecret(ctx context.Context, params *secretsmanager.DescribeSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DescribeSecretOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, "describe")
+	if c.err != nil {
+		return nil, c.err
+	}
+	if aws.ToString(params.SecretId) != c.name {
+		return nil, &smithy.GenericAPIError{Code: "ResourceNotFoundException", Message: "not found"}
+	}
+	return &secretsmanager.DescribeSecretOutput{
+		Name:               aws.String(c.name),
+		NextRotationDate:   c.nextRotation,
+		VersionIdsToStages: c.stages,
+	}, nil
+}
+
+func (c *fakeSecretsManager) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	versionID := aws.ToString(params.VersionId)
+	c.calls = append(c.calls, "get "+versionID)
+	value, ok := c.values[versionID]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "ResourceNotFoundException", Message: "not found"}
+	}
+	return &secretsmanager.GetSecretValueOutput{
+		Name:          aws.String(c.name),
+		SecretString:  aws.String(value),
+		VersionId:     aws.String(versionID),
+		VersionStages: c.stages[versionID],
+	}, nil
+}
+
+// rotate makes a new version current, as a completed rotation does
+func (c *fakeSecretsManager) rotate(versionID, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, stages := range c.stages {
+		switch {
+		case reflect.DeepEqual(stages, []string{currentStage}):
+			c.stages[id] = []string{previousStage}
+		default:
+			delete(c.stages, id)
+		}
+	}
+	c.values[versionID] = value
+	c.stages[versionID] = []string{currentStage}
+}
+
+func (c *fakeSecretsManager) reset() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	calls := c.calls
+	c.calls = nil
+	return calls
+}
+
+func newFakeSecretsManager() *fakeSecretsManager {
+	return &fakeSecretsManager{
+		name: "prod/db",
+		values: map[string]string{
+			"v1": `{"username": "app", "password": "hunter1", "port": 5432, "a/b": "c"}`,
+			"v2": `{"username": "app", "password": "hunter2", "port": 5432, "a/b": "c"}`,
+		},
+		stages: map[string][]string{
+			"v1": {previousStage},
+			"v2": {currentStage},
+		},
+	}
+}
+
+func setup(t *testing.T, client *fakeSecretsManager, configure func(*SecretsFs)) (dir string, cleanup func()) {
+	fs := New(client, []string{"prod/db", "missing"}, logging.NewLogger())
+	if configure != nil {
+		configure(fs)
+	}
+	return fusetest.Mount(t, fs)
+}
+
+func TestSecretsFs(t *testing.T) {
+	dir, cleanup := setup(t, newFakeSecretsManager(), nil)
+	defer cleanup()
+
+	if names := fusetest.Listing(t, dir); !reflect.DeepEqual([]string{"missing dr-x------", "prod%2Fdb dr-x------"}, names) {
+		t.Errorf(`returned entries %q`, names)
+	}
+	expected := []string{"AWSCURRENT -r--------", "AWSPREVIOUS -r--------", "keys dr-x------"}
+	if names := fusetest.Listing(t, path.Join(dir, "prod%2Fdb")); !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %q, expected %q`, names, expected)
+	}
+	expected = []string{"a%2Fb -r--------", "password -r--------", "port -r--------", "username -r--------"}
+	if names := fusetest.Listing(t, path.Join(dir, "prod%2Fdb", "keys")); !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %q, expected %q`, names, expected)
+	}
+
+	for name, expected := range map[string]string{
+		"AWSPREVIOUS":   `{"username": "app", "password": "hunter1", "port": 5432, "a/b": "c"}`,
+		"keys/password": "hunter2",
+		"keys/port":     "5432",
+		"keys/a%2Fb":    "c",
+	} {
+		contents, err := ioutil.ReadFile(path.Join(dir, "prod%2Fdb", name))
+		if err != nil || string(contents) != expected {
+			t.Errorf(`read %s: %q, %v, expected %q`, name, contents, err, expected)
+		}
+	}
+
+	info, err := os.Stat(path.Join(dir, "prod%2Fdb", "AWSCURRENT"))
+	if err != nil {
+		t.Fatalf(`error getting attributes: %s`, err)
+	}
+	if stat := info.Sys().(*syscall.Stat_t); stat.Uid != uint32(os.Getuid()) {
+		t.Errorf(`expected file to be owned by %d, got %d`, os.Getuid(), stat.Uid)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "missing", "AWSCURRENT")); !os.IsNotExist(err) {
+		t.Errorf(`expected missing secret not to exist, got %v`, err)
+	}
+	if _, err := os.Stat(path.Join(dir, "other")); !os.IsNotExist(err) {
+		t.Errorf(`expected secret that is not allowed not to exist, got %v`, err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "prod%2Fdb", "AWSCURRENT"), []byte("{}"), 0600); !errors.Is(err, syscall.EPERM) && !errors.Is(err, syscall.EACCES) {
+		t.Errorf(`expected writing a secret to fail, got %v`, err)
+	}
+}
+
+func TestSecretsFs_notJSON(t *testing.T) {
+	client := newFakeSecretsManager()
+	client.values["v2"] = "hunter2"
+	dir, cleanup := setup(t, client, nil)
+	defer cleanup()
+
+	expected := []string{"AWSCURRENT -r--------", "AWSPREVIOUS -r--------"}
+	if names := fusetest.Listing(t, path.Join(dir, "prod%2Fdb")); !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %q, expected %q`, names, expected)
+	}
+	if _, err := os.Stat(path.Join(dir, "prod%2Fdb", "keys")); !os.IsNotExist(err) {
+		t.Errorf(`expected keys not to exist, got %v`, err)
+	}
+}
+
+func TestSecretsFs_rotation(t *testing.T) {
+	client := newFakeSecretsManager()
+	dir, cleanup := setup(t, client, nil)
+	defer cleanup()
+
+	current := path.Join(dir, "prod%2Fdb", "AWSCURRENT")
+	if _, err := ioutil.ReadFile(current); err != nil {
+		t.Fatalf(`error reading secret: %s`, err)
+	}
+	client.reset()
+
+	// unchanged versions are not fetched again
+	if _, err := ioutil.ReadFile(current); err != nil {
+		t.Fatalf(`error reading secret: %s`, err)
+	}
+	for _, call := range client.reset() {
+		if call != "describe" {
+			t.Errorf(`expected only describes, got %q`, call)
+		}
+	}
+
+	client.rotate("v3", "hunter3")
+	contents, err := ioutil.ReadFile(current)
+	if err != nil || string(contents) != "hunter3" {
+		t.Errorf(`read AWSCURRENT: %q, %v, expected "hunter3"`, contents, err)
+	}
+	contents, err = ioutil.ReadFile(path.Join(dir, "prod%2Fdb", "keys", "password"))
+	if !os.IsNotExist(err) {
+		t.Errorf(`expected keys of previous value to be gone, got %q, %v`, contents, err)
+	}
+	contents, err = ioutil.ReadFile(path.Join(dir, "prod%2Fdb", "AWSPREVIOUS"))
+	if err != nil || string(contents) != client.values["v2"] {
+		t.Errorf(`read AWSPREVIOUS: %q, %v`, contents, err)
+	}
+	for _, call := range client.reset() {
+		if call != "describe" && call != "get v3" {
+			t.Errorf(`expected only v3 to be fetched, got %q`, call)
+		}
+	}
+}
+
+func TestSecretsFs_expires(t *testing.T) {
+	fs := New(newFakeSecretsManager(), []string{"prod/db"}, logging.NewLogger())
+	fs.RefreshInterval = time.Hour
+	s := fs.secrets["prod%2Fdb"]
+
+	if err := fs.refresh(context.Background(), s); err != nil {
+		t.Fatalf(`error refreshing secret: %s`, err)
+	}
+	if remaining := time.Until(s.expires); remaining < 59*time.Minute {
+		t.Errorf(`expected secret to expire in an hour, expires in %s`, remaining)
+	}
+
+	client := fs.Client.(*fakeSecretsManager)
+	client.nextRotation = aws.Time(time.Now().Add(time.Minute))
+	if err := fs.refresh(context.Background(), s); err != nil {
+		t.Fatalf(`error refreshing secret: %s`, err)
+	}
+	if !s.expires.Equal(*client.nextRotation) {
+		t.Errorf(`expected secret to expire at the next rotation, expires at %s`, s.expires)
+	}
+}
+
+func TestSecretsFs_pendingRotation(t *testing.T) {
+	client := newFakeSecretsManager()
+	client.values["v3"] = "hunter3"
+	client.stages["v3"] = []string{pendingStage}
+	fs := New(client, []string{"prod/db"}, logging.NewLogger())
+	fs.RefreshInterval = time.Hour
+	s := fs.secrets["prod%2Fdb"]
+
+	values, code := fs.stages(context.Background(), s)
+	if code != fuse.OK || string(values[currentStage]) != client.values["v2"] {
+		t.Fatalf(`read AWSCURRENT: %q, %s, expected the value of v2`, values[currentStage], code)
+	}
+	if remaining := time.Until(s.expires); remaining > pendingRefreshInterval {
+		t.Errorf(`expected secret being rotated to expire within %s, expires in %s`, pendingRefreshInterval, remaining)
+	}
+
+	// once pendingRefreshInterval has passed, the finished rotation shows up
+	// and the secret is served for RefreshInterval again
+	client.rotate("v3", "hunter3")
+	s.expires = time.Now()
+	values, code = fs.stages(context.Background(), s)
+	if code != fuse.OK || string(values[currentStage]) != "hunter3" {
+		t.Errorf(`read AWSCURRENT: %q, %s, expected "hunter3"`, values[currentStage], code)
+	}
+	if remaining := time.Until(s.expires); remaining < 59*time.Minute {
+		t.Errorf(`expected rotated secret to expire in an hour, expires in %s`, remaining)
+	}
+}
+
+func TestSecretsFs_error(t *testing.T) {
+	client := newFakeSecretsManager()
+	client.err = &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "denied"}
+	dir, cleanup := setup(t, client, nil)
+	defer cleanup()
+
+	if _, err := ioutil.ReadFile(path.Join(dir, "prod%2Fdb", "AWSCURRENT")); !errors.Is(err, syscall.EACCES) {
+		t.Errorf(`expected EACCES, got %v`, err)
+	}
+}
@@ -0,0 +1,228 @@
+package ssmfs
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/jszwedko/ec2-metadatafs/internal/fuseutil"
+	"github.com/jszwedko/ec2-metadatafs/logger"
+)
+
+// The filesystem shows the parameters beneath Path, with the hierarchy of
+// their names as directories, so that the parameter /app/prod/db/host is the
+// file db/host with Path /app/prod. SecureString parameters are decrypted. A
+// parameter that is also the directory of other parameters is hidden.
+//
+// Parameter values may be secrets, so only the owner of the mount and root
+// can read files and list directories (see fuseutil.Allowed).
+
+// SSMAPI is the part of the SSM API client used
+// Satisfied by *ssm.Client
+type SSMAPI interface {
+	ssm.GetParametersByPathAPIClient
+}
+
+// SSMFs represents a filesystem that exposes SSM Parameter Store parameters
+// Satisfies pathfs.FileSystem
+type SSMFs struct {
+	pathfs.FileSystem
+
+	Client SSMAPI
+	Path   string
+	Logger logger.LeveledLogger
+
+	// RefreshInterval is how long the parameters are served before they are
+	// fetched again, 0 to fetch them on every access
+	RefreshInterval time.Duration
+
+	mu      sync.Mutex
+	tree    *tree
+	fetched time.Time
+}
+
+// tree is the parameters as files and directories
+type tree struct {
+	files map[string]string
+	dirs  map[string][]fuse.DirEntry
+}
+
+// New initializes a new SSMFs for the parameters beneath path
+func New(client SSMAPI, path string, l logger.LeveledLogger) *SSMFs {
+	return &SSMFs{
+		FileSystem: pathfs.NewReadonlyFileSystem(pathfs.NewDefaultFileSystem()),
+		Client:     client,
+		Path:       path,
+		Logger:     l,
+	}
+}
+
+// parameters returns the parameters, fetching them again if they are older
+// than RefreshInterval
+func (fs *SSMFs) parameters(ctx context.Context) (*tree, fuse.Status) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.tree != nil && time.Since(fs.fetched) < fs.RefreshInterval {
+		return fs.tree, fuse.OK
+	}
+
+	t, err := fs.fetch(ctx)
+	if err != nil {
+		fs.Logger.Errorf("failed to query AWS API for parameters: %s", err)
+		return nil, fuseutil.ErrorStatus(err, errorCodes)
+	}
+
+	fs.tree = t
+	fs.fetched = time.Now()
+	return t, fuse.OK
+}
+
+// fetch gets all of the parameters beneath Path
+func (fs *SSMFs) fetch(ctx context.Context) (*tree, error) {
+	prefix := "/" + strings.Trim(fs.Path, "/")
+	fs.Logger.Debugf("issuing request to AWS API for parameters beneath %s", prefix)
+
+	values := map[string]string{}
+	paginator := ssm.NewGetParametersByPathPaginator(fs.Client, &ssm.GetParametersByPathInput{
+		Path:           aws.String(prefix),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, parameter := range page.Parameters {
+			name := strings.TrimPrefix(aws.ToString(parameter.Name), strings.TrimSuffix(prefix, "/")+"/")
+			values[name] = aws.ToString(parameter.Value)
+		}
+	}
+
+	return fs.buildTree(values), nil
+}
+
+// buildTree lays out the parameters by relative name as files and
+// directories
+func (fs *SSMFs) buildTree(values map[string]string) *tree {
+	t := &tree{files: map[string]string{}, dirs: map[string][]fuse.DirEntry{"": {}}}
+
+	children := map[string]map[string]bool{"": {}}
+	for name := range values {
+		if name == "" || strings.Contains(name, "//") || strings.HasSuffix(name, "/") {
+			fs.Logger.Warningf("hiding parameter '%s' as it cannot be shown as a file", name)
+			continue
+		}
+		for dir := name; dir != "."; {
+			parent := path.Dir(dir)
+			if parent == "." {
+				parent = ""
+			}
+			if children[parent] == nil {
+				children[parent] = map[string]bool{}
+			}
+			children[parent][path.Base(dir)] = true
+			dir = path.Dir(dir)
+		}
+	}
+
+	for name, value := range values {
+		if _, isDir := children[name]; isDir {
+			fs.Logger.Warningf("hiding parameter '%s' as it is also a directory of other parameters", name)
+			continue
+		}
+		t.files[name] = value
+	}
+	for dir, names := range children {
+		entries := make([]fuse.DirEntry, 0, len(names))
+		for name := range names {
+			mode := uint32(fuse.S_IFREG)
+			if _, isDir := children[path.Join(dir, name)]; isDir {
+				mode = fuse.S_IFDIR
+			} else if _, ok := t.files[path.Join(dir, name)]; !ok {
+				continue
+			}
+			entries = append(entries, fuse.DirEntry{Name: name, Mode: mode})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		t.dirs[dir] = entries
+	}
+	return t
+}
+
+// GetAttr returns the attributes of a parameter or directory
+func (fs *SSMFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if name == "" {
+		return fuseutil.OwnedAttr(&fuse.Attr{Size: 4096, Mode: fuse.S_IFDIR | 0500}), fuse.OK
+	}
+
+	t, code := fs.parameters(fuseutil.RequestContext(context))
+	if code != fuse.OK {
+		return nil, code
+	}
+
+	if value, ok := t.files[name]; ok {
+		return fuseutil.OwnedAttr(&fuse.Attr{Size: uint64(len(value)), Mode: fuse.S_IFREG | 0400}), fuse.OK
+	}
+	if _, ok := t.dirs[name]; ok {
+		return fuseutil.OwnedAttr(&fuse.Attr{Size: 4096, Mode: fuse.S_IFDIR | 0500}), fuse.OK
+	}
+	return nil, fuse.ENOENT
+}
+
+// OpenDir lists the parameters and directories in a directory
+func (fs *SSMFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if !fuseutil.Allowed(context) {
+		return nil, fuse.EACCES
+	}
+
+	t, code := fs.parameters(fuseutil.RequestContext(context))
+	if code != fuse.OK {
+		return nil, code
+	}
+
+	entries, ok := t.dirs[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return entries, fuse.OK
+}
+
+// Open returns the value of a parameter
+func (fs *SSMFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	if !fuseutil.Allowed(context) {
+		return nil, fuse.EACCES
+	}
+
+	t, code := fs.parameters(fuseutil.RequestContext(context))
+	if code != fuse.OK {
+		return nil, code
+	}
+
+	value, ok := t.files[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return nodefs.NewDataFile([]byte(value)), fuse.OK
+}
+
+// errorCodes maps the error codes of the SSM API to errnos
+var errorCodes = map[string]fuse.Status{
+	"AccessDeniedException": fuse.EACCES,
+	"AccessDenied":          fuse.EACCES,
+	"UnauthorizedOperation": fuse.EACCES,
+	"ThrottlingException":   fuse.EAGAIN,
+	"Throttling":            fuse.EAGAIN,
+}
@@ -0,0 +1,180 @@
+package ssmfs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jszwedko/ec2-metadatafs/internal/fusetest"
+	"github.com/jszwedko/ec2-metadatafs/internal/logging"
+)
+
+// fakeSSM implements SSMAPI, returning the parameters beneath the requested
+// path two to a page and counting the calls
+type fakeSSM struct {
+	mu         sync.Mutex
+	parameters map[string]string
+	encrypted  map[string]bool
+	err        error
+	calls      int
+}
+
+func (c *fakeSSM) GetParametersByPath(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	prefix := strings.TrimSuffix(aws.ToString(params.Path), "/") + "/"
+	names := []string{}
+	for name := range c.parameters {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(aws.ToString(params.NextToken))
+	out := &ssm.GetParametersByPathOutput{}
+	for i := start; i < len(names) && i < start+2; i++ {
+		value := c.parameters[names[i]]
+		if c.encrypted[names[i]] && !aws.ToBool(params.WithDecryption) {
+			value = "AQICAHh...encrypted"
+		}
+		out.Parameters = append(out.Parameters, types.Parameter{Name: aws.String(names[i]), Value: aws.String(value)})
+	}
+	if start+2 < len(names) {
+		out.NextToken = aws.String(strconv.Itoa(start + 2))
+	}
+	return out, nil
+}
+
+func newFakeSSM() *fakeSSM {
+	return &fakeSSM{
+		parameters: map[string]string{
+			"/app/prod/db/host":     "db.internal",
+			"/app/prod/db/password": "hunter2",
+			"/app/prod/db/port":     "5432",
+			"/app/prod/name":        "web",
+			"/app/staging/name":     "web-staging",
+		},
+		encrypted: map[string]bool{"/app/prod/db/password": true},
+	}
+}
+
+func setup(t *testing.T, client *fakeSSM, configure func(*SSMFs)) (dir string, cleanup func()) {
+	fs := New(client, "/app/prod", logging.NewLogger())
+	if configure != nil {
+		configure(fs)
+	}
+	return fusetest.Mount(t, fs)
+}
+
+func TestSSMFs(t *testing.T) {
+	client := newFakeSSM()
+	dir, cleanup := setup(t, client, nil)
+	defer cleanup()
+
+	if names := fusetest.Listing(t, dir); !reflect.DeepEqual([]string{"db dr-x------", "name -r--------"}, names) {
+		t.Errorf(`returned entries %q`, names)
+	}
+	expected := []string{"host -r--------", "password -r--------", "port -r--------"}
+	if names := fusetest.Listing(t, path.Join(dir, "db")); !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %q, expected %q`, names, expected)
+	}
+
+	for name, expected := range map[string]string{
+		"name":        "web",
+		"db/host":     "db.internal",
+		"db/password": "hunter2",
+	} {
+		contents, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil || string(contents) != expected {
+			t.Errorf(`read %s: %q, %v, expected %q`, name, contents, err, expected)
+		}
+	}
+
+	info, err := os.Stat(path.Join(dir, "name"))
+	if err != nil {
+		t.Fatalf(`error getting attributes: %s`, err)
+	}
+	if stat := info.Sys().(*syscall.Stat_t); stat.Uid != uint32(os.Getuid()) {
+		t.Errorf(`expected file to be owned by %d, got %d`, os.Getuid(), stat.Uid)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "staging")); !os.IsNotExist(err) {
+		t.Errorf(`expected parameter beneath another path not to exist, got %v`, err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "name"), []byte("api"), 0600); !errors.Is(err, syscall.EPERM) && !errors.Is(err, syscall.EACCES) {
+		t.Errorf(`expected writing a parameter to fail, got %v`, err)
+	}
+}
+
+func TestSSMFs_RefreshInterval(t *testing.T) {
+	client := newFakeSSM()
+	dir, cleanup := setup(t, client, func(fs *SSMFs) {
+		fs.RefreshInterval = time.Hour
+	})
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		if _, err := ioutil.ReadFile(path.Join(dir, "db", "port")); err != nil {
+			t.Fatalf(`error reading parameter: %s`, err)
+		}
+	}
+	// three parameters beneath /app/prod, two to a page
+	if client.calls != 2 {
+		t.Errorf(`requested %d pages, expected 2`, client.calls)
+	}
+}
+
+func TestSSMFs_error(t *testing.T) {
+	client := newFakeSSM()
+	client.err = &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "denied"}
+	dir, cleanup := setup(t, client, nil)
+	defer cleanup()
+
+	if _, err := ioutil.ReadFile(path.Join(dir, "name")); !errors.Is(err, syscall.EACCES) {
+		t.Errorf(`expected EACCES, got %v`, err)
+	}
+}
+
+func TestSSMFs_buildTree(t *testing.T) {
+	fs := New(nil, "/", logging.NewLogger())
+	tree := fs.buildTree(map[string]string{
+		"a":     "1",
+		"a/b":   "2",
+		"c/d/e": "3",
+	})
+
+	expected := map[string]string{"a/b": "2", "c/d/e": "3"}
+	if !reflect.DeepEqual(expected, tree.files) {
+		t.Errorf(`built files %q, expected %q`, tree.files, expected)
+	}
+	for dir, expected := range map[string][]fuse.DirEntry{
+		"":  {{Name: "a", Mode: fuse.S_IFDIR}, {Name: "c", Mode: fuse.S_IFDIR}},
+		"a": {{Name: "b", Mode: fuse.S_IFREG}},
+		"c": {{Name: "d", Mode: fuse.S_IFDIR}},
+	} {
+		if !reflect.DeepEqual(expected, tree.dirs[dir]) {
+			t.Errorf(`built entries %v for %q, expected %v`, tree.dirs[dir], dir, expected)
+		}
+	}
+}
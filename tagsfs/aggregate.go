@@ -0,0 +1,158 @@
+package tagsfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/jszwedko/ec2-metadatafs/internal/fuseutil"
+)
+
+// The root of a TagsFs also holds two read-only files with all of the tags
+// shown, so that they can be read at once:
+//
+//   - tags.json: a JSON object of keys to values
+//   - tags.env: a TAG_<KEY>='value' line per tag, to be sourced by a shell.
+//     Keys are upper-cased, with characters other than letters, digits and _
+//     replaced with _. Of the keys that end up the same, the first in order
+//     is kept.
+//
+// Both are generated from a single snapshot of the tags when opened, if the
+// source is a SnapshotTagSource. Tags whose keys are named like these files
+// are only shown within them.
+
+const (
+	tagsJSONFile = "tags.json"
+	tagsEnvFile  = "tags.env"
+)
+
+// aggregateFiles generate the content of the aggregate files from the tags
+var aggregateFiles = map[string]func(fs *TagsFs, tags map[string]string) []byte{
+	tagsJSONFile: (*TagsFs).tagsJSON,
+	tagsEnvFile:  (*TagsFs).tagsEnv,
+}
+
+// isAggregate reports whether name is the path of an aggregate file
+func isAggregate(name string) bool {
+	_, ok := aggregateFiles[name]
+	return ok
+}
+
+// aggregate returns the content of the aggregate file at name
+func (fs *TagsFs) aggregate(ctx context.Context, name string) ([]byte, fuse.Status) {
+	tags, code := fs.snapshot(ctx)
+	if code != fuse.OK {
+		return nil, code
+	}
+	return aggregateFiles[name](fs, tags), fuse.OK
+}
+
+// aggregateAttr returns the attributes of the aggregate file at name
+func (fs *TagsFs) aggregateAttr(ctx context.Context, name string) (*fuse.Attr, fuse.Status) {
+	content, code := fs.aggregate(ctx, name)
+	if code != fuse.OK {
+		return nil, code
+	}
+	return &fuse.Attr{Size: uint64(len(content)), Mode: fuse.S_IFREG | 0444}, fuse.OK
+}
+
+// openAggregate returns the aggregate file at name, generated once
+func (fs *TagsFs) openAggregate(ctx context.Context, name string, flags uint32) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+
+	content, code := fs.aggregate(ctx, name)
+	if code != fuse.OK {
+		return nil, code
+	}
+
+	// the tags may have changed since GetAttr reported the size, so don't
+	// let the kernel rely on it
+	return &nodefs.WithFlags{
+		File:      nodefs.NewDataFile(content),
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, fuse.OK
+}
+
+// snapshot returns all of the tags shown, by the keys they are shown under
+func (fs *TagsFs) snapshot(ctx context.Context) (map[string]string, fuse.Status) {
+	source, ok := fs.Source.(SnapshotTagSource)
+	if !ok {
+		keys, code := fs.keys(ctx)
+		if code != fuse.OK {
+			return nil, code
+		}
+
+		tags := make(map[string]string, len(keys))
+		for _, key := range keys {
+			sourceKey, value, ok, err := fs.lookup(ctx, key)
+			if err != nil {
+				fs.Logger.Errorf("failed to read tag %s: %s", sourceKey, err)
+				return nil, errorStatus(err)
+			}
+			if ok {
+				tags[key] = value
+			}
+		}
+		return tags, fuse.OK
+	}
+
+	all, err := source.Tags(ctx)
+	if err != nil {
+		fs.Logger.Errorf("failed to list tags: %s", err)
+		return nil, errorStatus(err)
+	}
+
+	shown := fs.shownKeys(sortedKeys(all))
+	tags := make(map[string]string, len(shown))
+	for key, sourceKey := range shown {
+		tags[key] = all[sourceKey]
+	}
+	return tags, fuse.OK
+}
+
+// tagsJSON returns the tags as a JSON object
+func (fs *TagsFs) tagsJSON(tags map[string]string) []byte {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(tags)
+	return buf.Bytes()
+}
+
+// tagsEnv returns the tags as shell variable assignments
+func (fs *TagsFs) tagsEnv(tags map[string]string) []byte {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	names := map[string]string{}
+	for _, key := range keys {
+		name := envName(key)
+		if other, ok := names[name]; ok {
+			fs.Logger.Warningf("leaving tag '%s' out of %s as %s is already set from '%s'", key, tagsEnvFile, name, other)
+			continue
+		}
+		names[name] = key
+		fmt.Fprintf(&buf, "%s=%s\n", name, fuseutil.ShellQuote(tags[key]))
+	}
+	return buf.Bytes()
+}
+
+var envUnsafe = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// envName returns the name of the variable holding the tag with key
+func envName(key string) string {
+	return "TAG_" + envUnsafe.ReplaceAllString(strings.ToUpper(key), "_")
+}
@@ -0,0 +1,307 @@
+package tagsfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jszwedko/ec2-metadatafs/logger"
+)
+
+// Tags read from the AWS API are served from a snapshot of all of the
+// resource's tags, taken with a single paginated DescribeTags and retaken once
+// it is RefreshInterval old. When the API throttles the requests, the stale
+// snapshot keeps being served and refreshes back off exponentially.
+
+const (
+	// minRefreshBackoff is how long refreshes are held off after the first
+	// throttled request
+	minRefreshBackoff = time.Second
+
+	// maxRefreshBackoff caps how long refreshes are held off
+	maxRefreshBackoff = 5 * time.Minute
+)
+
+// EC2API is the part of the EC2 API client used for tags
+// Satisfied by *ec2.Client
+type EC2API interface {
+	ec2.DescribeTagsAPIClient
+	ec2.DescribeInstancesAPIClient
+	CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error)
+	DeleteTags(ctx context.Context, params *ec2.DeleteTagsInput, optFns ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error)
+}
+
+// EC2Source reads and writes the tags of an EC2 resource through the AWS API
+// Satisfies WritableTagSource, SnapshotTagSource and NotifyingTagSource
+type EC2Source struct {
+	Client     EC2API
+	ResourceID string
+	Logger     logger.LeveledLogger
+
+	// RefreshInterval is how long a snapshot of the tags is served before it
+	// is refreshed, 0 to refresh on every access
+	RefreshInterval time.Duration
+
+	mu       sync.Mutex
+	snapshot map[string]string
+	fetched  time.Time
+	backoff  time.Duration
+	retryAt  time.Time
+	onChange func(key string, old, new []byte)
+}
+
+// NewEC2Source initializes a new EC2Source for the resource with the given ID
+func NewEC2Source(client EC2API, resourceID string, l logger.LeveledLogger) *EC2Source {
+	return &EC2Source{
+		Client:     client,
+		ResourceID: resourceID,
+		Logger:     l,
+	}
+}
+
+// tags returns the tags of the resource, refreshing them if the snapshot is
+// older than RefreshInterval. The returned map must not be modified.
+func (s *EC2Source) tags(ctx context.Context) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.snapshot != nil && now.Sub(s.fetched) < s.RefreshInterval {
+		return s.snapshot, nil
+	}
+
+	if now.Before(s.retryAt) {
+		if s.snapshot != nil {
+			s.Logger.Debugf("serving stale tags, refreshes backed off until %s", s.retryAt)
+			return s.snapshot, nil
+		}
+		return nil, &StatusError{fuse.EAGAIN, fmt.Errorf("refreshes backed off until %s", s.retryAt)}
+	}
+
+	tags, err := s.describeTags(ctx)
+	if err != nil {
+		if errorCode(err) == "RequestLimitExceeded" {
+			s.backoff *= 2
+			if s.backoff < minRefreshBackoff {
+				s.backoff = minRefreshBackoff
+			}
+			if s.backoff > maxRefreshBackoff {
+				s.backoff = maxRefreshBackoff
+			}
+			s.retryAt = now.Add(s.backoff)
+			s.Logger.Warningf("AWS API throttled tag requests, backing off refreshes for %s", s.backoff)
+
+			if s.snapshot != nil {
+				return s.snapshot, nil
+			}
+			return nil, &StatusError{fuse.EAGAIN, err}
+		}
+
+		return nil, fmt.Errorf("failed to query AWS API: %w", err)
+	}
+
+	s.backoff = 0
+	s.retryAt = time.Time{}
+	s.fetched = now
+
+	old := s.snapshot
+	s.snapshot = tags
+	if old != nil {
+		s.notifyChanges(old, tags)
+	}
+	return tags, nil
+}
+
+// Notify sets the function called for every tag that differs between a
+// snapshot and the one it is replaced with. It is called with the snapshot
+// locked, so it must not read the tags.
+func (s *EC2Source) Notify(onChange func(key string, old, new []byte)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = onChange
+}
+
+// notifyChanges calls onChange for every tag that differs between two
+// snapshots
+func (s *EC2Source) notifyChanges(old, new map[string]string) {
+	if s.onChange == nil {
+		return
+	}
+
+	keys := sortedKeys(old)
+	for key := range new {
+		if _, ok := old[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		oldValue, hadOld := old[key]
+		newValue, hasNew := new[key]
+		if hadOld == hasNew && oldValue == newValue {
+			continue
+		}
+		s.onChange(key, optionalValue(oldValue, hadOld), optionalValue(newValue, hasNew))
+	}
+}
+
+// optionalValue returns value, or nil if the tag is missing
+func optionalValue(value string, ok bool) []byte {
+	if !ok {
+		return nil
+	}
+	return []byte(value)
+}
+
+// Tags returns the snapshot
+func (s *EC2Source) Tags(ctx context.Context) (map[string]string, error) {
+	return s.tags(ctx)
+}
+
+// Keys returns the keys of the tags in the snapshot
+func (s *EC2Source) Keys(ctx context.Context) ([]string, error) {
+	tags, err := s.tags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeys(tags), nil
+}
+
+// Tag returns the value of a tag from the snapshot
+func (s *EC2Source) Tag(ctx context.Context, key string) (string, bool, error) {
+	tags, err := s.tags(ctx)
+	if err != nil {
+		return "", false, err
+	}
+
+	value, ok := tags[key]
+	return value, ok, nil
+}
+
+// describeTags fetches all of the tags of the resource
+func (s *EC2Source) describeTags(ctx context.Context) (map[string]string, error) {
+	s.Logger.Debugf("issuing request to AWS API for tags of %s", s.ResourceID)
+
+	tags := map[string]string{}
+	paginator := ec2.NewDescribeTagsPaginator(s.Client, &ec2.DescribeTagsInput{
+		Filters: []types.Filter{
+			{Name: aws.String("resource-id"), Values: []string{s.ResourceID}},
+		},
+		MaxResults: aws.Int32(1000),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range page.Tags {
+			tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+
+	return tags, nil
+}
+
+// SetTag sets the value of a tag with CreateTags
+func (s *EC2Source) SetTag(ctx context.Context, key, value string) error {
+	s.Logger.Debugf("issuing request to AWS API to set tag: %s", key)
+
+	_, err := s.Client.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{s.ResourceID},
+		Tags:      []types.Tag{{Key: aws.String(key), Value: aws.String(value)}},
+	})
+	if err != nil {
+		return awsError(err)
+	}
+
+	s.updateSnapshot(key, &value)
+	return nil
+}
+
+// DeleteTag removes a tag with DeleteTags
+func (s *EC2Source) DeleteTag(ctx context.Context, key string) error {
+	s.Logger.Debugf("issuing request to AWS API to delete tag: %s", key)
+
+	_, err := s.Client.DeleteTags(ctx, &ec2.DeleteTagsInput{
+		Resources: []string{s.ResourceID},
+		Tags:      []types.Tag{{Key: aws.String(key)}},
+	})
+	if err != nil {
+		return awsError(err)
+	}
+
+	s.updateSnapshot(key, nil)
+	return nil
+}
+
+// updateSnapshot records a change made through the filesystem so that it is
+// visible before the next refresh. A nil value means the tag was deleted.
+func (s *EC2Source) updateSnapshot(key string, value *string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.snapshot == nil {
+		return
+	}
+
+	tags := make(map[string]string, len(s.snapshot)+1)
+	for k, v := range s.snapshot {
+		tags[k] = v
+	}
+	if value == nil {
+		delete(tags, key)
+	} else {
+		tags[key] = *value
+	}
+
+	old := s.snapshot
+	s.snapshot = tags
+	s.notifyChanges(old, tags)
+}
+
+// awsError returns an error returned by the EC2 API that fails the operation
+// with the errno it maps to
+func awsError(err error) error {
+	if code := awsErrorStatus(err); code != fuse.EIO {
+		return &StatusError{code, err}
+	}
+	return err
+}
+
+// awsErrorStatus maps an error returned by the EC2 API to an errno
+func awsErrorStatus(err error) fuse.Status {
+	switch errorCode(err) {
+	case "UnauthorizedOperation", "AuthFailure", "AccessDenied", "OptInRequired":
+		return fuse.EACCES
+	case "InvalidParameterValue", "InvalidParameter", "InvalidParameterCombination", "MissingParameter":
+		return fuse.EINVAL
+	case "TagLimitExceeded":
+		return fuse.Status(syscall.ENOSPC)
+	case "RequestLimitExceeded", "Throttling":
+		return fuse.EAGAIN
+	case "InvalidInstanceID.NotFound", "InvalidID":
+		return fuse.ENOENT
+	default:
+		return fuse.EIO
+	}
+}
+
+// errorCode returns the code of an error returned by the EC2 API, "" if it is
+// not an API error
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
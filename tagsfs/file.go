@@ -0,0 +1,65 @@
+package tagsfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/jszwedko/ec2-metadatafs/logger"
+)
+
+// FileSource reads tags from a JSON file holding an object of tag keys to
+// values, e.g. {"Name": "web-1", "team": "platform"}. The file is read on
+// every access, so changes to it are visible immediately.
+// Satisfies SnapshotTagSource
+type FileSource struct {
+	Path   string
+	Logger logger.LeveledLogger
+}
+
+// NewFileSource initializes a new FileSource reading the file at path
+func NewFileSource(path string, l logger.LeveledLogger) *FileSource {
+	return &FileSource{Path: path, Logger: l}
+}
+
+// Tags returns all of the tags in the file
+func (s *FileSource) Tags(ctx context.Context) (map[string]string, error) {
+	return s.read()
+}
+
+// Keys returns the keys of the tags in the file
+func (s *FileSource) Keys(ctx context.Context) ([]string, error) {
+	tags, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeys(tags), nil
+}
+
+// Tag returns the value of a tag in the file
+func (s *FileSource) Tag(ctx context.Context, key string) (string, bool, error) {
+	tags, err := s.read()
+	if err != nil {
+		return "", false, err
+	}
+
+	value, ok := tags[key]
+	return value, ok, nil
+}
+
+// read parses the file
+func (s *FileSource) read() (map[string]string, error) {
+	s.Logger.Debugf("reading tags from %s", s.Path)
+
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := map[string]string{}
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", s.Path, err)
+	}
+	return tags, nil
+}
@@ -0,0 +1,141 @@
+package tagsfs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A KeyFilter hides tags whose keys do not match its globs, which behave as
+// if they did not exist, and shows the keys starting with StripPrefix without
+// it. In globs, * matches any run of characters, including "/", ? matches
+// one character and [...] one of a set of characters.
+//
+// With StripPrefix "app:", the key "app:env" is shown as "env". Should the
+// instance also have an "env" tag, it is hidden in favor of "app:env". Writing
+// to "env" changes "app:env" if it exists, and "env" otherwise.
+
+// KeyFilter selects which tags a TagsFs shows and under which keys
+type KeyFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+
+	StripPrefix string
+}
+
+// NewKeyFilter initializes a new KeyFilter showing the keys matching any of
+// the include globs, or all keys if there are none, except for those matching
+// any of the exclude globs
+func NewKeyFilter(include, exclude []string, stripPrefix string) (*KeyFilter, error) {
+	f := &KeyFilter{StripPrefix: stripPrefix}
+
+	for _, glob := range include {
+		re, err := compileGlob(glob)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, re)
+	}
+	for _, glob := range exclude {
+		re, err := compileGlob(glob)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, re)
+	}
+
+	return f, nil
+}
+
+// Match reports whether the tag with the given key is shown
+func (f *KeyFilter) Match(key string) bool {
+	if f == nil {
+		return true
+	}
+
+	included := len(f.include) == 0
+	for _, re := range f.include {
+		if re.MatchString(key) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+
+	for _, re := range f.exclude {
+		if re.MatchString(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// shownKey returns the key a tag is shown under
+func (f *KeyFilter) shownKey(key string) string {
+	if f == nil || f.StripPrefix == "" {
+		return key
+	}
+	return strings.TrimPrefix(key, f.StripPrefix)
+}
+
+// candidates returns the keys of the tags that can be shown under key, in
+// order of preference
+func (f *KeyFilter) candidates(key string) []string {
+	if f == nil || f.StripPrefix == "" {
+		return []string{key}
+	}
+	if strings.HasPrefix(key, f.StripPrefix) {
+		// keys with the prefix are always shown without it
+		return []string{f.StripPrefix + key}
+	}
+	return []string{f.StripPrefix + key, key}
+}
+
+// compileGlob translates a glob into a regular expression matching whole keys.
+// Keys are Unicode, so the glob is read a rune at a time.
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+
+	runes := []rune(glob)
+	for i := 0; i < len(runes); i++ {
+		switch c := runes[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := indexRune(runes[i+1:], ']')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated [ in tag glob %q", glob)
+			}
+			class := string(runes[i+1 : i+1+end])
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag glob %q: %s", glob, err)
+	}
+	return re, nil
+}
+
+// indexRune returns the index of the first r in runes, -1 if there is none
+func indexRune(runes []rune, r rune) int {
+	for i, c := range runes {
+		if c == r {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,113 @@
+package tagsfs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jszwedko/ec2-metadatafs/logger"
+	"github.com/jszwedko/ec2-metadatafs/metadatafs"
+)
+
+// When instance metadata tags are enabled on the instance, the Instance
+// Metadata Service lists the tag keys under imdsTagsPath with a file holding
+// each value, so tags can be read without AWS API credentials. These tags are
+// read-only.
+
+// imdsTagsPath is the metadata path holding the instance tags
+const imdsTagsPath = "meta-data/tags/instance"
+
+// IMDSSource reads the tags of the instance from the Instance Metadata
+// Service
+// Satisfies TagSource
+type IMDSSource struct {
+	Client metadatafs.MetadataClient
+	Logger logger.LeveledLogger
+}
+
+// NewIMDSSource initializes a new IMDSSource that uses the given client
+func NewIMDSSource(client metadatafs.MetadataClient, l logger.LeveledLogger) *IMDSSource {
+	return &IMDSSource{Client: client, Logger: l}
+}
+
+// NewIMDS initializes a new TagsFs that reads the tags from the Instance
+// Metadata Service using the given client
+func NewIMDS(client metadatafs.MetadataClient, l logger.LeveledLogger) *TagsFs {
+	return NewFromSource(NewIMDSSource(client, l), l)
+}
+
+// IMDSTagsAvailable reports whether the Instance Metadata Service serves the
+// instance tags, which it only does if instance metadata tags are enabled
+func IMDSTagsAvailable(client metadatafs.MetadataClient) (bool, error) {
+	resp, err := client.Get(imdsTagsPath)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// get fetches a path beneath imdsTagsPath, ok is false if it does not exist
+func (s *IMDSSource) get(name string) (body []byte, ok bool, err error) {
+	resp, err := s.Client.Get(imdsTagsPath + "/" + name)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to query AWS metadata API: %s", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, false, nil
+	case http.StatusUnauthorized:
+		return nil, false, &StatusError{fuse.EACCES, fmt.Errorf("got 401 from AWS metadata API for tags; instance may only support IMDSv2")}
+	case http.StatusOK:
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to query AWS metadata API: %s", err)
+		}
+		return body, true, nil
+	default:
+		return nil, false, fmt.Errorf("unknown HTTP status code from AWS metadata API: %d", resp.StatusCode)
+	}
+}
+
+// Tag returns the value of a tag from the Instance Metadata Service
+func (s *IMDSSource) Tag(ctx context.Context, key string) (string, bool, error) {
+	// the Instance Metadata Service only serves tags whose keys are valid
+	// path components
+	if key == "" || key == "." || key == ".." || strings.Contains(key, "/") {
+		return "", false, nil
+	}
+
+	s.Logger.Debugf("issuing request to AWS metadata API for tag: %s", key)
+	body, ok, err := s.get(url.PathEscape(key))
+	return string(body), ok, err
+}
+
+// Keys lists the tag keys from the Instance Metadata Service
+func (s *IMDSSource) Keys(ctx context.Context) ([]string, error) {
+	s.Logger.Debugf("issuing request to AWS metadata API for instance tags")
+
+	body, ok, err := s.get("")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("instance metadata tags are not enabled for this instance")
+	}
+
+	keys := []string{}
+	for _, key := range strings.Split(string(body), "\n") {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
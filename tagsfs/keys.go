@@ -0,0 +1,146 @@
+package tagsfs
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jszwedko/ec2-metadatafs/internal/fuseutil"
+)
+
+// Tag keys may contain any character, including "/", and may be "." or "..",
+// none of which can be used as file names. Keys are shown as file names
+// escaped as follows, which is reversed on lookup:
+//
+//   - "%" is replaced with "%25" and "/" with "%2F"
+//   - the keys "." and ".." are shown as "%2E" and "%2E%2E"
+//
+// Only the escaped form of a key can be looked up, so every key has exactly
+// one name (e.g. "%41" does not find the key "A").
+//
+// With NestedKeys set, keys are instead split on "/" into directories, so the
+// key "team/owner" is the file "owner" in the directory "team", with "%"
+// escaped in each component. Keys that cannot be split, as they start or end
+// with "/", contain "//" or have "." or ".." components, are shown escaped at
+// the top level. A key that is also the directory of other keys is hidden.
+//
+// Keys named like the aggregate files (see aggregate.go) are hidden too.
+
+// maxNameLength is the longest file name the kernel accepts
+const maxNameLength = 255
+
+// nestable reports whether a key can be split into directories
+func nestable(key string) bool {
+	for _, component := range strings.Split(key, "/") {
+		if component == "" || component == "." || component == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// keyPath returns the path of the file holding a tag, relative to the root
+func (fs *TagsFs) keyPath(key string) string {
+	if !fs.NestedKeys || !nestable(key) {
+		return fuseutil.EscapeName(key)
+	}
+
+	components := strings.Split(key, "/")
+	for i, component := range components {
+		components[i] = strings.ReplaceAll(component, "%", "%25")
+	}
+	return strings.Join(components, "/")
+}
+
+// tagKey returns the key of the tag held by the file at name, ok is false if
+// name is not the path of any key
+func (fs *TagsFs) tagKey(name string) (key string, ok bool) {
+	if name == "" {
+		return "", false
+	}
+
+	components := strings.Split(name, "/")
+	for i, component := range components {
+		unescaped, err := url.PathUnescape(component)
+		if err != nil {
+			return "", false
+		}
+		components[i] = unescaped
+	}
+
+	key = strings.Join(components, "/")
+	return key, fs.keyPath(key) == name
+}
+
+// dirEntries lists the directory name given the keys of all tags, found is
+// false if no key is beneath it
+func (fs *TagsFs) dirEntries(keys []string, name string) (entries []fuse.DirEntry, found bool) {
+	prefix := ""
+	if name != "" {
+		prefix = name + "/"
+	}
+
+	files := map[string]string{}
+	dirs := map[string]bool{}
+	for _, key := range keys {
+		p := fs.keyPath(key)
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+
+		child := strings.TrimPrefix(p, prefix)
+		if i := strings.Index(child, "/"); i != -1 {
+			dirs[child[:i]] = true
+		} else {
+			files[child] = key
+		}
+	}
+
+	if name == "" {
+		for child := range aggregateFiles {
+			if key, ok := files[child]; ok || dirs[child] {
+				fs.Logger.Debugf("hiding tag '%s' as it is named like %s", key, child)
+				delete(files, child)
+				delete(dirs, child)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(files)+len(dirs)+len(aggregateFiles))
+	if name == "" {
+		for child := range aggregateFiles {
+			names = append(names, child)
+		}
+	}
+	for child := range files {
+		if !dirs[child] {
+			names = append(names, child)
+		}
+	}
+	for child := range dirs {
+		names = append(names, child)
+	}
+	sort.Strings(names)
+
+	entries = make([]fuse.DirEntry, 0, len(names))
+	for _, child := range names {
+		key, isFile := files[child]
+		switch {
+		case dirs[child]:
+			if isFile {
+				fs.Logger.Warningf("hiding tag '%s' as it is also a directory of other tags", key)
+			}
+			entries = append(entries, fuse.DirEntry{Name: child, Mode: fuse.S_IFDIR})
+		case name == "" && isAggregate(child):
+			entries = append(entries, fuse.DirEntry{Name: child, Mode: fuse.S_IFREG})
+		case len(child) > maxNameLength:
+			fs.Logger.Warningf("hiding tag '%s' as its file name is longer than %d bytes", key, maxNameLength)
+		default:
+			fs.Logger.Debugf("adding dir entry for tag '%s'", key)
+			entries = append(entries, fuse.DirEntry{Name: child, Mode: fuse.S_IFREG})
+		}
+	}
+
+	return entries, len(names) > 0 || name == ""
+}
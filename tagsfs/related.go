@@ -0,0 +1,419 @@
+package tagsfs
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/jszwedko/ec2-metadatafs/internal/fuseutil"
+	"github.com/jszwedko/ec2-metadatafs/logger"
+	"github.com/jszwedko/ec2-metadatafs/metadatafs"
+)
+
+// Resource directories holding the tags of the resources related to the
+// instance, alongside the instance's own tags
+const (
+	volumesDir           = "volumes"
+	networkInterfacesDir = "network-interfaces"
+	securityGroupsDir    = "security-groups"
+	subnetDir            = "subnet"
+	vpcDir               = "vpc"
+)
+
+// relatedDirs are the resource directories. subnet and vpc hold the tags of
+// their resource directly, the others hold a directory per resource.
+var relatedDirs = []string{networkInterfacesDir, securityGroupsDir, subnetDir, volumesDir, vpcDir}
+
+// RelatedFs serves the tags of an instance alongside those of its EBS
+// volumes, network interfaces, security groups, subnet and VPC, e.g.
+// volumes/vol-1234/Name or subnet/Name.
+//
+// The network interfaces, security groups, subnet and VPC are found through
+// the Instance Metadata Service and the volumes with DescribeInstances. The
+// IDs are refreshed with the tags, every Source.RefreshInterval. Instance
+// tags whose keys collide with the resource directories are hidden. The tags
+// of related resources are read-only even if the instance's are writable, as
+// the resources may be shared with other instances.
+// Satisfies pathfs.FileSystem
+type RelatedFs struct {
+	pathfs.FileSystem
+
+	// Instance serves the tags of the instance, and is the template for
+	// the TagsFs of the related resources
+	Instance *TagsFs
+
+	// Source reads the tags of the instance, its client is used to find the
+	// volumes and to read the tags of the related resources
+	Source *EC2Source
+
+	Metadata metadatafs.MetadataClient
+	Logger   logger.LeveledLogger
+
+	mu        sync.Mutex
+	ids       map[string][]string
+	fetched   time.Time
+	resources map[string]*TagsFs
+
+	// volumesCode is why the volumes could not be found, so that the other
+	// resources can still be served without ec2:DescribeInstances
+	volumesCode fuse.Status
+}
+
+// NewRelated initializes a new RelatedFs around the TagsFs of the instance,
+// which reads its tags from source
+func NewRelated(instance *TagsFs, source *EC2Source, client metadatafs.MetadataClient, l logger.LeveledLogger) *RelatedFs {
+	return &RelatedFs{
+		FileSystem: pathfs.NewReadonlyFileSystem(pathfs.NewDefaultFileSystem()),
+		Instance:   instance,
+		Source:     source,
+		Metadata:   client,
+		Logger:     l,
+	}
+}
+
+// relatedIDs returns the IDs of the related resources by directory,
+// refreshing them if they are older than Source.RefreshInterval
+func (fs *RelatedFs) relatedIDs(ctx context.Context) (map[string][]string, fuse.Status) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.ids != nil && time.Since(fs.fetched) < fs.Source.RefreshInterval {
+		return fs.ids, fuse.OK
+	}
+
+	ids, err := fs.metadataIDs()
+	if err != nil {
+		fs.Logger.Errorf("failed to query AWS metadata API: %s", err)
+		return nil, fuse.EIO
+	}
+
+	fs.volumesCode = fuse.OK
+	ids[volumesDir], err = fs.volumeIDs(ctx)
+	if err != nil {
+		fs.Logger.Errorf("failed to query AWS API for instance volumes: %s", err)
+		fs.volumesCode = awsErrorStatus(err)
+	}
+
+	fs.ids = ids
+	fs.fetched = time.Now()
+	return ids, fuse.OK
+}
+
+// metadataIDs finds the network interfaces, security groups, subnet and VPC
+// of the instance in the metadata of its network interfaces. The subnet and
+// VPC are those of the primary network interface.
+func (fs *RelatedFs) metadataIDs() (map[string][]string, error) {
+	ids := map[string][]string{}
+
+	primary, err := metadatafs.FetchValue(fs.Metadata, "meta-data/mac")
+	if err != nil {
+		return nil, err
+	}
+
+	macs, err := metadatafs.FetchValue(fs.Metadata, "meta-data/network/interfaces/macs/")
+	if err != nil {
+		return nil, err
+	}
+
+	groups := map[string]bool{}
+	for _, mac := range lines(macs) {
+		mac = strings.TrimSuffix(mac, "/")
+		dir := "meta-data/network/interfaces/macs/" + mac + "/"
+
+		values := map[string][]byte{}
+		for _, name := range []string{"interface-id", "security-group-ids", "subnet-id", "vpc-id"} {
+			if values[name], err = metadatafs.FetchValue(fs.Metadata, dir+name); err != nil {
+				return nil, err
+			}
+		}
+
+		ids[networkInterfacesDir] = append(ids[networkInterfacesDir], lines(values["interface-id"])...)
+		for _, group := range lines(values["security-group-ids"]) {
+			groups[group] = true
+		}
+		if mac == strings.TrimSpace(string(primary)) {
+			ids[subnetDir] = lines(values["subnet-id"])
+			ids[vpcDir] = lines(values["vpc-id"])
+		}
+	}
+
+	for group := range groups {
+		ids[securityGroupsDir] = append(ids[securityGroupsDir], group)
+	}
+	for _, dir := range relatedDirs {
+		sort.Strings(ids[dir])
+	}
+	return ids, nil
+}
+
+// volumeIDs finds the EBS volumes attached to the instance
+func (fs *RelatedFs) volumeIDs(ctx context.Context) ([]string, error) {
+	fs.Logger.Debugf("issuing request to AWS API for instance volumes")
+
+	ids := []string{}
+	paginator := ec2.NewDescribeInstancesPaginator(fs.Source.Client, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{fs.Source.ResourceID},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				for _, mapping := range instance.BlockDeviceMappings {
+					if mapping.Ebs != nil && mapping.Ebs.VolumeId != nil {
+						ids = append(ids, *mapping.Ebs.VolumeId)
+					}
+				}
+			}
+		}
+	}
+
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// lines splits a metadata value into its non-empty lines
+func lines(value []byte) []string {
+	result := []string{}
+	for _, line := range strings.Split(string(value), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+// resourceFs returns the TagsFs of a related resource served at prefix,
+// created like the instance's own but read-only
+func (fs *RelatedFs) resourceFs(prefix, id string) *TagsFs {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.resources == nil {
+		fs.resources = map[string]*TagsFs{}
+	}
+	if resource, ok := fs.resources[id]; ok {
+		return resource
+	}
+
+	source := NewEC2Source(fs.Source.Client, id, fs.Logger)
+	source.RefreshInterval = fs.Source.RefreshInterval
+
+	resource := NewFromSource(source, fs.Logger)
+	resource.NestedKeys = fs.Instance.NestedKeys
+	resource.Filter = fs.Instance.Filter
+	if onChange := fs.Instance.OnChange; onChange != nil {
+		resource.OnChange = func(name string, old, new []byte) {
+			onChange(path.Join(prefix, name), old, new)
+		}
+	}
+
+	fs.resources[id] = resource
+	return resource
+}
+
+// resolve finds the filesystem serving name and the path within it. dirs
+// is the listing of name if it is one of the resource directories holding a
+// directory per resource.
+func (fs *RelatedFs) resolve(name string, context *fuse.Context) (target pathfs.FileSystem, rest string, dirs []string, code fuse.Status) {
+	components := strings.SplitN(name, "/", 3)
+	if !isRelatedDir(components[0]) {
+		return fs.Instance, name, nil, fuse.OK
+	}
+
+	ids, code := fs.relatedIDs(fuseutil.RequestContext(context))
+	if code != fuse.OK {
+		return nil, "", nil, code
+	}
+	resourceIDs := ids[components[0]]
+
+	switch components[0] {
+	case subnetDir, vpcDir:
+		if len(resourceIDs) == 0 {
+			return nil, "", nil, fuse.ENOENT
+		}
+		return fs.resourceFs(components[0], resourceIDs[0]), strings.Join(components[1:], "/"), nil, fuse.OK
+	case volumesDir:
+		fs.mu.Lock()
+		volumesCode := fs.volumesCode
+		fs.mu.Unlock()
+		if volumesCode != fuse.OK {
+			return nil, "", nil, volumesCode
+		}
+	}
+
+	if len(components) == 1 {
+		return nil, "", resourceIDs, fuse.OK
+	}
+	if !includes(resourceIDs, components[1]) {
+		fs.Logger.Debugf("%s is not related to the instance", components[1])
+		return nil, "", nil, fuse.ENOENT
+	}
+	return fs.resourceFs(path.Join(components[0], components[1]), components[1]), strings.Join(components[2:], "/"), nil, fuse.OK
+}
+
+func isRelatedDir(name string) bool {
+	return includes(relatedDirs, name)
+}
+
+func includes(values []string, needle string) bool {
+	for _, value := range values {
+		if value == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// GetAttr returns the attributes of the resource directories or forwards to
+// the filesystem of the resource
+func (fs *RelatedFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	target, rest, _, code := fs.resolve(name, context)
+	switch {
+	case code != fuse.OK:
+		return nil, code
+	case target == nil:
+		return &fuse.Attr{Size: 4096, Mode: fuse.S_IFDIR | 0555}, fuse.OK
+	default:
+		return target.GetAttr(rest, context)
+	}
+}
+
+// OpenDir lists the resource directories along with the instance tags, or
+// forwards to the filesystem of the resource
+func (fs *RelatedFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	target, rest, dirs, code := fs.resolve(name, context)
+	if code != fuse.OK {
+		return nil, code
+	}
+	if target == nil {
+		entries := make([]fuse.DirEntry, 0, len(dirs))
+		for _, id := range dirs {
+			entries = append(entries, fuse.DirEntry{Name: id, Mode: fuse.S_IFDIR})
+		}
+		return entries, fuse.OK
+	}
+
+	entries, code := target.OpenDir(rest, context)
+	if code != fuse.OK || name != "" {
+		return entries, code
+	}
+
+	ids, code := fs.relatedIDs(fuseutil.RequestContext(context))
+	if code != fuse.OK {
+		return nil, code
+	}
+
+	result := make([]fuse.DirEntry, 0, len(entries)+len(relatedDirs))
+	for _, entry := range entries {
+		if isRelatedDir(entry.Name) {
+			fs.Logger.Warningf("hiding instance tag '%s' as it is the name of a resource directory", entry.Name)
+			continue
+		}
+		result = append(result, entry)
+	}
+	for _, dir := range relatedDirs {
+		if (dir == subnetDir || dir == vpcDir) && len(ids[dir]) == 0 {
+			continue
+		}
+		result = append(result, fuse.DirEntry{Name: dir, Mode: fuse.S_IFDIR})
+	}
+	return result, fuse.OK
+}
+
+// Open forwards to the filesystem of the resource
+func (fs *RelatedFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	target, rest, _, code := fs.resolve(name, context)
+	switch {
+	case code != fuse.OK:
+		return nil, code
+	case target == nil:
+		return nil, fuse.EISDIR
+	default:
+		return target.Open(rest, flags, context)
+	}
+}
+
+// Create forwards to the filesystem of the resource
+func (fs *RelatedFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	target, rest, _, code := fs.resolve(name, context)
+	switch {
+	case code != fuse.OK:
+		return nil, code
+	case target == nil || rest == "":
+		return nil, fuse.EPERM
+	default:
+		return target.Create(rest, flags, mode, context)
+	}
+}
+
+// Truncate forwards to the filesystem of the resource
+func (fs *RelatedFs) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	target, rest, _, code := fs.resolve(name, context)
+	switch {
+	case code != fuse.OK:
+		return code
+	case target == nil:
+		return fuse.EISDIR
+	default:
+		return target.Truncate(rest, size, context)
+	}
+}
+
+// Unlink forwards to the filesystem of the resource
+func (fs *RelatedFs) Unlink(name string, context *fuse.Context) fuse.Status {
+	target, rest, _, code := fs.resolve(name, context)
+	switch {
+	case code != fuse.OK:
+		return code
+	case target == nil || rest == "":
+		return fuse.EPERM
+	default:
+		return target.Unlink(rest, context)
+	}
+}
+
+// Rename forwards to the filesystem of the resource, tags cannot be moved
+// between resources
+func (fs *RelatedFs) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	oldTarget, oldRest, _, code := fs.resolve(oldName, context)
+	if code != fuse.OK {
+		return code
+	}
+	newTarget, newRest, _, code := fs.resolve(newName, context)
+	if code != fuse.OK {
+		return code
+	}
+
+	switch {
+	case oldTarget == nil || newTarget == nil || oldRest == "" || newRest == "":
+		return fuse.EPERM
+	case oldTarget != newTarget:
+		return fuse.Status(syscall.EXDEV)
+	default:
+		return oldTarget.Rename(oldRest, newRest, context)
+	}
+}
+
+// Utimens forwards to the filesystem of the resource
+func (fs *RelatedFs) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	target, rest, _, code := fs.resolve(name, context)
+	switch {
+	case code != fuse.OK:
+		return code
+	case target == nil:
+		return fuse.EPERM
+	default:
+		return target.Utimens(rest, atime, mtime, context)
+	}
+}
@@ -0,0 +1,94 @@
+package tagsfs
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// TagSource supplies the tags served by a TagsFs. Implementations are
+// provided for the AWS API (EC2Source), the Instance Metadata Service
+// (IMDSSource) and a static file (FileSource).
+type TagSource interface {
+	// Keys returns the keys of all of the tags, in order
+	Keys(ctx context.Context) ([]string, error)
+
+	// Tag returns the value of a tag, ok is false if there is no such tag
+	Tag(ctx context.Context, key string) (value string, ok bool, err error)
+}
+
+// WritableTagSource is a TagSource whose tags can be changed. Tags are only
+// writable through a TagsFs if its source implements this and Writable is
+// set.
+type WritableTagSource interface {
+	TagSource
+
+	// SetTag creates or updates a tag
+	SetTag(ctx context.Context, key, value string) error
+
+	// DeleteTag removes a tag
+	DeleteTag(ctx context.Context, key string) error
+}
+
+// SnapshotTagSource is a TagSource that can return all of its tags as of a
+// single point in time, which tags.json and tags.env are generated from.
+// Without it they are assembled from Keys and Tag.
+type SnapshotTagSource interface {
+	TagSource
+
+	// Tags returns all of the tags by key. The map must not be modified.
+	Tags(ctx context.Context) (map[string]string, error)
+}
+
+// NotifyingTagSource is a TagSource that finds changes to its tags without
+// them being read, e.g. when refreshing a snapshot. A TagsFs passes them on
+// to its OnChange.
+type NotifyingTagSource interface {
+	TagSource
+
+	// Notify sets the function called with the key of every tag added,
+	// changed or removed, along with its old and new values. A nil value
+	// means the tag is missing.
+	Notify(onChange func(key string, old, new []byte))
+}
+
+// StatusError is an error returned by a TagSource that fails the operation
+// with Status. Any other error fails it with EIO, or EINTR if the operation
+// was interrupted.
+type StatusError struct {
+	Status fuse.Status
+	Err    error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// errorStatus returns the errno an error returned by a TagSource fails the
+// operation with
+func errorStatus(err error) fuse.Status {
+	var serr *StatusError
+	if errors.As(err, &serr) {
+		return serr.Status
+	}
+	if errors.Is(err, context.Canceled) {
+		return fuse.EINTR
+	}
+	return fuse.EIO
+}
+
+// sortedKeys returns the keys of a set of tags in order
+func sortedKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,111 +1,290 @@
 package tagsfs
 
 import (
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/ec2"
+	"context"
+	"sync"
+
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/jszwedko/ec2-metadatafs/internal/fuseutil"
 	"github.com/jszwedko/ec2-metadatafs/logger"
 )
 
-// TagsFs represents a filesystem that exposes the instance tags
+// TagsFs represents a filesystem that exposes the tags of a TagSource,
+// normally those of the instance
 // Satisfies pathfs.FileSystem
-// Currently is readonly
+// Read-only unless Writable is set
 type TagsFs struct {
 	pathfs.FileSystem
 
-	Client     *ec2.EC2
-	InstanceID string
-	Logger     logger.LeveledLogger
+	Source TagSource
+	Logger logger.LeveledLogger
+
+	// Writable allows tags to be created, updated and deleted through the
+	// filesystem, if Source is a WritableTagSource
+	Writable bool
+
+	// NestedKeys shows keys containing "/" as nested directories rather than
+	// escaping them (see keys.go)
+	NestedKeys bool
+
+	// Filter, if set, hides some of the tags and strips a prefix from the
+	// keys of others (see filter.go)
+	Filter *KeyFilter
+
+	// OnChange, if set, is called with the path of a tag's file when the tag
+	// is found to have a different value than when it was last read, or than
+	// before a NotifyingTagSource refreshed it. A nil value means the tag is
+	// missing.
+	OnChange func(name string, old, new []byte)
+
+	valuesMu sync.Mutex
+	values   map[string][]byte
+
+	createdMu sync.Mutex
+	created   map[string]*tagFile
+}
+
+// New initializes a new TagsFs that reads the tags of the instance from the
+// AWS API using the given client
+func New(client EC2API, instanceID string, l logger.LeveledLogger) *TagsFs {
+	return NewFromSource(NewEC2Source(client, instanceID, l), l)
 }
 
-// New initializes a new TagsFs that uses the given AWS client
-func New(client *ec2.EC2, instanceID string, l logger.LeveledLogger) *TagsFs {
-	return &TagsFs{
+// NewFromSource initializes a new TagsFs that serves the tags of source
+func NewFromSource(source TagSource, l logger.LeveledLogger) *TagsFs {
+	fs := &TagsFs{
 		FileSystem: pathfs.NewReadonlyFileSystem(pathfs.NewDefaultFileSystem()),
-		Client:     client,
-		InstanceID: instanceID,
+		Source:     source,
 		Logger:     l,
 	}
+	if notifying, ok := source.(NotifyingTagSource); ok {
+		notifying.Notify(fs.sourceChanged)
+	}
+	return fs
 }
 
 // GetAttr returns an fuse.Attr representing a read-only file or directory
 func (fs *TagsFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
 	if name == "" {
-		return &fuse.Attr{Size: 4096, Mode: fuse.S_IFDIR | 0555}, fuse.OK
+		return &fuse.Attr{Size: 4096, Mode: fuse.S_IFDIR | fs.mode(0555)}, fuse.OK
 	}
 
-	fs.Logger.Debugf("issuing request to AWS API for tag: %s", name)
+	if attr, ok := fs.createdAttr(name); ok {
+		return attr, fuse.OK
+	}
 
-	resp, err := fs.Client.DescribeTags(&ec2.DescribeTagsInput{
-		Filters: []*ec2.Filter{
-			{Name: aws.String("key"), Values: []*string{aws.String(name)}},
-			{Name: aws.String("resource-id"), Values: []*string{aws.String(fs.InstanceID)}},
-		},
-	})
+	if isAggregate(name) {
+		return fs.aggregateAttr(fuseutil.RequestContext(context), name)
+	}
 
-	if err != nil {
-		fs.Logger.Errorf("failed to query AWS API: %s", err)
-		return nil, fuse.EIO
+	if fs.NestedKeys {
+		keys, code := fs.keys(fuseutil.RequestContext(context))
+		if code != fuse.OK {
+			return nil, code
+		}
+		if _, found := fs.dirEntries(keys, name); found {
+			return &fuse.Attr{Size: 4096, Mode: fuse.S_IFDIR | fs.mode(0555)}, fuse.OK
+		}
 	}
 
-	if len(resp.Tags) == 0 {
+	key, ok := fs.tagKey(name)
+	if !ok {
 		fs.Logger.Debugf("no tag found for %s", name)
 		return nil, fuse.ENOENT
 	}
 
+	value, code := fs.getTag(fuseutil.RequestContext(context), key)
+	if code != fuse.OK {
+		return nil, code
+	}
+
 	return &fuse.Attr{
-		Size: uint64(len(*resp.Tags[0].Value)),
-		Mode: fuse.S_IFREG | 0444,
+		Size: uint64(len(value)),
+		Mode: fuse.S_IFREG | fs.mode(0444),
 	}, fuse.OK
 }
 
 // OpenDir returns the list of paths under the given path
 // GetAttr is called on the file first, so we do not worry about this being called on non-dirs
 func (fs *TagsFs) OpenDir(name string, context *fuse.Context) (c []fuse.DirEntry, code fuse.Status) {
-	fs.Logger.Debugf("issuing request to AWS API for instance tags")
-
-	resp, err := fs.Client.DescribeTags(&ec2.DescribeTagsInput{
-		Filters: []*ec2.Filter{
-			{Name: aws.String("resource-id"), Values: []*string{aws.String(fs.InstanceID)}},
-		},
-	})
-
-	if err != nil {
-		fs.Logger.Errorf("failed to query AWS API: %s", err)
-		return nil, fuse.EIO
+	keys, code := fs.keys(fuseutil.RequestContext(context))
+	if code != fuse.OK {
+		return nil, code
 	}
 
-	dirEntries := make([]fuse.DirEntry, 0, len(resp.Tags))
-	for _, tag := range resp.Tags {
-		fs.Logger.Debugf("adding dir entry for tag '%s'", *tag.Key)
-		dirEntries = append(dirEntries, fuse.DirEntry{Name: *tag.Key, Mode: fuse.S_IFREG})
+	dirEntries, found := fs.dirEntries(keys, name)
+	if !found {
+		return nil, fuse.ENOENT
 	}
-
 	return dirEntries, fuse.OK
 }
 
 // Open returns a datafile representing the tag value
 func (fs *TagsFs) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
-	fs.Logger.Debugf("issuing request to AWS API for tag: %s", name)
+	if isAggregate(name) {
+		return fs.openAggregate(fuseutil.RequestContext(context), name, flags)
+	}
 
-	resp, err := fs.Client.DescribeTags(&ec2.DescribeTagsInput{
-		Filters: []*ec2.Filter{
-			{Name: aws.String("key"), Values: []*string{aws.String(name)}},
-			{Name: aws.String("resource-id"), Values: []*string{aws.String(fs.InstanceID)}},
-		},
-	})
+	if flags&fuse.O_ANYWRITE != 0 && !fs.writable() {
+		return nil, fuse.EPERM
+	}
+	if flags&fuse.O_ANYWRITE != 0 && !fuseutil.Allowed(context) {
+		return nil, fuse.EACCES
+	}
 
+	key, ok := fs.tagKey(name)
+	if !ok {
+		fs.Logger.Debugf("no tag found for %s", name)
+		return nil, fuse.ENOENT
+	}
+
+	value, code := fs.getTag(fuseutil.RequestContext(context), key)
+	if code != fuse.OK {
+		return nil, code
+	}
+
+	if flags&fuse.O_ANYWRITE != 0 {
+		return newTagFile(fs, name, key, value, false), fuse.OK
+	}
+	return nodefs.NewDataFile(value), fuse.OK
+}
+
+// keys returns the keys of all of the tags shown
+func (fs *TagsFs) keys(ctx context.Context) ([]string, fuse.Status) {
+	keys, err := fs.Source.Keys(ctx)
 	if err != nil {
-		fs.Logger.Errorf("failed to query AWS API: %s", err)
-		return nil, fuse.EIO
+		fs.Logger.Errorf("failed to list tags: %s", err)
+		return nil, errorStatus(err)
 	}
+	if fs.Filter == nil {
+		return keys, fuse.OK
+	}
+	return sortedKeys(fs.shownKeys(keys)), fuse.OK
+}
 
-	if len(resp.Tags) == 0 {
-		fs.Logger.Debugf("no tag found for %s", name)
+// shownKeys returns the keys of the tags shown by the keys they are shown
+// under
+func (fs *TagsFs) shownKeys(keys []string) map[string]string {
+	shown := map[string]string{}
+	for _, key := range keys {
+		if !fs.Filter.Match(key) {
+			continue
+		}
+		name := fs.Filter.shownKey(key)
+		if other, ok := shown[name]; ok {
+			// the key with the prefix wins, as getTag prefers it
+			fs.Logger.Debugf("tag %s is hidden by %s", name, fs.Filter.StripPrefix+name)
+			if other != name {
+				continue
+			}
+		}
+		shown[name] = key
+	}
+	return shown
+}
+
+// lookup returns the key and value of the tag shown under key, ok is false if
+// there is none
+func (fs *TagsFs) lookup(ctx context.Context, key string) (sourceKey, value string, ok bool, err error) {
+	for _, candidate := range fs.Filter.candidates(key) {
+		if !fs.Filter.Match(candidate) {
+			continue
+		}
+		value, ok, err := fs.Source.Tag(ctx, candidate)
+		if err != nil || ok {
+			return candidate, value, ok, err
+		}
+	}
+	return "", "", false, nil
+}
+
+// Tag returns the value of the tag shown under key, ok is false if there is
+// no such tag or it is filtered out
+func (fs *TagsFs) Tag(ctx context.Context, key string) (value string, ok bool, err error) {
+	_, value, ok, err = fs.lookup(ctx, key)
+	return value, ok, err
+}
+
+// getTag returns the value of a tag, ENOENT if there is no such tag or it is
+// filtered out
+func (fs *TagsFs) getTag(ctx context.Context, key string) ([]byte, fuse.Status) {
+	sourceKey, value, ok, err := fs.lookup(ctx, key)
+	if err != nil {
+		fs.Logger.Errorf("failed to read tag %s: %s", sourceKey, err)
+		return nil, errorStatus(err)
+	}
+
+	if !ok {
+		fs.Logger.Debugf("no tag found for %s", key)
+		fs.observe(fs.keyPath(key), nil)
 		return nil, fuse.ENOENT
 	}
 
-	return nodefs.NewDataFile([]byte(*resp.Tags[0].Value)), fuse.OK
+	fs.observe(fs.keyPath(key), []byte(value))
+	return []byte(value), fuse.OK
+}
+
+// mode adds the owner write bit to perm if tags are writable
+func (fs *TagsFs) mode(perm uint32) uint32 {
+	if fs.writable() {
+		return perm | 0200
+	}
+	return perm
+}
+
+// writableSource returns the source if tags can be changed through the
+// filesystem
+func (fs *TagsFs) writableSource() (WritableTagSource, bool) {
+	if !fs.Writable {
+		return nil, false
+	}
+	source, ok := fs.Source.(WritableTagSource)
+	return source, ok
+}
+
+// writable reports whether tags can be changed through the filesystem
+func (fs *TagsFs) writable() bool {
+	_, ok := fs.writableSource()
+	return ok
+}
+
+// sourceChanged passes a change found by the source on to OnChange, unless
+// the tag is filtered out, and records the new value so that reading it does
+// not report the change again
+func (fs *TagsFs) sourceChanged(key string, old, new []byte) {
+	if fs.OnChange == nil || !fs.Filter.Match(key) {
+		return
+	}
+	name := fs.keyPath(fs.Filter.shownKey(key))
+
+	fs.valuesMu.Lock()
+	if fs.values == nil {
+		fs.values = map[string][]byte{}
+	}
+	fs.values[name] = new
+	fs.valuesMu.Unlock()
+
+	fs.OnChange(name, old, new)
+}
+
+// observe records the value read for a tag, calling OnChange if it differs
+// from the previous one. The first value read for a tag is only recorded.
+func (fs *TagsFs) observe(name string, value []byte) {
+	if fs.OnChange == nil {
+		return
+	}
+
+	fs.valuesMu.Lock()
+	if fs.values == nil {
+		fs.values = map[string][]byte{}
+	}
+	old, seen := fs.values[name]
+	fs.values[name] = value
+	fs.valuesMu.Unlock()
+
+	if seen && ((old == nil) != (value == nil) || string(old) != string(value)) {
+		fs.OnChange(name, old, value)
+	}
 }
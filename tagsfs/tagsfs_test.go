@@ -1,28 +1,113 @@
 package tagsfs
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/request"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
 	"github.com/jszwedko/ec2-metadatafs/internal/logging"
+	"github.com/jszwedko/ec2-metadatafs/metadatafs"
 )
 
-func setup(t *testing.T) (svc *ec2.EC2, dir string, cleanup func()) {
-	svc = ec2.New(session.New())
-	svc.Handlers.Clear()
+// fakeEC2 implements EC2API by passing every call through its handlers in
+// order, each of which can fill in the output or fail the call
+type fakeEC2 struct {
+	mu       sync.Mutex
+	handlers []func(*fakeRequest)
+}
+
+// fakeRequest is a call to a fakeEC2
+type fakeRequest struct {
+	Params interface{}
+	Data   interface{}
+	Error  error
+}
+
+func newFakeEC2() *fakeEC2 {
+	return &fakeEC2{}
+}
+
+// PushBack adds a handler run after the existing ones
+func (c *fakeEC2) PushBack(handler func(*fakeRequest)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers = append(c.handlers, handler)
+}
+
+func (c *fakeEC2) send(params, data interface{}) error {
+	c.mu.Lock()
+	handlers := c.handlers
+	c.mu.Unlock()
+
+	r := &fakeRequest{Params: params, Data: data}
+	for _, handler := range handlers {
+		handler(r)
+	}
+	return r.Error
+}
+
+func (c *fakeEC2) DescribeTags(ctx context.Context, params *ec2.DescribeTagsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeTagsOutput, error) {
+	output := &ec2.DescribeTagsOutput{}
+	return output, c.send(params, output)
+}
+
+func (c *fakeEC2) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	output := &ec2.DescribeInstancesOutput{}
+	return output, c.send(params, output)
+}
+
+func (c *fakeEC2) CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	output := &ec2.CreateTagsOutput{}
+	return output, c.send(params, output)
+}
+
+func (c *fakeEC2) DeleteTags(ctx context.Context, params *ec2.DeleteTagsInput, optFns ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error) {
+	output := &ec2.DeleteTagsOutput{}
+	return output, c.send(params, output)
+}
+
+// apiError returns an error like those returned by the EC2 API
+func apiError(code, message string) error {
+	return &smithy.GenericAPIError{Code: code, Message: message}
+}
+
+func setup(t *testing.T) (svc *fakeEC2, dir string, cleanup func()) {
+	return setupFs(t, func(*TagsFs) {})
+}
+
+// setupFs mounts a TagsFs after passing it to configure
+func setupFs(t *testing.T, configure func(*TagsFs)) (svc *fakeEC2, dir string, cleanup func()) {
+	return setupRelated(t, func(fs *TagsFs) pathfs.FileSystem {
+		configure(fs)
+		return fs
+	})
+}
+
+// setupRelated mounts the filesystem wrap returns for a TagsFs
+func setupRelated(t *testing.T, wrap func(*TagsFs) pathfs.FileSystem) (svc *fakeEC2, dir string, cleanup func()) {
+	svc = newFakeEC2()
 
 	tmpDir, err := ioutil.TempDir("", "ec2metadata-test")
 	if err != nil {
@@ -30,13 +115,14 @@ func setup(t *testing.T) (svc *ec2.EC2, dir string, cleanup func()) {
 	}
 
 	fs := New(svc, "i-123456", logging.NewLogger())
-	nfs := pathfs.NewPathNodeFs(fs, nil)
+	nfs := pathfs.NewPathNodeFs(wrap(fs), nil)
 	state, _, err := nodefs.MountRoot(tmpDir, nfs.Root(), nodefs.NewOptions())
 	if err != nil {
 		t.Fatalf("mounting filesystem failed: %v", err)
 	}
 
 	go state.Serve()
+	state.WaitMount()
 
 	return svc, tmpDir, func() {
 		state.Unmount()
@@ -44,35 +130,147 @@ func setup(t *testing.T) (svc *ec2.EC2, dir string, cleanup func()) {
 	}
 }
 
-func includesString(values []*string, needle string) bool {
+// setupIMDS mounts a TagsFs reading the given tags from a fake Instance
+// Metadata Service, a nil map meaning instance metadata tags are disabled
+func setupIMDS(t *testing.T, tags map[string]string) (dir string, cleanup func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tags == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch key := strings.TrimPrefix(r.URL.Path, "/meta-data/tags/instance/"); {
+		case r.URL.Path == "/meta-data/tags/instance", key == "":
+			keys := []string{}
+			for key := range tags {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			fmt.Fprint(w, strings.Join(keys, "\n"))
+		case tags[key] != "":
+			fmt.Fprint(w, tags[key])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	tmpDir, err := ioutil.TempDir("", "ec2metadata-test")
+	if err != nil {
+		t.Fatalf("creating tempdir failed: %v", err)
+	}
+
+	fs := NewIMDS(metadatafs.NewIMDSv1Client(server.URL+"/", logging.NewLogger()), logging.NewLogger())
+	fs.Writable = true
+	nfs := pathfs.NewPathNodeFs(fs, nil)
+	state, _, err := nodefs.MountRoot(tmpDir, nfs.Root(), nodefs.NewOptions())
+	if err != nil {
+		t.Fatalf("mounting filesystem failed: %v", err)
+	}
+
+	go state.Serve()
+	state.WaitMount()
+
+	return tmpDir, func() {
+		state.Unmount()
+		server.Close()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+// setupSource mounts a writable TagsFs serving the tags of source, calling
+// configure, if set, on it first
+func setupSource(t *testing.T, source TagSource, configure func(*TagsFs)) (dir string, cleanup func()) {
+	tmpDir, err := ioutil.TempDir("", "ec2metadata-test")
+	if err != nil {
+		t.Fatalf("creating tempdir failed: %v", err)
+	}
+
+	fs := NewFromSource(source, logging.NewLogger())
+	fs.Writable = true
+	if configure != nil {
+		configure(fs)
+	}
+	nfs := pathfs.NewPathNodeFs(fs, nil)
+	state, _, err := nodefs.MountRoot(tmpDir, nfs.Root(), nodefs.NewOptions())
+	if err != nil {
+		t.Fatalf("mounting filesystem failed: %v", err)
+	}
+
+	go state.Serve()
+	state.WaitMount()
+
+	return tmpDir, func() {
+		state.Unmount()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+// mapSource is a WritableTagSource holding tags in memory, failing writes
+// with err if set
+type mapSource struct {
+	mu   sync.Mutex
+	tags map[string]string
+	err  error
+}
+
+func (s *mapSource) Keys(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedKeys(s.tags), nil
+}
+
+func (s *mapSource) Tag(ctx context.Context, key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.tags[key]
+	return value, ok, nil
+}
+
+func (s *mapSource) SetTag(ctx context.Context, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.tags[key] = value
+	return nil
+}
+
+func (s *mapSource) DeleteTag(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	delete(s.tags, key)
+	return nil
+}
+
+func includesString(values []string, needle string) bool {
 	for _, value := range values {
-		if needle == *value {
+		if needle == value {
 			return true
 		}
 	}
 	return false
 }
 
-func serveTags(tags map[string]string) func(*request.Request) {
-	return func(r *request.Request) {
+func serveTags(tags map[string]string) func(*fakeRequest) {
+	return func(r *fakeRequest) {
 		input, ok := r.Params.(*ec2.DescribeTagsInput)
 		if !ok {
-			r.Error = awserr.NewRequestFailure(
-				awserr.New("UnknownError", "500 Internal Server Error", fmt.Errorf("unsupported request")), 500, "",
-			)
+			r.Error = apiError("UnknownError", "unsupported request")
 			return
 		}
 
-		restrictToKey := []*string{}
+		restrictToKey := []string{}
 		for _, filter := range input.Filters {
 			switch *filter.Name {
 			case "resource-id":
 			case "key":
 				restrictToKey = filter.Values
 			default:
-				r.Error = awserr.NewRequestFailure(
-					awserr.New("UnknownError", "500 Internal Server Error", fmt.Errorf("unsupported filter %s", *filter.Name)), 500, "",
-				)
+				r.Error = apiError("UnknownError", fmt.Sprintf("unsupported filter %s", *filter.Name))
 			}
 		}
 
@@ -81,7 +279,33 @@ func serveTags(tags map[string]string) func(*request.Request) {
 			if len(restrictToKey) > 0 && !includesString(restrictToKey, key) {
 				continue
 			}
-			data.Tags = append(data.Tags, &ec2.TagDescription{Key: aws.String(key), Value: aws.String(value)})
+			data.Tags = append(data.Tags, types.TagDescription{Key: aws.String(key), Value: aws.String(value)})
+		}
+	}
+}
+
+// serveWritableTags serves DescribeTags, CreateTags and DeleteTags on tags,
+// recording the CreateTags and DeleteTags calls made as "create key=value"
+// and "delete key"
+func serveWritableTags(tags map[string]string, calls *[]string) func(*fakeRequest) {
+	var mu sync.Mutex
+	return func(r *fakeRequest) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch input := r.Params.(type) {
+		case *ec2.CreateTagsInput:
+			for _, tag := range input.Tags {
+				tags[*tag.Key] = *tag.Value
+				*calls = append(*calls, fmt.Sprintf("create %s=%s", *tag.Key, *tag.Value))
+			}
+		case *ec2.DeleteTagsInput:
+			for _, tag := range input.Tags {
+				delete(tags, *tag.Key)
+				*calls = append(*calls, fmt.Sprintf("delete %s", *tag.Key))
+			}
+		default:
+			serveTags(tags)(r)
 		}
 	}
 }
@@ -90,7 +314,7 @@ func TestTagsFs_GetAttr_regularFile(t *testing.T) {
 	client, dir, cleanup := setup(t)
 	defer cleanup()
 
-	client.Handlers.Send.PushBack(serveTags(map[string]string{"name": "MyName"}))
+	client.PushBack(serveTags(map[string]string{"name": "MyName"}))
 
 	info, err := os.Stat(path.Join(dir, "name"))
 	if err != nil {
@@ -108,7 +332,7 @@ func TestTagsFs_GetAttr_root(t *testing.T) {
 	client, dir, cleanup := setup(t)
 	defer cleanup()
 
-	client.Handlers.Send.PushBack(serveTags(map[string]string{"name": "MyName"}))
+	client.PushBack(serveTags(map[string]string{"name": "MyName"}))
 
 	info, err := os.Stat(path.Join(dir, ""))
 	if err != nil {
@@ -126,7 +350,7 @@ func TestTagsFs_GetAttr_noFile(t *testing.T) {
 	client, dir, cleanup := setup(t)
 	defer cleanup()
 
-	client.Handlers.Send.PushBack(serveTags(map[string]string{"name": "MyName"}))
+	client.PushBack(serveTags(map[string]string{"name": "MyName"}))
 
 	_, err := os.Stat(path.Join(dir, "foobar"))
 	if !os.IsNotExist(err) {
@@ -138,10 +362,8 @@ func TestTagsFs_GetAttr_error(t *testing.T) {
 	client, dir, cleanup := setup(t)
 	defer cleanup()
 
-	client.Handlers.Send.PushBack(func(r *request.Request) {
-		r.Error = awserr.NewRequestFailure(
-			awserr.New("UnknownError", "500 Internal Server Error", fmt.Errorf("mock error")), 500, "",
-		)
+	client.PushBack(func(r *fakeRequest) {
+		r.Error = apiError("UnknownError", "mock error")
 	})
 
 	_, err := os.Stat(path.Join(dir, "name"))
@@ -154,7 +376,7 @@ func TestTagsFs_OpenDir(t *testing.T) {
 	client, dir, cleanup := setup(t)
 	defer cleanup()
 
-	client.Handlers.Send.PushBack(serveTags(map[string]string{"name": "MyName", "role": "MyRole"}))
+	client.PushBack(serveTags(map[string]string{"name": "MyName", "role": "MyRole"}))
 
 	fileInfos, err := ioutil.ReadDir(path.Join(dir, "/"))
 	if err != nil {
@@ -170,8 +392,8 @@ func TestTagsFs_OpenDir(t *testing.T) {
 		}
 	}
 
-	if !reflect.DeepEqual([]string{"name", "role"}, names) {
-		t.Errorf(`returned entries %+v, expected %+v`, names, []string{"name", "role"})
+	if expected := []string{"name", "role", "tags.env", "tags.json"}; !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %+v, expected %+v`, names, expected)
 	}
 }
 
@@ -179,7 +401,7 @@ func TestTagsFs_OpenDir_notDir(t *testing.T) {
 	client, dir, cleanup := setup(t)
 	defer cleanup()
 
-	client.Handlers.Send.PushBack(serveTags(map[string]string{"name": "MyName"}))
+	client.PushBack(serveTags(map[string]string{"name": "MyName"}))
 
 	_, err := ioutil.ReadDir(path.Join(dir, "name"))
 	if syscallError := (&os.SyscallError{}); errors.As(err, &syscallError) && syscallError.Err != syscall.ENOTDIR {
@@ -201,10 +423,8 @@ func TestTagsFs_OpenDir_error(t *testing.T) {
 	client, dir, cleanup := setup(t)
 	defer cleanup()
 
-	client.Handlers.Send.PushBack(func(r *request.Request) {
-		r.Error = awserr.NewRequestFailure(
-			awserr.New("UnknownError", "500 Internal Server Error", fmt.Errorf("mock error")), 500, "",
-		)
+	client.PushBack(func(r *fakeRequest) {
+		r.Error = apiError("UnknownError", "mock error")
 	})
 
 	_, err := ioutil.ReadDir(path.Join(dir, "/"))
@@ -217,7 +437,7 @@ func TestTagsFs_Open(t *testing.T) {
 	client, dir, cleanup := setup(t)
 	defer cleanup()
 
-	client.Handlers.Send.PushBack(serveTags(map[string]string{"name": "MyName"}))
+	client.PushBack(serveTags(map[string]string{"name": "MyName"}))
 
 	contents, err := ioutil.ReadFile(path.Join(dir, "/name"))
 	if err != nil {
@@ -234,15 +454,15 @@ func TestTagsFs_Open_noFile(t *testing.T) {
 	defer cleanup()
 
 	numReqs := 0
-	client.Handlers.Send.PushBack(serveTags(map[string]string{"name": "MyName"}))
-	client.Handlers.Send.PushBack(func(r *request.Request) {
+	client.PushBack(serveTags(map[string]string{"name": "MyName"}))
+	client.PushBack(func(r *fakeRequest) {
 		if numReqs == 0 { // Allow GetAttr call to succeed
 			numReqs++
 			return
 		}
 
 		data := r.Data.(*ec2.DescribeTagsOutput)
-		data.Tags = []*ec2.TagDescription{}
+		data.Tags = []types.TagDescription{}
 	})
 
 	_, err := ioutil.ReadFile(path.Join(dir, "name"))
@@ -256,16 +476,14 @@ func TestTagsFs_Open_error(t *testing.T) {
 	defer cleanup()
 
 	numReqs := 0
-	client.Handlers.Send.PushBack(serveTags(map[string]string{"name": "MyName"}))
-	client.Handlers.Send.PushBack(func(r *request.Request) {
+	client.PushBack(serveTags(map[string]string{"name": "MyName"}))
+	client.PushBack(func(r *fakeRequest) {
 		if numReqs == 0 { // Allow GetAttr call to succeed
 			numReqs++
 			return
 		}
 
-		r.Error = awserr.NewRequestFailure(
-			awserr.New("UnknownError", "500 Internal Server Error", fmt.Errorf("mock error")), 500, "",
-		)
+		r.Error = apiError("UnknownError", "mock error")
 	})
 
 	_, err := ioutil.ReadFile(path.Join(dir, "name"))
@@ -278,7 +496,7 @@ func TestTagsFs_ReadOnly(t *testing.T) {
 	client, dir, cleanup := setup(t)
 	defer cleanup()
 
-	client.Handlers.Send.PushBack(serveTags(map[string]string{"name": "MyName"}))
+	client.PushBack(serveTags(map[string]string{"name": "MyName"}))
 
 	err := ioutil.WriteFile(path.Join(dir, "name"), []byte("hello world"), os.ModePerm)
 	if !os.IsPermission(err) {
@@ -290,3 +508,874 @@ func TestTagsFs_ReadOnly(t *testing.T) {
 		t.Fatalf(`expected to get permissions error, got %s`, err)
 	}
 }
+
+func TestTagsFs_Writable_write(t *testing.T) {
+	client, dir, cleanup := setupFs(t, func(fs *TagsFs) { fs.Writable = true })
+	defer cleanup()
+
+	tags := map[string]string{"name": "MyName"}
+	calls := []string{}
+	client.PushBack(serveWritableTags(tags, &calls))
+
+	if err := ioutil.WriteFile(path.Join(dir, "name"), []byte("OtherName\n"), 0644); err != nil {
+		t.Fatalf(`error writing file: %s`, err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "role"), []byte("MyRole"), 0644); err != nil {
+		t.Fatalf(`error creating file: %s`, err)
+	}
+
+	expected := []string{"create name=OtherName", "create role=MyRole"}
+	if !reflect.DeepEqual(expected, calls) {
+		t.Errorf(`made calls %q, expected %q`, calls, expected)
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(dir, "name"))
+	if err != nil {
+		t.Fatalf(`error reading file: %s`, err)
+	}
+	if string(contents) != "OtherName" {
+		t.Errorf(`contents were %q, expected %q`, contents, "OtherName")
+	}
+}
+
+func TestTagsFs_Writable_removeAndRename(t *testing.T) {
+	client, dir, cleanup := setupFs(t, func(fs *TagsFs) { fs.Writable = true })
+	defer cleanup()
+
+	tags := map[string]string{"name": "MyName", "role": "MyRole"}
+	calls := []string{}
+	client.PushBack(serveWritableTags(tags, &calls))
+
+	if err := os.Remove(path.Join(dir, "role")); err != nil {
+		t.Fatalf(`error removing file: %s`, err)
+	}
+	if err := os.Rename(path.Join(dir, "name"), path.Join(dir, "Name")); err != nil {
+		t.Fatalf(`error renaming file: %s`, err)
+	}
+
+	expected := []string{"delete role", "create Name=MyName", "delete name"}
+	if !reflect.DeepEqual(expected, calls) {
+		t.Errorf(`made calls %q, expected %q`, calls, expected)
+	}
+	if !reflect.DeepEqual(map[string]string{"Name": "MyName"}, tags) {
+		t.Errorf(`tags were %q after changes`, tags)
+	}
+}
+
+func TestTagsFs_Writable_denied(t *testing.T) {
+	client, dir, cleanup := setupFs(t, func(fs *TagsFs) { fs.Writable = true })
+	defer cleanup()
+
+	client.PushBack(func(r *fakeRequest) {
+		if _, ok := r.Params.(*ec2.CreateTagsInput); ok {
+			r.Error = apiError("UnauthorizedOperation", "You are not authorized to perform this operation.")
+			return
+		}
+		serveTags(map[string]string{"name": "MyName"})(r)
+	})
+
+	err := ioutil.WriteFile(path.Join(dir, "name"), []byte("OtherName"), 0644)
+	if syscallError := (&os.PathError{}); !errors.As(err, &syscallError) || syscallError.Err != syscall.EACCES {
+		t.Fatalf(`expected EACCES, got %v`, err)
+	}
+}
+
+func TestTagsFs_Writable_otherUser(t *testing.T) {
+	source := &mapSource{tags: map[string]string{"Name": "web", "Team": "infra"}}
+	fs := NewFromSource(source, logging.NewLogger())
+	fs.Writable = true
+	context := &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: uint32(os.Getuid() + 1000)}}}
+
+	if _, code := fs.Open("Name", fuse.O_ANYWRITE, context); code != fuse.EACCES {
+		t.Errorf(`expected EACCES opening a tag for writing, got %s`, code)
+	}
+	if _, code := fs.Create("Role", syscall.O_WRONLY, 0644, context); code != fuse.EACCES {
+		t.Errorf(`expected EACCES creating a tag, got %s`, code)
+	}
+	if code := fs.Truncate("Name", 0, context); code != fuse.EACCES {
+		t.Errorf(`expected EACCES truncating a tag, got %s`, code)
+	}
+	if code := fs.Unlink("Name", context); code != fuse.EACCES {
+		t.Errorf(`expected EACCES deleting a tag, got %s`, code)
+	}
+	if code := fs.Rename("Name", "Role", context); code != fuse.EACCES {
+		t.Errorf(`expected EACCES renaming a tag, got %s`, code)
+	}
+	if code := fs.Utimens("Name", nil, nil, context); code != fuse.EACCES {
+		t.Errorf(`expected EACCES touching a tag, got %s`, code)
+	}
+	if expected := map[string]string{"Name": "web", "Team": "infra"}; !reflect.DeepEqual(expected, source.tags) {
+		t.Errorf(`tags changed to %q, expected %q`, source.tags, expected)
+	}
+
+	// reading is still allowed
+	if _, code := fs.Open("Name", syscall.O_RDONLY, context); code != fuse.OK {
+		t.Errorf(`expected other users to read tags, got %s`, code)
+	}
+}
+
+func TestTagsFs_Writable_tooLarge(t *testing.T) {
+	source := &mapSource{tags: map[string]string{"Name": "web"}}
+	fs := NewFromSource(source, logging.NewLogger())
+	fs.Writable = true
+
+	file, code := fs.Open("Name", syscall.O_WRONLY, nil)
+	if code != fuse.OK {
+		t.Fatalf(`error opening tag for writing: %s`, code)
+	}
+	for _, c := range []struct {
+		data     []byte
+		off      int64
+		expected fuse.Status
+	}{
+		{[]byte("x"), -1, fuse.EINVAL},
+		{[]byte("x"), 1 << 40, fuse.Status(syscall.EFBIG)},
+		{[]byte("x"), 1<<63 - 1, fuse.Status(syscall.EFBIG)},
+		{make([]byte, maxValueSize+1), 0, fuse.Status(syscall.EFBIG)},
+		{[]byte(strings.Repeat("é", 256) + "\n"), 0, fuse.OK},
+	} {
+		if _, code := file.Write(c.data, c.off); code != c.expected {
+			t.Errorf(`writing %d bytes at %d: %s, expected %s`, len(c.data), c.off, code, c.expected)
+		}
+	}
+}
+
+func TestTagsFs_IMDS(t *testing.T) {
+	dir, cleanup := setupIMDS(t, map[string]string{"Name": "MyName", "Role": "MyRole"})
+	defer cleanup()
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf(`error listing directory: %s`, err)
+	}
+	names := []string{}
+	for _, fileInfo := range fileInfos {
+		names = append(names, fileInfo.Name())
+	}
+	if expected := []string{"Name", "Role", "tags.env", "tags.json"}; !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %+v, expected %+v`, names, expected)
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(dir, "Name"))
+	if err != nil {
+		t.Fatalf(`error reading file: %s`, err)
+	}
+	if string(contents) != "MyName" {
+		t.Errorf(`contents were %s, expected %s`, string(contents), "MyName")
+	}
+
+	if _, err := os.Stat(path.Join(dir, "foobar")); !os.IsNotExist(err) {
+		t.Errorf(`expected to get an error that the file doesn't exist, got %s`, err)
+	}
+
+	// tags from the instance metadata are read-only even if Writable is set
+	err = ioutil.WriteFile(path.Join(dir, "Name"), []byte("OtherName"), 0644)
+	if !os.IsPermission(err) {
+		t.Errorf(`expected to get permissions error, got %s`, err)
+	}
+}
+
+func TestTagsFs_IMDS_disabled(t *testing.T) {
+	dir, cleanup := setupIMDS(t, nil)
+	defer cleanup()
+
+	_, err := ioutil.ReadDir(dir)
+	if syscallError := (&os.PathError{}); !errors.As(err, &syscallError) || syscallError.Err != syscall.EIO {
+		t.Fatalf(`expected EIO, got %v`, err)
+	}
+}
+
+func TestIMDSTagsAvailable(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !enabled || r.URL.Path != "/meta-data/tags/instance" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, "Name")
+		}))
+
+		available, err := IMDSTagsAvailable(metadatafs.NewIMDSv1Client(server.URL+"/", logging.NewLogger()))
+		server.Close()
+		if err != nil {
+			t.Fatalf(`error checking for instance metadata tags: %s`, err)
+		}
+		if available != enabled {
+			t.Errorf(`reported available %t, expected %t`, available, enabled)
+		}
+	}
+}
+
+func TestTagsFs_OpenDir_paginated(t *testing.T) {
+	client, dir, cleanup := setup(t)
+	defer cleanup()
+
+	// serve one tag per page
+	keys := []string{"a", "b", "c"}
+	client.PushBack(func(r *fakeRequest) {
+		input := r.Params.(*ec2.DescribeTagsInput)
+		i := 0
+		if input.NextToken != nil {
+			i, _ = strconv.Atoi(*input.NextToken)
+		}
+
+		data := r.Data.(*ec2.DescribeTagsOutput)
+		data.Tags = []types.TagDescription{{Key: aws.String(keys[i]), Value: aws.String("value")}}
+		if i+1 < len(keys) {
+			data.NextToken = aws.String(strconv.Itoa(i + 1))
+		}
+	})
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf(`error listing directory: %s`, err)
+	}
+	names := []string{}
+	for _, fileInfo := range fileInfos {
+		names = append(names, fileInfo.Name())
+	}
+	if expected := append(keys, "tags.env", "tags.json"); !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %+v, expected %+v`, names, expected)
+	}
+}
+
+func TestTagsFs_RefreshInterval(t *testing.T) {
+	svc := newFakeEC2()
+
+	tags := map[string]string{"name": "MyName", "role": "MyRole"}
+	requests := 0
+	svc.PushBack(func(r *fakeRequest) {
+		requests++
+		serveTags(tags)(r)
+	})
+
+	source := NewEC2Source(svc, "i-123456", logging.NewLogger())
+	source.RefreshInterval = time.Hour
+	fs := NewFromSource(source, logging.NewLogger())
+
+	fs.OpenDir("", nil)
+	fs.GetAttr("name", nil)
+	fs.Open("role", 0, nil)
+	if requests != 1 {
+		t.Errorf(`made %d requests, expected 1`, requests)
+	}
+
+	source.fetched = time.Now().Add(-time.Hour)
+	tags["name"] = "OtherName"
+	if attr, _ := fs.GetAttr("name", nil); attr == nil || attr.Size != uint64(len("OtherName")) {
+		t.Errorf(`returned attributes %+v for refreshed tag`, attr)
+	}
+	if requests != 2 {
+		t.Errorf(`made %d requests, expected 2`, requests)
+	}
+}
+
+func TestTagsFs_throttled(t *testing.T) {
+	svc := newFakeEC2()
+
+	throttled := false
+	requests := 0
+	svc.PushBack(func(r *fakeRequest) {
+		requests++
+		if throttled {
+			r.Error = apiError("RequestLimitExceeded", "Request limit exceeded.")
+			return
+		}
+		serveTags(map[string]string{"name": "MyName"})(r)
+	})
+
+	source := NewEC2Source(svc, "i-123456", logging.NewLogger())
+	fs := NewFromSource(source, logging.NewLogger())
+
+	if _, code := fs.GetAttr("name", nil); code != fuse.OK {
+		t.Fatalf(`expected OK, got %s`, code)
+	}
+
+	// the stale snapshot is served and refreshes are held off
+	throttled = true
+	for i := 0; i < 3; i++ {
+		if _, code := fs.GetAttr("name", nil); code != fuse.OK {
+			t.Errorf(`expected stale snapshot to be served, got %s`, code)
+		}
+	}
+	if requests != 2 {
+		t.Errorf(`made %d requests, expected 2`, requests)
+	}
+	if source.backoff != minRefreshBackoff {
+		t.Errorf(`backed off for %s, expected %s`, source.backoff, minRefreshBackoff)
+	}
+
+	// the back off doubles while throttled
+	source.retryAt = time.Time{}
+	fs.GetAttr("name", nil)
+	if source.backoff != 2*minRefreshBackoff {
+		t.Errorf(`backed off for %s, expected %s`, source.backoff, 2*minRefreshBackoff)
+	}
+
+	// and resets once requests succeed
+	throttled = false
+	source.retryAt = time.Time{}
+	fs.GetAttr("name", nil)
+	if source.backoff != 0 {
+		t.Errorf(`backed off for %s after success, expected 0`, source.backoff)
+	}
+}
+
+func TestTagKey(t *testing.T) {
+	for _, nested := range []bool{false, true} {
+		fs := &TagsFs{NestedKeys: nested}
+		for _, key := range []string{"Name", "team/owner", "50%", "%2F", ".", "..", "a/./b", "/a", "a//b", "a/", "日本語"} {
+			name := fs.keyPath(key)
+			if name == "." || name == ".." || (!nested && strings.Contains(name, "/")) {
+				t.Errorf(`key %q has invalid name %q (nested %t)`, key, name, nested)
+			}
+			if got, ok := fs.tagKey(name); !ok || got != key {
+				t.Errorf(`name %q of key %q maps back to %q, %t (nested %t)`, name, key, got, ok, nested)
+			}
+		}
+	}
+
+	fs := &TagsFs{}
+	for name, expected := range map[string]string{"a%2Fb": "a/b", "%2E%2E": "..", "100%25": "100%"} {
+		if key, ok := fs.tagKey(name); !ok || key != expected {
+			t.Errorf(`name %q maps to key %q, %t, expected %q`, name, key, ok, expected)
+		}
+	}
+	for _, name := range []string{"%41", "%2f", "100%", "%zz", "."} {
+		if key, ok := fs.tagKey(name); ok {
+			t.Errorf(`non-canonical name %q maps to key %q`, name, key)
+		}
+	}
+}
+
+func TestTagsFs_escapedKeys(t *testing.T) {
+	client, dir, cleanup := setup(t)
+	defer cleanup()
+
+	client.PushBack(serveTags(map[string]string{"team/owner": "alice", "..": "dots", "50%": "half"}))
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf(`error listing directory: %s`, err)
+	}
+	names := []string{}
+	for _, fileInfo := range fileInfos {
+		names = append(names, fileInfo.Name())
+	}
+	expected := []string{"%2E%2E", "50%25", "tags.env", "tags.json", "team%2Fowner"}
+	if !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %q, expected %q`, names, expected)
+	}
+
+	for name, value := range map[string]string{"team%2Fowner": "alice", "%2E%2E": "dots", "50%25": "half"} {
+		contents, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Errorf(`error reading %s: %s`, name, err)
+		} else if string(contents) != value {
+			t.Errorf(`contents of %s were %q, expected %q`, name, contents, value)
+		}
+	}
+}
+
+func TestTagsFs_nestedKeys(t *testing.T) {
+	client, dir, cleanup := setupFs(t, func(fs *TagsFs) { fs.NestedKeys = true })
+	defer cleanup()
+
+	client.PushBack(serveTags(map[string]string{
+		"Name":            "MyName",
+		"team/owner":      "alice",
+		"team/cost/group": "infra",
+		"a//b":            "odd",
+	}))
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf(`error listing directory: %s`, err)
+	}
+	names := []string{}
+	for _, fileInfo := range fileInfos {
+		names = append(names, fmt.Sprintf("%s %t", fileInfo.Name(), fileInfo.IsDir()))
+	}
+	expected := []string{"Name false", "a%2F%2Fb false", "tags.env false", "tags.json false", "team true"}
+	if !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %q, expected %q`, names, expected)
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(dir, "team/cost/group"))
+	if err != nil {
+		t.Fatalf(`error reading file: %s`, err)
+	}
+	if string(contents) != "infra" {
+		t.Errorf(`contents were %q, expected %q`, contents, "infra")
+	}
+
+	if _, err := os.Stat(path.Join(dir, "team/foo")); !os.IsNotExist(err) {
+		t.Errorf(`expected to get an error that the file doesn't exist, got %s`, err)
+	}
+}
+
+// serveResourceTags serves DescribeTags for several resources and
+// DescribeInstances for an instance with the given volumes
+func serveResourceTags(tags map[string]map[string]string, volumes []string) func(*fakeRequest) {
+	return func(r *fakeRequest) {
+		switch input := r.Params.(type) {
+		case *ec2.DescribeInstancesInput:
+			instance := types.Instance{InstanceId: aws.String(input.InstanceIds[0])}
+			for _, volume := range volumes {
+				instance.BlockDeviceMappings = append(instance.BlockDeviceMappings, types.InstanceBlockDeviceMapping{
+					Ebs: &types.EbsInstanceBlockDevice{VolumeId: aws.String(volume)},
+				})
+			}
+			data := r.Data.(*ec2.DescribeInstancesOutput)
+			data.Reservations = []types.Reservation{{Instances: []types.Instance{instance}}}
+		case *ec2.DescribeTagsInput:
+			for _, filter := range input.Filters {
+				if *filter.Name == "resource-id" {
+					serveTags(tags[filter.Values[0]])(r)
+				}
+			}
+		}
+	}
+}
+
+func TestRelatedFs(t *testing.T) {
+	metadata := map[string]string{
+		"/meta-data/mac":                      "0e:00:00:00:00:01",
+		"/meta-data/network/interfaces/macs/": "0e:00:00:00:00:01/\n0e:00:00:00:00:02/",
+		"/meta-data/network/interfaces/macs/0e:00:00:00:00:01/interface-id":       "eni-1",
+		"/meta-data/network/interfaces/macs/0e:00:00:00:00:01/security-group-ids": "sg-1\nsg-2",
+		"/meta-data/network/interfaces/macs/0e:00:00:00:00:01/subnet-id":          "subnet-1",
+		"/meta-data/network/interfaces/macs/0e:00:00:00:00:01/vpc-id":             "vpc-1",
+		"/meta-data/network/interfaces/macs/0e:00:00:00:00:02/interface-id":       "eni-2",
+		"/meta-data/network/interfaces/macs/0e:00:00:00:00:02/security-group-ids": "sg-2",
+		"/meta-data/network/interfaces/macs/0e:00:00:00:00:02/subnet-id":          "subnet-2",
+		"/meta-data/network/interfaces/macs/0e:00:00:00:00:02/vpc-id":             "vpc-1",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value, ok := metadata[r.URL.Path]
+		if !ok {
+			value, ok = metadata[r.URL.Path+"/"]
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, value)
+	}))
+	defer server.Close()
+
+	var related *RelatedFs
+	client, dir, cleanup := setupRelated(t, func(fs *TagsFs) pathfs.FileSystem {
+		fs.Writable = true
+		related = NewRelated(fs, fs.Source.(*EC2Source), metadatafs.NewIMDSv1Client(server.URL+"/", logging.NewLogger()), logging.NewLogger())
+		return related
+	})
+	defer cleanup()
+
+	client.PushBack(serveResourceTags(map[string]map[string]string{
+		"i-123456": {"Name": "MyName", "vpc": "hidden"},
+		"vol-1":    {"Name": "root"},
+		"subnet-1": {"Name": "private-a"},
+		"sg-2":     {"Name": "web"},
+	}, []string{"vol-1", "vol-2"}))
+
+	listing := func(name string) []string {
+		fileInfos, err := ioutil.ReadDir(path.Join(dir, name))
+		if err != nil {
+			t.Fatalf(`error listing %s: %s`, name, err)
+		}
+		names := []string{}
+		for _, fileInfo := range fileInfos {
+			names = append(names, fileInfo.Name())
+		}
+		return names
+	}
+
+	expected := []string{"Name", "network-interfaces", "security-groups", "subnet", "tags.env", "tags.json", "volumes", "vpc"}
+	if names := listing(""); !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %q, expected %q`, names, expected)
+	}
+	for name, expected := range map[string][]string{
+		"volumes":            {"vol-1", "vol-2"},
+		"network-interfaces": {"eni-1", "eni-2"},
+		"security-groups":    {"sg-1", "sg-2"},
+		"vpc":                {"tags.env", "tags.json"},
+	} {
+		if names := listing(name); !reflect.DeepEqual(expected, names) {
+			t.Errorf(`returned entries %q for %s, expected %q`, names, name, expected)
+		}
+	}
+
+	for name, value := range map[string]string{
+		"Name":                      "MyName",
+		"volumes/vol-1/Name":        "root",
+		"subnet/Name":               "private-a",
+		"security-groups/sg-2/Name": "web",
+	} {
+		contents, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Errorf(`error reading %s: %s`, name, err)
+		} else if string(contents) != value {
+			t.Errorf(`contents of %s were %q, expected %q`, name, contents, value)
+		}
+	}
+
+	if _, err := os.Stat(path.Join(dir, "volumes/vol-3")); !os.IsNotExist(err) {
+		t.Errorf(`expected unrelated volume not to exist, got %s`, err)
+	}
+
+	// shared resources stay read-only even when the instance tags are writable
+	if err := ioutil.WriteFile(path.Join(dir, "subnet/Name"), []byte("public-a"), 0644); !os.IsPermission(err) {
+		t.Errorf(`expected writing a related resource's tag to be denied, got %v`, err)
+	}
+}
+
+func TestTagsFs_OnChange(t *testing.T) {
+	svc := newFakeEC2()
+
+	tags := map[string]string{"name": "MyName"}
+	svc.PushBack(func(r *fakeRequest) { serveTags(tags)(r) })
+
+	changes := [][]string{}
+	fs := New(svc, "i-123456", logging.NewLogger())
+	fs.OnChange = func(name string, old, new []byte) {
+		changes = append(changes, []string{name, fmt.Sprint(old == nil), string(old), fmt.Sprint(new == nil), string(new)})
+	}
+
+	fs.GetAttr("name", nil)
+	fs.GetAttr("name", nil)
+	tags["name"] = "OtherName"
+	fs.Open("name", 0, nil)
+	delete(tags, "name")
+	fs.GetAttr("name", nil)
+
+	expected := [][]string{
+		{"name", "false", "MyName", "false", "OtherName"},
+		{"name", "false", "OtherName", "true", ""},
+	}
+	if !reflect.DeepEqual(expected, changes) {
+		t.Errorf(`reported changes %q, expected %q`, changes, expected)
+	}
+}
+
+func TestTagsFs_OnChange_refresh(t *testing.T) {
+	svc := newFakeEC2()
+
+	tags := map[string]string{"name": "MyName", "team": "web"}
+	svc.PushBack(func(r *fakeRequest) { serveTags(tags)(r) })
+
+	changes := [][]string{}
+	fs := New(svc, "i-123456", logging.NewLogger())
+	fs.OnChange = func(name string, old, new []byte) {
+		changes = append(changes, []string{name, fmt.Sprint(old == nil), string(old), fmt.Sprint(new == nil), string(new)})
+	}
+
+	// refreshing the snapshot reports changes to tags that were never read
+	fs.OpenDir("", nil)
+	delete(tags, "team")
+	tags["app/role"] = "api"
+	fs.OpenDir("", nil)
+
+	expected := [][]string{
+		{"app%2Frole", "true", "", "false", "api"},
+		{"team", "false", "web", "true", ""},
+	}
+	if !reflect.DeepEqual(expected, changes) {
+		t.Errorf(`reported changes %q, expected %q`, changes, expected)
+	}
+
+	// nor are they reported again when read
+	fs.GetAttr("app%2Frole", nil)
+	if len(changes) != len(expected) {
+		t.Errorf(`reported changes %q after reading, expected %q`, changes, expected)
+	}
+}
+
+func TestTagsFs_source(t *testing.T) {
+	source := &mapSource{tags: map[string]string{"name": "MyName"}}
+	dir, cleanup := setupSource(t, source, nil)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(path.Join(dir, "role"), []byte("MyRole\n"), 0644); err != nil {
+		t.Fatalf(`error writing tag: %s`, err)
+	}
+	if err := os.Remove(path.Join(dir, "name")); err != nil {
+		t.Fatalf(`error removing tag: %s`, err)
+	}
+	expected := map[string]string{"role": "MyRole"}
+	if !reflect.DeepEqual(expected, source.tags) {
+		t.Errorf(`source has tags %+v, expected %+v`, source.tags, expected)
+	}
+
+	source.err = &StatusError{fuse.EACCES, errors.New("denied")}
+	if err := os.Remove(path.Join(dir, "role")); !errors.Is(err, syscall.EACCES) {
+		t.Errorf(`expected EACCES removing tag, got %v`, err)
+	}
+
+	source.err = errors.New("failed")
+	if err := os.Remove(path.Join(dir, "role")); !errors.Is(err, syscall.EIO) {
+		t.Errorf(`expected EIO removing tag, got %v`, err)
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	file, err := ioutil.TempFile("", "ec2metadata-tags")
+	if err != nil {
+		t.Fatalf("creating tempfile failed: %v", err)
+	}
+	defer os.Remove(file.Name())
+	fmt.Fprint(file, `{"name": "MyName", "role": "MyRole"}`)
+	file.Close()
+
+	dir, cleanup := setupSource(t, NewFileSource(file.Name(), logging.NewLogger()), nil)
+	defer cleanup()
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf(`error listing directory: %s`, err)
+	}
+	names := []string{}
+	for _, fileInfo := range fileInfos {
+		names = append(names, fileInfo.Name())
+		if fileInfo.Mode().Perm() != 0444 {
+			t.Errorf(`%s has mode %s, expected read-only`, fileInfo.Name(), fileInfo.Mode())
+		}
+	}
+	if expected := []string{"name", "role", "tags.env", "tags.json"}; !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %+v, expected %+v`, names, expected)
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(dir, "role"))
+	if err != nil || string(contents) != "MyRole" {
+		t.Errorf(`read %q, %v, expected "MyRole"`, contents, err)
+	}
+
+	if err := ioutil.WriteFile(file.Name(), []byte("not json"), 0644); err != nil {
+		t.Fatalf(`error writing tags file: %s`, err)
+	}
+	if _, err := ioutil.ReadDir(dir); !errors.Is(err, syscall.EIO) {
+		t.Errorf(`expected EIO for invalid tags file, got %v`, err)
+	}
+}
+
+func TestTagsFs_filter(t *testing.T) {
+	source := &mapSource{tags: map[string]string{
+		"Name":                          "MyName",
+		"app:env":                       "prod",
+		"env":                           "shadowed",
+		"aws:cloudformation:stack-name": "stack",
+	}}
+	dir, cleanup := setupSource(t, source, func(fs *TagsFs) {
+		filter, err := NewKeyFilter(nil, []string{"aws:*"}, "app:")
+		if err != nil {
+			t.Fatalf(`error creating filter: %s`, err)
+		}
+		fs.Filter = filter
+	})
+	defer cleanup()
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf(`error listing directory: %s`, err)
+	}
+	names := []string{}
+	for _, fileInfo := range fileInfos {
+		names = append(names, fileInfo.Name())
+	}
+	if expected := []string{"Name", "env", "tags.env", "tags.json"}; !reflect.DeepEqual(expected, names) {
+		t.Errorf(`returned entries %+v, expected %+v`, names, expected)
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(dir, "env"))
+	if err != nil || string(contents) != "prod" {
+		t.Errorf(`read %q, %v, expected "prod"`, contents, err)
+	}
+
+	for _, name := range []string{"aws:cloudformation:stack-name", "app:env"} {
+		if _, err := os.Stat(path.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf(`expected %s not to exist, got %v`, name, err)
+		}
+		if _, err := os.Open(path.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf(`expected opening %s to fail with ENOENT, got %v`, name, err)
+		}
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "env"), []byte("staging\n"), 0644); err != nil {
+		t.Fatalf(`error writing tag: %s`, err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "role"), []byte("web\n"), 0644); err != nil {
+		t.Fatalf(`error writing tag: %s`, err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "aws:new"), []byte("value"), 0644); !errors.Is(err, syscall.EPERM) {
+		t.Errorf(`expected EPERM creating filtered out tag, got %v`, err)
+	}
+
+	expected := map[string]string{
+		"Name":                          "MyName",
+		"app:env":                       "staging",
+		"env":                           "shadowed",
+		"role":                          "web",
+		"aws:cloudformation:stack-name": "stack",
+	}
+	if !reflect.DeepEqual(expected, source.tags) {
+		t.Errorf(`source has tags %+v, expected %+v`, source.tags, expected)
+	}
+}
+
+func TestTagsFs_Tag(t *testing.T) {
+	fs := NewFromSource(&mapSource{tags: map[string]string{
+		"app:env":                       "prod",
+		"env":                           "shadowed",
+		"aws:cloudformation:stack-name": "stack",
+	}}, logging.NewLogger())
+	filter, err := NewKeyFilter(nil, []string{"aws:*"}, "app:")
+	if err != nil {
+		t.Fatalf(`error creating filter: %s`, err)
+	}
+	fs.Filter = filter
+
+	for key, expected := range map[string]struct {
+		value string
+		ok    bool
+	}{
+		"env":                           {"prod", true},
+		"aws:cloudformation:stack-name": {"", false},
+		"Name":                          {"", false},
+	} {
+		value, ok, err := fs.Tag(context.Background(), key)
+		if err != nil || value != expected.value || ok != expected.ok {
+			t.Errorf(`tag %s: %q, %t, %v, expected %q, %t`, key, value, ok, err, expected.value, expected.ok)
+		}
+	}
+}
+
+func TestTagsFs_aggregates(t *testing.T) {
+	client, dir, cleanup := setupFs(t, func(fs *TagsFs) {
+		fs.Writable = true
+	})
+	defer cleanup()
+	client.PushBack(serveTags(map[string]string{
+		"Name":      "it's web-1",
+		"app:env":   "prod",
+		"app-env":   "staging",
+		"tags.json": "hidden",
+		"multi":     "line 1\nline $2 `3`",
+	}))
+
+	contents, err := ioutil.ReadFile(path.Join(dir, "tags.json"))
+	if err != nil {
+		t.Fatalf(`error reading tags.json: %s`, err)
+	}
+	tags := map[string]string{}
+	if err := json.Unmarshal(contents, &tags); err != nil {
+		t.Fatalf(`error parsing tags.json %q: %s`, contents, err)
+	}
+	if len(tags) != 5 || tags["Name"] != "it's web-1" || tags["tags.json"] != "hidden" {
+		t.Errorf(`tags.json holds %+v, expected all of the tags`, tags)
+	}
+
+	contents, err = ioutil.ReadFile(path.Join(dir, "tags.env"))
+	if err != nil {
+		t.Fatalf(`error reading tags.env: %s`, err)
+	}
+	expected := "TAG_NAME='it'\\''s web-1'\n" +
+		"TAG_APP_ENV='staging'\n" +
+		"TAG_MULTI='line 1\nline $2 `3`'\n" +
+		"TAG_TAGS_JSON='hidden'\n"
+	if string(contents) != expected {
+		t.Errorf(`tags.env holds %q, expected %q`, contents, expected)
+	}
+
+	out, err := exec.Command("sh", "-c", `. "$1" && printf '%s|%s' "$TAG_NAME" "$TAG_MULTI"`, "sh", path.Join(dir, "tags.env")).Output()
+	if err != nil {
+		t.Fatalf(`error sourcing tags.env: %s`, err)
+	}
+	if expected := "it's web-1|line 1\nline $2 `3`"; string(out) != expected {
+		t.Errorf(`sourcing tags.env set %q, expected %q`, out, expected)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "tags.json"), []byte("{}"), 0644); !errors.Is(err, syscall.EPERM) {
+		t.Errorf(`expected EPERM writing tags.json, got %v`, err)
+	}
+	if err := os.Remove(path.Join(dir, "tags.env")); !errors.Is(err, syscall.EPERM) {
+		t.Errorf(`expected EPERM removing tags.env, got %v`, err)
+	}
+}
+
+func TestTagsFs_aggregates_source(t *testing.T) {
+	source := &mapSource{tags: map[string]string{"app:env": "prod", "Name": "web-1"}}
+	dir, cleanup := setupSource(t, source, func(fs *TagsFs) {
+		fs.Filter = &KeyFilter{StripPrefix: "app:"}
+	})
+	defer cleanup()
+
+	contents, err := ioutil.ReadFile(path.Join(dir, "tags.env"))
+	if err != nil {
+		t.Fatalf(`error reading tags.env: %s`, err)
+	}
+	if expected := "TAG_NAME='web-1'\nTAG_ENV='prod'\n"; string(contents) != expected {
+		t.Errorf(`tags.env holds %q, expected %q`, contents, expected)
+	}
+}
+
+func TestKeyFilter(t *testing.T) {
+	filter, err := NewKeyFilter([]string{"app:*", "Name", "team/[a-c]?"}, []string{"*:secret", "team/[!a]*"}, "")
+	if err != nil {
+		t.Fatalf(`error creating filter: %s`, err)
+	}
+
+	for key, expected := range map[string]bool{
+		"app:env":       true,
+		"app:a/b":       true,
+		"app:secret":    false,
+		"Name":          true,
+		"Names":         false,
+		"team/ab":       true,
+		"team/bb":       false,
+		"team/abc":      false,
+		"aws:autoscale": false,
+	} {
+		if match := filter.Match(key); match != expected {
+			t.Errorf(`filter matched %s: %t, expected %t`, key, match, expected)
+		}
+	}
+
+	unicode, err := NewKeyFilter([]string{"éc*", "équipe/[àé]?"}, nil, "")
+	if err != nil {
+		t.Fatalf(`error creating filter: %s`, err)
+	}
+	for key, expected := range map[string]bool{
+		"école":      true,
+		"ecole":      false,
+		"équipe/àb":  true,
+		"équipe/éb":  true,
+		"équipe/ab":  false,
+		"équipe/àbc": false,
+	} {
+		if match := unicode.Match(key); match != expected {
+			t.Errorf(`filter matched %s: %t, expected %t`, key, match, expected)
+		}
+	}
+
+	if _, err := NewKeyFilter([]string{"app:[env"}, nil, ""); err == nil {
+		t.Errorf(`expected error for unterminated [`)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		expected fuse.Status
+	}{
+		{errors.New("failed"), fuse.EIO},
+		{&StatusError{fuse.EACCES, errors.New("denied")}, fuse.EACCES},
+		{fmt.Errorf("failed to query AWS API: %w", context.Canceled), fuse.EINTR},
+		{awsError(apiError("UnauthorizedOperation", "denied")), fuse.EACCES},
+		{awsError(apiError("TagLimitExceeded", "too many tags")), fuse.Status(syscall.ENOSPC)},
+		{awsError(apiError("UnknownError", "mock error")), fuse.EIO},
+	} {
+		if code := errorStatus(test.err); code != test.expected {
+			t.Errorf(`error %q mapped to %s, expected %s`, test.err, code, test.expected)
+		}
+	}
+}
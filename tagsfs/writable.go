@@ -0,0 +1,343 @@
+package tagsfs
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/jszwedko/ec2-metadatafs/internal/fuseutil"
+)
+
+// When Writable is set and the source is a WritableTagSource, tags can be
+// changed through the mount:
+//
+//   - writing to a file, or creating one, sets the tag once the file is
+//     closed, so that a truncate followed by writes is a single CreateTags
+//     call with an EC2Source. A single trailing newline is dropped, so that
+//     `echo value > tags/Name` sets the value "value".
+//   - removing a file deletes the tag
+//   - renaming a file sets the tag under its new key and deletes the old one
+//
+// The aggregate files tags.json and tags.env are always read-only. Only the
+// owner of the mount and root can change tags (see fuseutil.Allowed), as
+// changes are made with the credentials of the mount.
+
+// maxValueSize is the most that can be written to a tag file: EC2 tag values
+// are at most 256 characters, of up to utf8.UTFMax bytes, and a trailing
+// newline is dropped
+const maxValueSize = 256*utf8.UTFMax + 1
+
+// setTag sets the value of a tag through the source
+func (fs *TagsFs) setTag(ctx context.Context, key string, value []byte) fuse.Status {
+	source, ok := fs.writableSource()
+	if !ok {
+		return fuse.EPERM
+	}
+
+	sourceKey, code := fs.writeKey(ctx, key)
+	if code != fuse.OK {
+		return code
+	}
+
+	if err := source.SetTag(ctx, sourceKey, string(value)); err != nil {
+		fs.Logger.Errorf("failed to set tag %s: %s", sourceKey, err)
+		return errorStatus(err)
+	}
+
+	fs.observe(fs.keyPath(key), value)
+	return fuse.OK
+}
+
+// deleteTag removes a tag through the source
+func (fs *TagsFs) deleteTag(ctx context.Context, key string) fuse.Status {
+	source, ok := fs.writableSource()
+	if !ok {
+		return fuse.EPERM
+	}
+
+	sourceKey, _, ok, err := fs.lookup(ctx, key)
+	if err != nil {
+		fs.Logger.Errorf("failed to read tag %s: %s", sourceKey, err)
+		return errorStatus(err)
+	}
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	if err := source.DeleteTag(ctx, sourceKey); err != nil {
+		fs.Logger.Errorf("failed to delete tag %s: %s", sourceKey, err)
+		return errorStatus(err)
+	}
+
+	fs.observe(fs.keyPath(key), nil)
+	return fuse.OK
+}
+
+// writeKey returns the key of the tag written to through key: the tag shown
+// under it if there is one, otherwise a new tag, which must not be filtered
+// out
+func (fs *TagsFs) writeKey(ctx context.Context, key string) (string, fuse.Status) {
+	sourceKey, _, ok, err := fs.lookup(ctx, key)
+	if err != nil {
+		fs.Logger.Errorf("failed to read tag %s: %s", sourceKey, err)
+		return "", errorStatus(err)
+	}
+	if ok {
+		return sourceKey, fuse.OK
+	}
+
+	candidates := fs.Filter.candidates(key)
+	sourceKey = candidates[len(candidates)-1]
+	if !fs.Filter.Match(sourceKey) {
+		fs.Logger.Errorf("tag %s is filtered out", sourceKey)
+		return "", fuse.EPERM
+	}
+	return sourceKey, fuse.OK
+}
+
+// Create starts a new tag, which is set when the file is closed
+func (fs *TagsFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if !fs.writable() || isAggregate(name) {
+		return nil, fuse.EPERM
+	}
+	if !fuseutil.Allowed(context) {
+		return nil, fuse.EACCES
+	}
+
+	key, ok := fs.tagKey(name)
+	if !ok {
+		fs.Logger.Errorf("%s is not the escaped form of a tag key", name)
+		return nil, fuse.EINVAL
+	}
+
+	f := newTagFile(fs, name, key, nil, true)
+
+	// go-fuse looks up the attributes of the new file before it knows about
+	// the handle, and the tag does not exist until the file is flushed
+	fs.createdMu.Lock()
+	if fs.created == nil {
+		fs.created = map[string]*tagFile{}
+	}
+	fs.created[name] = f
+	fs.createdMu.Unlock()
+
+	return f, fuse.OK
+}
+
+// createdAttr returns the attributes of a file created but not yet flushed
+func (fs *TagsFs) createdAttr(name string) (*fuse.Attr, bool) {
+	fs.createdMu.Lock()
+	f, ok := fs.created[name]
+	fs.createdMu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	attr := &fuse.Attr{}
+	f.GetAttr(attr)
+	return attr, true
+}
+
+// forgetCreated stops reporting f as created once it is flushed or closed
+func (fs *TagsFs) forgetCreated(f *tagFile) {
+	fs.createdMu.Lock()
+	defer fs.createdMu.Unlock()
+
+	if fs.created[f.path] == f {
+		delete(fs.created, f.path)
+	}
+}
+
+// Truncate sets a tag to a prefix of its value. The kernel truncates through
+// the open file instead when opening with O_TRUNC.
+func (fs *TagsFs) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	if !fs.writable() || isAggregate(name) {
+		return fuse.EPERM
+	}
+	if !fuseutil.Allowed(context) {
+		return fuse.EACCES
+	}
+
+	key, ok := fs.tagKey(name)
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	ctx := fuseutil.RequestContext(context)
+	value, code := fs.getTag(ctx, key)
+	if code != fuse.OK {
+		return code
+	}
+	if size > uint64(len(value)) {
+		return fuse.EINVAL
+	}
+
+	return fs.setTag(ctx, key, value[:size])
+}
+
+// Unlink deletes the tag
+func (fs *TagsFs) Unlink(name string, context *fuse.Context) fuse.Status {
+	if !fs.writable() || isAggregate(name) {
+		return fuse.EPERM
+	}
+	if !fuseutil.Allowed(context) {
+		return fuse.EACCES
+	}
+
+	key, ok := fs.tagKey(name)
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	ctx := fuseutil.RequestContext(context)
+	if _, code := fs.getTag(ctx, key); code != fuse.OK {
+		return code
+	}
+
+	return fs.deleteTag(ctx, key)
+}
+
+// Rename moves the value of a tag to a new key
+func (fs *TagsFs) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if !fs.writable() || isAggregate(oldName) || isAggregate(newName) {
+		return fuse.EPERM
+	}
+	if !fuseutil.Allowed(context) {
+		return fuse.EACCES
+	}
+
+	oldKey, ok := fs.tagKey(oldName)
+	if !ok {
+		return fuse.ENOENT
+	}
+	newKey, ok := fs.tagKey(newName)
+	if !ok {
+		fs.Logger.Errorf("%s is not the escaped form of a tag key", newName)
+		return fuse.EINVAL
+	}
+
+	ctx := fuseutil.RequestContext(context)
+	value, code := fs.getTag(ctx, oldKey)
+	if code != fuse.OK {
+		return code
+	}
+
+	if code := fs.setTag(ctx, newKey, value); code != fuse.OK {
+		return code
+	}
+	return fs.deleteTag(ctx, oldKey)
+}
+
+// Utimens is accepted so that `touch` works, tags have no times to set
+func (fs *TagsFs) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if !fs.writable() || isAggregate(name) {
+		return fuse.EPERM
+	}
+	if !fuseutil.Allowed(context) {
+		return fuse.EACCES
+	}
+
+	return fuse.OK
+}
+
+// tagFile buffers the value of a tag being written, setting it on Flush
+type tagFile struct {
+	nodefs.File
+
+	fs   *TagsFs
+	path string
+	key  string
+
+	mu    sync.Mutex
+	value []byte
+	dirty bool
+}
+
+func newTagFile(fs *TagsFs, path, key string, value []byte, dirty bool) *tagFile {
+	return &tagFile{
+		File:  nodefs.NewDefaultFile(),
+		fs:    fs,
+		path:  path,
+		key:   key,
+		value: value,
+		dirty: dirty,
+	}
+}
+
+func (f *tagFile) GetAttr(out *fuse.Attr) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out.Mode = fuse.S_IFREG | f.fs.mode(0444)
+	out.Size = uint64(len(f.value))
+	return fuse.OK
+}
+
+func (f *tagFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if off >= int64(len(f.value)) {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	n := copy(dest, f.value[off:])
+	return fuse.ReadResultData(dest[:n]), fuse.OK
+}
+
+func (f *tagFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if off < 0 {
+		return 0, fuse.EINVAL
+	}
+	if off > maxValueSize || int(off)+len(data) > maxValueSize {
+		return 0, fuse.Status(syscall.EFBIG)
+	}
+	if end := int(off) + len(data); end > len(f.value) {
+		f.value = append(f.value, make([]byte, end-len(f.value))...)
+	}
+	copy(f.value[off:], data)
+	f.dirty = true
+	return uint32(len(data)), fuse.OK
+}
+
+func (f *tagFile) Truncate(size uint64) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if size > uint64(len(f.value)) {
+		return fuse.EINVAL
+	}
+	f.value = f.value[:size]
+	f.dirty = true
+	return fuse.OK
+}
+
+// Flush sets the tag if the file was changed since it was opened or last
+// flushed
+func (f *tagFile) Flush() fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.dirty {
+		return fuse.OK
+	}
+
+	// nodefs.File.Flush is not given the context of the request
+	code := f.fs.setTag(context.Background(), f.key, []byte(strings.TrimSuffix(string(f.value), "\n")))
+	if code == fuse.OK {
+		f.dirty = false
+		f.fs.forgetCreated(f)
+	}
+	return code
+}
+
+func (f *tagFile) Release() {
+	f.fs.forgetCreated(f)
+}